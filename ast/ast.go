@@ -31,10 +31,16 @@ type Text struct {
 type WarningType string
 
 const (
-	WarningLineTooLong WarningType = "line_too_long"
+	WarningLineTooLong        WarningType = "line_too_long"
+	WarningUnreachableCode    WarningType = "unreachable_code"
+	WarningImplicitReturn     WarningType = "implicit_return"
+	WarningUndefinedSymbol    WarningType = "undefined_symbol"
+	WarningDeprecatedCommand  WarningType = "deprecated_command"
+	WarningSymbolKindMismatch WarningType = "symbol_kind_mismatch"
+	WarningDuplicateCase      WarningType = "duplicate_case"
 )
 
-// Warning represents a non-fatal diagnostic produced during parsing.
+// Warning represents a non-fatal diagnostic produced during parsing or emitting.
 type Warning struct {
 	Type            WarningType
 	LineNumberStart int
@@ -64,10 +70,18 @@ func (p *Program) TokenLiteral() string {
 // ScriptStatement is a Poryscript script statement. Script statements define
 // the block of a script's execution.
 type ScriptStatement struct {
-	Token token.Token
-	Name  *Identifier
-	Body  *BlockStatement
-	Scope token.Type
+	Token  token.Token
+	Name   *Identifier
+	Body   *BlockStatement
+	Scope  token.Type
+	Locals []*LocalDeclaration
+	// Params is nil if the script doesn't declare a parameter list.
+	Params []*LocalDeclaration
+	// ReturnVar is the var that the script returns its value in, if it returns one.
+	ReturnVar string
+	// Epilogue holds the statements of the script's template that run when
+	// execution reaches the end of the script's body.
+	Epilogue []Statement
 }
 
 func (ss *ScriptStatement) AllChildren() []Statement {
@@ -79,6 +93,15 @@ func (ss *ScriptStatement) statementNode() {}
 // TokenLiteral returns a string representation of the script statement.
 func (ss *ScriptStatement) TokenLiteral() string { return ss.Token.Literal }
 
+// LocalDeclaration is a script-local temporary declared with 'let'. Value is
+// the temporary that the local was allocated to.
+type LocalDeclaration struct {
+	Token token.Token
+	Name  *Identifier
+	Type  token.Type
+	Value string
+}
+
 // BlockStatement is a Poryscript block, which can hold many statements and blocks inside.
 // It is defined by curly braces.
 type BlockStatement struct {
@@ -150,6 +173,9 @@ func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
 type RawStatement struct {
 	Token token.Token
 	Value string
+	// NoReturn is true for raw statements inside of scripts that never continue
+	// to the statement after them, such as a macro that ends the script.
+	NoReturn bool
 }
 
 func (rs *RawStatement) AllChildren() []Statement {
@@ -0,0 +1,497 @@
+// Package cheader reads integer constants from C header files, such as the
+// ones in the decomp projects' include/constants directory.
+package cheader
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Constant is an integer constant defined in a C header, either with #define
+// or as an enum value.
+type Constant struct {
+	Name  string
+	Value int64
+	// Evaluated is false when the constant's value couldn't be evaluated, such
+	// as a define that refers to a constant from another header. Its Value is
+	// 0, but the name is still defined.
+	Evaluated bool
+	File      string
+	Line      int
+}
+
+// Constants is a set of constants read from C headers.
+type Constants struct {
+	constants map[string]Constant
+	names     []string
+}
+
+// New creates an empty set of constants.
+func New() *Constants {
+	return &Constants{
+		constants: make(map[string]Constant),
+	}
+}
+
+// ParseFile reads the constants defined in a C header file.
+func (c *Constants) ParseFile(filepath string) error {
+	bytes, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+	c.Parse(string(bytes), filepath)
+	return nil
+}
+
+// Parse reads the constants defined in the contents of a C header. Only
+// '#define NAME value' and enum values are read. Their values can use
+// constants defined earlier. Constants whose values don't evaluate to an
+// integer, such as strings or references to constants from other headers, are
+// still defined, but they aren't Evaluated. Function-like macros are skipped.
+// Other preprocessor directives, such as '#ifdef', are ignored.
+func (c *Constants) Parse(input, filename string) {
+	tokens := tokenize(stripComments(input), true)
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		switch {
+		case tok.kind == tokenDirective:
+			c.parseDefine(tok, filename)
+		case tok.kind == tokenIdent && tok.text == "enum":
+			i = c.parseEnum(tokens, i+1, filename)
+		}
+	}
+}
+
+// Lookup returns the constant with the given name.
+func (c *Constants) Lookup(name string) (Constant, bool) {
+	constant, ok := c.constants[name]
+	return constant, ok
+}
+
+// Names returns the names of all constants, in the order they were defined.
+func (c *Constants) Names() []string {
+	return c.names
+}
+
+// Len returns the number of constants.
+func (c *Constants) Len() int {
+	return len(c.names)
+}
+
+func (c *Constants) lookupValue(name string) (int64, bool) {
+	constant, ok := c.constants[name]
+	return constant.Value, ok && constant.Evaluated
+}
+
+func (c *Constants) add(name string, value int64, evaluated bool, filename string, line int) {
+	if _, ok := c.constants[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	if !evaluated {
+		value = 0
+	}
+	c.constants[name] = Constant{
+		Name:      name,
+		Value:     value,
+		Evaluated: evaluated,
+		File:      filename,
+		Line:      line,
+	}
+}
+
+func (c *Constants) parseDefine(directive headerToken, filename string) {
+	text := strings.TrimSpace(strings.TrimPrefix(directive.text, "#"))
+	if !strings.HasPrefix(text, "define") {
+		return
+	}
+	text = strings.TrimPrefix(text, "define")
+	if text == "" || (text[0] != ' ' && text[0] != '\t') {
+		return
+	}
+	text = strings.TrimSpace(text)
+	end := 0
+	for end < len(text) && isIdentChar(rune(text[end])) {
+		end++
+	}
+	name := text[:end]
+	// Skip function-like macros, such as "#define FOO(x) ((x) + 1)".
+	if name == "" || (end < len(text) && text[end] == '(') {
+		return
+	}
+	value, ok := Evaluate(text[end:], c.lookupValue)
+	c.add(name, value, ok, filename, directive.line)
+}
+
+// Parses the values of an enum, such as "enum { A, B = 5, C }". Returns the
+// index of the last token of the enum.
+func (c *Constants) parseEnum(tokens []headerToken, i int, filename string) int {
+	if i < len(tokens) && tokens[i].kind == tokenIdent {
+		i++
+	}
+	if i >= len(tokens) || tokens[i].text != "{" {
+		return i - 1
+	}
+	i++
+	var value int64
+	// An enum value without an explicit value can't be known if the previous
+	// value couldn't be evaluated.
+	known := true
+	for i < len(tokens) && tokens[i].text != "}" {
+		if tokens[i].kind == tokenDirective {
+			c.parseDefine(tokens[i], filename)
+			i++
+			continue
+		}
+		nameToken := tokens[i]
+		i++
+		// Read the explicit value, if there is one.
+		var expr []string
+		if i < len(tokens) && tokens[i].text == "=" {
+			i++
+			depth := 0
+			for ; i < len(tokens); i++ {
+				text := tokens[i].text
+				if depth == 0 && (text == "," || text == "}") {
+					break
+				}
+				if text == "(" {
+					depth++
+				} else if text == ")" {
+					depth--
+				}
+				expr = append(expr, text)
+			}
+		}
+		if expr != nil {
+			value, known = Evaluate(strings.Join(expr, " "), c.lookupValue)
+		}
+		if nameToken.kind == tokenIdent {
+			c.add(nameToken.text, value, known, filename, nameToken.line)
+		}
+		value++
+		if i < len(tokens) && tokens[i].text == "," {
+			i++
+		}
+	}
+	return i
+}
+
+// Evaluate evaluates a C integer expression, such as "(FLAG_BASE + 0x20)".
+// Identifiers are resolved with lookup. Returns false if the expression
+// can't be evaluated.
+func Evaluate(expr string, lookup func(string) (int64, bool)) (int64, bool) {
+	tokens := tokenize(expr, false)
+	if len(tokens) == 0 {
+		return 0, false
+	}
+	e := &evaluator{tokens: tokens, lookup: lookup}
+	value, ok := e.parseBinary(0)
+	if !ok || e.pos != len(e.tokens) {
+		return 0, false
+	}
+	return value, true
+}
+
+type evaluator struct {
+	tokens []headerToken
+	pos    int
+	lookup func(string) (int64, bool)
+}
+
+var binaryPrecedences = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, "<=": 7, ">": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+func (e *evaluator) peek() string {
+	if e.pos >= len(e.tokens) {
+		return ""
+	}
+	return e.tokens[e.pos].text
+}
+
+func (e *evaluator) parseBinary(minPrecedence int) (int64, bool) {
+	left, ok := e.parseUnary()
+	if !ok {
+		return 0, false
+	}
+	for {
+		operator := e.peek()
+		precedence, isBinary := binaryPrecedences[operator]
+		if !isBinary || precedence <= minPrecedence {
+			return left, true
+		}
+		e.pos++
+		right, ok := e.parseBinary(precedence)
+		if !ok {
+			return 0, false
+		}
+		left, ok = applyBinary(operator, left, right)
+		if !ok {
+			return 0, false
+		}
+	}
+}
+
+func (e *evaluator) parseUnary() (int64, bool) {
+	if e.pos >= len(e.tokens) {
+		return 0, false
+	}
+	tok := e.tokens[e.pos]
+	e.pos++
+	switch {
+	case tok.text == "-" || tok.text == "+" || tok.text == "~" || tok.text == "!":
+		value, ok := e.parseUnary()
+		if !ok {
+			return 0, false
+		}
+		switch tok.text {
+		case "-":
+			return -value, true
+		case "~":
+			return ^value, true
+		case "!":
+			return boolToInt(value == 0), true
+		}
+		return value, true
+	case tok.text == "(":
+		value, ok := e.parseBinary(0)
+		if !ok || e.peek() != ")" {
+			return 0, false
+		}
+		e.pos++
+		return value, true
+	case tok.kind == tokenNumber:
+		return parseNumber(tok.text)
+	case tok.kind == tokenIdent:
+		return e.lookup(tok.text)
+	}
+	return 0, false
+}
+
+func applyBinary(operator string, left, right int64) (int64, bool) {
+	switch operator {
+	case "||":
+		return boolToInt(left != 0 || right != 0), true
+	case "&&":
+		return boolToInt(left != 0 && right != 0), true
+	case "|":
+		return left | right, true
+	case "^":
+		return left ^ right, true
+	case "&":
+		return left & right, true
+	case "==":
+		return boolToInt(left == right), true
+	case "!=":
+		return boolToInt(left != right), true
+	case "<":
+		return boolToInt(left < right), true
+	case "<=":
+		return boolToInt(left <= right), true
+	case ">":
+		return boolToInt(left > right), true
+	case ">=":
+		return boolToInt(left >= right), true
+	case "<<":
+		if right < 0 || right > 63 {
+			return 0, false
+		}
+		return left << uint(right), true
+	case ">>":
+		if right < 0 || right > 63 {
+			return 0, false
+		}
+		return left >> uint(right), true
+	case "+":
+		return left + right, true
+	case "-":
+		return left - right, true
+	case "*":
+		return left * right, true
+	case "/", "%":
+		if right == 0 {
+			return 0, false
+		}
+		if operator == "/" {
+			return left / right, true
+		}
+		return left % right, true
+	}
+	return 0, false
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Parses a C integer literal, such as "0x20", "017", "0b101", or "5u".
+func parseNumber(text string) (int64, bool) {
+	text = strings.TrimRight(text, "uUlL")
+	base := 10
+	lower := strings.ToLower(text)
+	switch {
+	case strings.HasPrefix(lower, "0x"):
+		base, text = 16, text[2:]
+	case strings.HasPrefix(lower, "0b"):
+		base, text = 2, text[2:]
+	case len(text) > 1 && text[0] == '0':
+		base, text = 8, text[1:]
+	}
+	value, err := strconv.ParseUint(text, base, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(value), true
+}
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenNumber
+	tokenPunct
+	// An entire preprocessor directive line, such as "#define FOO 1".
+	tokenDirective
+	// String and character literals, which can't be evaluated.
+	tokenLiteral
+)
+
+type headerToken struct {
+	kind tokenKind
+	text string
+	line int
+}
+
+var multiCharOperators = []string{"<<", ">>", "<=", ">=", "==", "!=", "&&", "||"}
+
+// Splits C source into tokens. If directives is true, preprocessor directives
+// at the start of a line are read as a single token, including any lines
+// joined with a backslash.
+func tokenize(input string, directives bool) []headerToken {
+	var tokens []headerToken
+	line := 1
+	lineStart := true
+	for i := 0; i < len(input); {
+		ch := rune(input[i])
+		switch {
+		case ch == '\n':
+			line++
+			lineStart = true
+			i++
+			continue
+		case unicode.IsSpace(ch):
+			i++
+			continue
+		case ch == '#' && lineStart && directives:
+			start, startLine := i, line
+			for i < len(input) && input[i] != '\n' {
+				if input[i] == '\\' && i+1 < len(input) && input[i+1] == '\n' {
+					line++
+					i++
+				}
+				i++
+			}
+			text := strings.Replace(input[start:i], "\\\n", " ", -1)
+			tokens = append(tokens, headerToken{tokenDirective, text, startLine})
+		case isIdentChar(ch) && !unicode.IsDigit(ch):
+			start := i
+			for i < len(input) && isIdentChar(rune(input[i])) {
+				i++
+			}
+			tokens = append(tokens, headerToken{tokenIdent, input[start:i], line})
+		case unicode.IsDigit(ch):
+			start := i
+			for i < len(input) && isIdentChar(rune(input[i])) {
+				i++
+			}
+			tokens = append(tokens, headerToken{tokenNumber, input[start:i], line})
+		case ch == '"' || ch == '\'':
+			start := i
+			i++
+			for i < len(input) && rune(input[i]) != ch && input[i] != '\n' {
+				if input[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+			if i > len(input) {
+				i = len(input)
+			}
+			tokens = append(tokens, headerToken{tokenLiteral, input[start:i], line})
+		default:
+			text := string(ch)
+			for _, operator := range multiCharOperators {
+				if strings.HasPrefix(input[i:], operator) {
+					text = operator
+					break
+				}
+			}
+			i += len(text)
+			tokens = append(tokens, headerToken{tokenPunct, text, line})
+		}
+		lineStart = false
+	}
+	return tokens
+}
+
+// Replaces comments with spaces, while keeping the newlines inside of block
+// comments, so that line numbers are preserved.
+func stripComments(input string) string {
+	var sb strings.Builder
+	for i := 0; i < len(input); i++ {
+		switch {
+		case strings.HasPrefix(input[i:], "//"):
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+			if i < len(input) {
+				sb.WriteByte('\n')
+			}
+		case strings.HasPrefix(input[i:], "/*"):
+			i += 2
+			for i < len(input) && !strings.HasPrefix(input[i:], "*/") {
+				if input[i] == '\n' {
+					sb.WriteByte('\n')
+				}
+				i++
+			}
+			i++
+			sb.WriteByte(' ')
+		case input[i] == '"' || input[i] == '\'':
+			quote := input[i]
+			sb.WriteByte(quote)
+			for i++; i < len(input) && input[i] != quote && input[i] != '\n'; i++ {
+				if input[i] == '\\' && i+1 < len(input) {
+					sb.WriteByte(input[i])
+					i++
+				}
+				sb.WriteByte(input[i])
+			}
+			if i < len(input) {
+				sb.WriteByte(input[i])
+			}
+		default:
+			sb.WriteByte(input[i])
+		}
+	}
+	return sb.String()
+}
+
+func isIdentChar(ch rune) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9')
+}
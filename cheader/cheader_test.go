@@ -0,0 +1,139 @@
+package cheader
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	input := `#ifndef GUARD_CONSTANTS_FLAGS_H
+#define GUARD_CONSTANTS_FLAGS_H
+
+#include "constants/opponents.h"
+
+#define TEMP_FLAGS_START 0x0
+#define FLAG_TEMP_1      (TEMP_FLAGS_START + 0x1) // Comment
+#define FLAG_TEMP_2      (TEMP_FLAGS_START + \
+                          0x2)
+/* #define FLAG_COMMENTED 5
+ */
+#define FLAG_SHIFTED     (1 << 4) | 1
+#define MAX_MONEY        999999u
+#define OCTAL            017
+#define NEGATIVE         -(FLAG_TEMP_2 * 3)
+#define STRING_DEFINE    "not a number"
+#define FUNCTION(x)      ((x) + 1)
+#define UNKNOWN_REF      (SOME_UNKNOWN + 1)
+#define CAST_VALUE       ((u16)5)
+
+enum {
+    ITEM_NONE,
+    ITEM_POTION = FLAG_TEMP_2 + 10,
+    ITEM_ANTIDOTE,
+#ifdef BUGFIX
+    ITEM_BUGFIX,
+#endif
+    ITEM_UNKNOWN = SOME_UNKNOWN,
+    ITEM_AFTER_UNKNOWN,
+    ITEM_LAST = ITEM_ANTIDOTE * (2 + 1),
+};
+
+typedef enum Direction
+{
+    DIR_NONE,
+    DIR_SOUTH,
+} Direction;
+
+#define AFTER_ENUM (ITEM_LAST + DIR_SOUTH)
+
+#endif // GUARD_CONSTANTS_FLAGS_H
+`
+	c := New()
+	c.Parse(input, "flags.h")
+
+	// Constants whose values can't be evaluated are still defined, so that
+	// their names are known.
+	tests := []struct {
+		name      string
+		value     int64
+		evaluated bool
+		line      int
+	}{
+		{"GUARD_CONSTANTS_FLAGS_H", 0, false, 2},
+		{"TEMP_FLAGS_START", 0, true, 6},
+		{"FLAG_TEMP_1", 1, true, 7},
+		{"FLAG_TEMP_2", 2, true, 8},
+		{"FLAG_SHIFTED", 17, true, 12},
+		{"MAX_MONEY", 999999, true, 13},
+		{"OCTAL", 15, true, 14},
+		{"NEGATIVE", -6, true, 15},
+		{"STRING_DEFINE", 0, false, 16},
+		{"UNKNOWN_REF", 0, false, 18},
+		{"CAST_VALUE", 0, false, 19},
+		{"ITEM_NONE", 0, true, 22},
+		{"ITEM_POTION", 12, true, 23},
+		{"ITEM_ANTIDOTE", 13, true, 24},
+		{"ITEM_BUGFIX", 14, true, 26},
+		{"ITEM_UNKNOWN", 0, false, 28},
+		{"ITEM_AFTER_UNKNOWN", 0, false, 29},
+		{"ITEM_LAST", 39, true, 30},
+		{"DIR_NONE", 0, true, 35},
+		{"DIR_SOUTH", 1, true, 36},
+		{"AFTER_ENUM", 40, true, 39},
+	}
+	if c.Len() != len(tests) {
+		t.Fatalf("Incorrect number of constants. Expected %d, got %d: %v", len(tests), c.Len(), c.Names())
+	}
+	for i, tt := range tests {
+		if name := c.Names()[i]; name != tt.name {
+			t.Fatalf("Incorrect constant %d. Expected %s, got %s", i, tt.name, name)
+		}
+		constant, ok := c.Lookup(tt.name)
+		if !ok {
+			t.Fatalf("Expected constant %s to be defined", tt.name)
+		}
+		if constant.Evaluated != tt.evaluated {
+			t.Errorf("Incorrect evaluated for %s. Expected %t, got %t", tt.name, tt.evaluated, constant.Evaluated)
+		}
+		if constant.Value != tt.value {
+			t.Errorf("Incorrect value for %s. Expected %d, got %d", tt.name, tt.value, constant.Value)
+		}
+		if constant.Line != tt.line {
+			t.Errorf("Incorrect line for %s. Expected %d, got %d", tt.name, tt.line, constant.Line)
+		}
+		if constant.File != "flags.h" {
+			t.Errorf("Incorrect file for %s. Expected flags.h, got %s", tt.name, constant.File)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	lookup := func(name string) (int64, bool) {
+		if name == "FOO" {
+			return 10, true
+		}
+		return 0, false
+	}
+	tests := []struct {
+		expr          string
+		expectedValue int64
+		expectedOk    bool
+	}{
+		{"FOO + 1", 11, true},
+		{"FOO * 2 + 3 * 4", 32, true},
+		{"(FOO - 4) / 3 % 5", 2, true},
+		{"0x10 | 0b11 & ~1", 18, true},
+		{"FOO > 5 && !(FOO == 3)", 1, true},
+		{"-FOO >> 1", -5, true},
+		{"BAR + 1", 0, false},
+		{"FOO / 0", 0, false},
+		{"(FOO + 1", 0, false},
+		{"FOO FOO", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		value, ok := Evaluate(tt.expr, lookup)
+		if ok != tt.expectedOk || value != tt.expectedValue {
+			t.Errorf("Incorrect result for '%s'. Expected %d, %t, got %d, %t", tt.expr, tt.expectedValue, tt.expectedOk, value, ok)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/huderlem/poryscript/cheader"
+	"github.com/huderlem/poryscript/parser"
+)
+
+// switchCheckFailure is a combination of compile switches that failed to compile.
+type switchCheckFailure struct {
+	switches map[string]string
+	err      error
+}
+
+type switchCheckResult struct {
+	builds   int
+	failures []switchCheckFailure
+	// Values that the file compares compile switches to, but that aren't
+	// used by any build.
+	unusedValues []parser.SwitchReference
+}
+
+// Compiles the input for every combination of compile switch values. The values
+// of a switch can be listed with the '-s' option, such as "-s VERSION=RUBY,SAPPHIRE".
+// Otherwise, the switch uses every value that the file compares it to, along with
+// a value that none of the file's cases name, so that the '_' fallbacks of poryswitch
+// statements are compiled, too. Switches are discovered as they are used, since code
+// can be excluded by other switches, so the combinations are compiled again until no
+// new switches or values are found. Values that the file uses, but that no build
+// uses, can only be reported for switches whose values are listed.
+func checkAllSwitches(input string, commandConfig parser.CommandConfig, headerConstants *cheader.Constants, options options) switchCheckResult {
+	buildValues := make(map[string][]string)
+	for name, value := range options.compileSwitches {
+		for _, v := range strings.Split(value, ",") {
+			buildValues[name] = append(buildValues[name], strings.TrimSpace(v))
+		}
+	}
+	discoveredValues := make(map[string][]string)
+
+	for {
+		names := []string{}
+		for name := range buildValues {
+			names = append(names, name)
+		}
+		for name := range discoveredValues {
+			if _, ok := buildValues[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		values := make([][]string, len(names))
+		for i, name := range names {
+			values[i] = buildValues[name]
+			if values[i] == nil {
+				values[i] = append(append([]string{}, discoveredValues[name]...), otherSwitchValue)
+			}
+			if len(values[i]) == 0 {
+				values[i] = []string{otherSwitchValue}
+			}
+		}
+
+		result := switchCheckResult{}
+		var references []parser.SwitchReference
+		changed := false
+		forEachSwitchCombination(names, values, func(switches map[string]string) {
+			result.builds++
+			compiled, err := compile(input, commandConfig, headerConstants, options, switches)
+			if err != nil {
+				result.failures = append(result.failures, switchCheckFailure{switches: switches, err: err})
+			}
+			for _, ref := range compiled.switchReferences {
+				references = append(references, ref)
+				if _, ok := buildValues[ref.Switch]; ok {
+					continue
+				}
+				if _, ok := discoveredValues[ref.Switch]; !ok {
+					discoveredValues[ref.Switch] = []string{}
+					changed = true
+				}
+				if ref.Value != "" && !containsString(discoveredValues[ref.Switch], ref.Value) {
+					discoveredValues[ref.Switch] = append(discoveredValues[ref.Switch], ref.Value)
+					changed = true
+				}
+			}
+		})
+		if changed {
+			continue
+		}
+
+		reported := make(map[string]bool)
+		for _, ref := range references {
+			if ref.Value == "" || buildValues[ref.Switch] == nil || containsString(buildValues[ref.Switch], ref.Value) {
+				continue
+			}
+			key := fmt.Sprintf("%d:%d:%s:%s", ref.Token.LineNumber, ref.Token.StartCharIndex, ref.Switch, ref.Value)
+			if !reported[key] {
+				reported[key] = true
+				result.unusedValues = append(result.unusedValues, ref)
+			}
+		}
+		sort.SliceStable(result.unusedValues, func(i, j int) bool {
+			return result.unusedValues[i].Token.LineNumber < result.unusedValues[j].Token.LineNumber
+		})
+		return result
+	}
+}
+
+// A compile switch value that doesn't match any poryswitch case or '#if' comparison.
+const otherSwitchValue = ""
+
+func forEachSwitchCombination(names []string, values [][]string, fn func(map[string]string)) {
+	indexes := make([]int, len(names))
+	for {
+		switches := make(map[string]string, len(names))
+		for i, name := range names {
+			switches[name] = values[i][indexes[i]]
+		}
+		fn(switches)
+		i := len(indexes) - 1
+		for ; i >= 0; i-- {
+			indexes[i]++
+			if indexes[i] < len(values[i]) {
+				break
+			}
+			indexes[i] = 0
+		}
+		if i < 0 {
+			return
+		}
+	}
+}
+
+// Prints the result of checking every combination of compile switches, and
+// returns whether all of them compiled.
+func reportSwitchCheck(result switchCheckResult) bool {
+	for _, failure := range result.failures {
+		log.Printf("PORYSCRIPT ERROR: %s: %s\n", formatSwitches(failure.switches), failure.err.Error())
+	}
+	for _, ref := range result.unusedValues {
+		log.Printf("PORYSCRIPT ERROR: line %d: '%s' isn't a value of compile switch '%s' in any build\n", ref.Token.LineNumber, ref.Value, ref.Switch)
+	}
+	if len(result.failures) > 0 || len(result.unusedValues) > 0 {
+		return false
+	}
+	log.Printf("PORYSCRIPT: all %d combinations of compile switches compiled successfully\n", result.builds)
+	return true
+}
+
+func formatSwitches(switches map[string]string) string {
+	names := []string{}
+	for name := range switches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := switches[name]
+		if value == otherSwitchValue {
+			value = "<other>"
+		}
+		parts[i] = fmt.Sprintf("%s=%s", name, value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/huderlem/poryscript/cheader"
+	"github.com/huderlem/poryscript/parser"
+)
+
+func TestCheckAllSwitches(t *testing.T) {
+	input := `
+script MyScript {
+	poryswitch(VERSION) {
+		RUBY: foo
+		SAPHIRE: bar
+		_: baz
+	}
+}
+
+#if VERSION == RUBY
+poryswitch(LANGUAGE) {
+	GERMAN { script GermanScript { german } }
+	ENGLISH { script EnglishScript { english( } }
+	_ { script OtherScript { other( } }
+}
+#endif
+`
+	tests := []struct {
+		switches         map[string]string
+		expectedBuilds   int
+		expectedFailures []string
+		expectedUnused   []string
+	}{
+		{
+			switches:         map[string]string{},
+			expectedBuilds:   9,
+			expectedFailures: []string{"LANGUAGE=ENGLISH VERSION=RUBY", "LANGUAGE=<other> VERSION=RUBY"},
+		},
+		{
+			switches:         map[string]string{"VERSION": "RUBY, SAPPHIRE", "LANGUAGE": "GERMAN"},
+			expectedBuilds:   2,
+			expectedFailures: []string{},
+			expectedUnused:   []string{"SAPHIRE", "ENGLISH"},
+		},
+	}
+
+	for i, tt := range tests {
+		result := checkAllSwitches(input, parser.CommandConfig{}, cheader.New(), options{compileSwitches: tt.switches})
+		if result.builds != tt.expectedBuilds {
+			t.Fatalf("Test %d: Incorrect number of builds. Expected %d, got %d", i, tt.expectedBuilds, result.builds)
+		}
+		if len(result.failures) != len(tt.expectedFailures) {
+			t.Fatalf("Test %d: Incorrect number of failures. Expected %d, got %d", i, len(tt.expectedFailures), len(result.failures))
+		}
+		for j, expected := range tt.expectedFailures {
+			if switches := formatSwitches(result.failures[j].switches); switches != expected {
+				t.Fatalf("Test %d: Incorrect failure %d. Expected %s, got %s", i, j, expected, switches)
+			}
+		}
+		if len(result.unusedValues) != len(tt.expectedUnused) {
+			t.Fatalf("Test %d: Incorrect number of unused values. Expected %d, got %d", i, len(tt.expectedUnused), len(result.unusedValues))
+		}
+		for j, expected := range tt.expectedUnused {
+			if value := result.unusedValues[j].Value; value != expected {
+				t.Fatalf("Test %d: Incorrect unused value %d. Expected %s, got %s", i, j, expected, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package emitter
+
+import (
+	"sort"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/token"
+)
+
+// The control-flow graph (CFG) is the intermediate representation between the
+// chunked AST and the emitted assembly. Each basic block holds a run of
+// straight-line statements, followed by exactly one terminator that describes
+// how control leaves the block.
+
+// returnTarget is the destination of an edge that exits the script
+// with the "return" command, rather than jumping to another block.
+const returnTarget = -1
+
+// A single basic block in a script's control-flow graph.
+type basicBlock struct {
+	id         int
+	statements []ast.Statement
+	terminator terminator
+	// External blocks stand in for labels defined outside of the script,
+	// so that jumps to them can be represented as regular edges. They
+	// have no statements or terminator, and they are never rendered.
+	externalLabel string
+	// Shared blocks are jumped to from other scripts, so their label
+	// must always be rendered.
+	shared bool
+}
+
+func (b *basicBlock) isExternal() bool {
+	return len(b.externalLabel) > 0
+}
+
+type edgeKind int
+
+const (
+	edgeJump edgeKind = iota
+	edgeTrue
+	edgeFalse
+	edgeCase
+	edgeDefault
+)
+
+// An edge is a single outgoing control-flow path from a block.
+type edge struct {
+	dest      int
+	kind      edgeKind
+	condition *ast.OperatorExpression
+	caseValue token.Token
+}
+
+// A terminator ends a basic block and decides where execution goes next.
+type terminator interface {
+	successors() []edge
+	// Replaces the destination of each outgoing edge with the result of f.
+	retarget(f func(e edge) int)
+}
+
+// Exits the script with a command, such as "end" or "return". The command is
+// empty when the block's last statement already exits, such as a raw statement
+// declared with "noreturn".
+type exitTerminator struct {
+	command string
+}
+
+func (t *exitTerminator) successors() []edge {
+	return []edge{}
+}
+
+func (t *exitTerminator) retarget(f func(e edge) int) {}
+
+// Unconditionally jumps to another block.
+type jumpTerminator struct {
+	dest int
+}
+
+func (t *jumpTerminator) successors() []edge {
+	return []edge{{dest: t.dest, kind: edgeJump}}
+}
+
+func (t *jumpTerminator) retarget(f func(e edge) int) {
+	t.dest = f(edge{dest: t.dest, kind: edgeJump})
+}
+
+// Jumps to trueDest if the condition holds. Otherwise, continues to falseDest.
+type conditionalTerminator struct {
+	condition *ast.OperatorExpression
+	preamble  *ast.CommandStatement
+	trueDest  int
+	falseDest int
+	// The result of an identical comparison is still available from every
+	// predecessor, so the comparison command can be skipped.
+	reusesComparison bool
+}
+
+func (t *conditionalTerminator) successors() []edge {
+	return []edge{
+		{dest: t.trueDest, kind: edgeTrue, condition: t.condition},
+		{dest: t.falseDest, kind: edgeFalse, condition: t.condition},
+	}
+}
+
+func (t *conditionalTerminator) retarget(f func(e edge) int) {
+	t.trueDest = f(edge{dest: t.trueDest, kind: edgeTrue, condition: t.condition})
+	t.falseDest = f(edge{dest: t.falseDest, kind: edgeFalse, condition: t.condition})
+}
+
+// Calls a script if the condition holds, and then continues to dest. The command
+// is the conditional call variant of the condition's branch command, such as "call_if_set".
+type conditionalCallTerminator struct {
+	condition *ast.OperatorExpression
+	preamble  *ast.CommandStatement
+	command   string
+	callee    string
+	dest      int
+}
+
+func (t *conditionalCallTerminator) successors() []edge {
+	return []edge{{dest: t.dest, kind: edgeJump}}
+}
+
+func (t *conditionalCallTerminator) retarget(f func(e edge) int) {
+	t.dest = f(edge{dest: t.dest, kind: edgeJump})
+}
+
+type switchTerminatorCase struct {
+	value token.Token
+	dest  int
+}
+
+// Jumps to the case matching the operand's value. Otherwise, continues to defaultDest.
+type switchTerminator struct {
+	operand     token.Token
+	cases       []switchTerminatorCase
+	defaultDest int
+}
+
+func (t *switchTerminator) successors() []edge {
+	edges := make([]edge, 0, len(t.cases)+1)
+	for _, c := range t.cases {
+		edges = append(edges, edge{dest: c.dest, kind: edgeCase, caseValue: c.value})
+	}
+	return append(edges, edge{dest: t.defaultDest, kind: edgeDefault})
+}
+
+func (t *switchTerminator) retarget(f func(e edge) int) {
+	for i, c := range t.cases {
+		t.cases[i].dest = f(edge{dest: c.dest, kind: edgeCase, caseValue: c.value})
+	}
+	t.defaultDest = f(edge{dest: t.defaultDest, kind: edgeDefault})
+}
+
+// Returns the destination of a terminator that unconditionally continues
+// somewhere else, including exiting with "return". ok is false for any
+// other terminator.
+func continuationDest(t terminator) (int, bool) {
+	switch t := t.(type) {
+	case *jumpTerminator:
+		return t.dest, true
+	case *exitTerminator:
+		if t.command == "return" {
+			return returnTarget, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the destination that is allowed to be reached by falling through
+// from the end of the block, rather than with an explicit jump.
+func fallthroughDest(t terminator) int {
+	switch t := t.(type) {
+	case *jumpTerminator:
+		return t.dest
+	case *conditionalTerminator:
+		return t.falseDest
+	case *conditionalCallTerminator:
+		return t.dest
+	case *switchTerminator:
+		return t.defaultDest
+	}
+	return returnTarget
+}
+
+// The control-flow graph of a single script.
+type scriptGraph struct {
+	scriptName string
+	isGlobal   bool
+	blocks     map[int]*basicBlock
+	// The order in which blocks are rendered. The entry block is always first.
+	layout []int
+}
+
+func buildScriptGraph(chunks map[int]*chunk, scriptName string, isGlobal bool) *scriptGraph {
+	g := &scriptGraph{
+		scriptName: scriptName,
+		isGlobal:   isGlobal,
+		blocks:     make(map[int]*basicBlock, len(chunks)),
+	}
+	for id, c := range chunks {
+		g.blocks[id] = c.toBlock()
+	}
+	return g
+}
+
+// Returns the ids of the script's own blocks in ascending order.
+// External blocks are excluded.
+func (g *scriptGraph) sortedIDs() []int {
+	ids := make([]int, 0, len(g.blocks))
+	for id, block := range g.blocks {
+		if !block.isExternal() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Returns the id of the external block for the given label, creating
+// it if it doesn't exist yet.
+func (g *scriptGraph) externalBlock(label string) int {
+	for id, block := range g.blocks {
+		if block.externalLabel == label {
+			return id
+		}
+	}
+	id := g.newBlockID()
+	g.blocks[id] = &basicBlock{id: id, externalLabel: label}
+	return id
+}
+
+// Returns an unused block id.
+func (g *scriptGraph) newBlockID() int {
+	maxID := 0
+	for id := range g.blocks {
+		if id > maxID {
+			maxID = id
+		}
+	}
+	return maxID + 1
+}
+
+// Reports whether control can enter the block from outside of the script's
+// own edges. Besides the script's entry point, this includes blocks containing
+// labels, which can be reached from anywhere, and shared blocks, which other
+// scripts jump to.
+func (g *scriptGraph) isEntryBlock(id int) bool {
+	block := g.blocks[id]
+	return id == 0 || block.shared || block.hasLabelStatement()
+}
+
+// Returns the set of blocks that can be reached from the script's entry points.
+func (g *scriptGraph) reachableBlocks() map[int]bool {
+	reachable := make(map[int]bool)
+	stack := []int{}
+	for _, id := range g.sortedIDs() {
+		if g.isEntryBlock(id) {
+			stack = append(stack, id)
+		}
+	}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == returnTarget || reachable[id] {
+			continue
+		}
+		reachable[id] = true
+		block := g.blocks[id]
+		if block.isExternal() {
+			continue
+		}
+		for _, e := range block.terminator.successors() {
+			stack = append(stack, e.dest)
+		}
+	}
+	return reachable
+}
+
+// Returns the ids of the blocks that can directly transfer control to each block.
+func (g *scriptGraph) predecessors() map[int][]int {
+	preds := make(map[int][]int)
+	for _, id := range g.sortedIDs() {
+		for _, e := range g.blocks[id].terminator.successors() {
+			if e.dest != returnTarget {
+				preds[e.dest] = append(preds[e.dest], id)
+			}
+		}
+	}
+	return preds
+}
+
+func (b *basicBlock) hasLabelStatement() bool {
+	for _, stmt := range b.statements {
+		if _, ok := stmt.(*ast.LabelStatement); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// A pass is a single step that analyzes or transforms the control-flow graphs
+// of the program's scripts.
+type pass struct {
+	name string
+	run  func(graphs []*scriptGraph) error
+}
+
+// Adapts a pass that only needs to look at one script at a time.
+func eachGraph(f func(g *scriptGraph) error) func(graphs []*scriptGraph) error {
+	return func(graphs []*scriptGraph) error {
+		for _, g := range graphs {
+			if err := f(g); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Builds the list of passes that are run on the scripts' control-flow graphs.
+func (e *Emitter) passPipeline() []pass {
+	if e.optimize {
+		return []pass{
+			{name: "lower-goto-commands", run: eachGraph(lowerGotoCommands)},
+			{name: "thread-jumps", run: eachGraph(threadJumps)},
+			// Conditional calls are lowered before tails are merged, so that
+			// every single-call branch becomes a conditional call, rather than
+			// jumping to another script's copy of the call.
+			{name: "lower-conditional-calls", run: eachGraph(e.lowerConditionalCalls)},
+			{name: "remove-unreachable-blocks", run: eachGraph(removeUnreachableBlocks)},
+			{name: "merge-tails", run: e.mergeTails},
+			{name: "thread-jumps", run: eachGraph(threadJumps)},
+			{name: "remove-unreachable-blocks", run: eachGraph(removeUnreachableBlocks)},
+			{name: "reuse-comparisons", run: eachGraph(reuseComparisons)},
+			{name: "layout", run: eachGraph(optimizeBlockOrder)},
+		}
+	}
+	return []pass{
+		{name: "layout", run: eachGraph(sortedBlockOrder)},
+	}
+}
+
+func (e *Emitter) runPasses(graphs []*scriptGraph) error {
+	for _, p := range e.passPipeline() {
+		if err := p.run(graphs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lays out the blocks in the order they were created.
+func sortedBlockOrder(g *scriptGraph) error {
+	g.layout = g.sortedIDs()
+	return nil
+}
+
+// Reorders blocks to take advantage of fall-throughs, rather than using
+// unncessary wasteful "goto" commands.
+//
+// Every block has at most one successor that it can fall through to, so each
+// fall-through that is realized saves exactly one "goto". A block can only be
+// placed directly after one of its predecessors, and the entry block must come
+// first, so the chosen fall-throughs form chains of blocks. Choosing one incoming
+// fall-through for every block that has one, and breaking any loop formed purely
+// by fall-throughs, gives the fewest possible "goto" commands. Loop back-edges
+// are the least preferred fall-throughs, so that loop bodies are laid out
+// contiguously after their headers.
+func optimizeBlockOrder(g *scriptGraph) error {
+	ids := g.sortedIDs()
+	g.layout = make([]int, 0, len(ids))
+	if len(ids) == 0 {
+		return nil
+	}
+
+	preorder, backEdges := g.depthFirstOrder()
+	rank := func(id int) int {
+		if r, ok := preorder[id]; ok {
+			return r
+		}
+		return len(preorder) + id
+	}
+
+	// Gather the fall-through candidates for each block.
+	candidateDest := make(map[int]int)
+	candidatePreds := make(map[int][]int)
+	for _, id := range ids {
+		dest := fallthroughDest(g.blocks[id].terminator)
+		if dest == returnTarget || dest == 0 || dest == id || g.blocks[dest].isExternal() {
+			continue
+		}
+		candidateDest[id] = dest
+		candidatePreds[dest] = append(candidatePreds[dest], id)
+	}
+	for _, preds := range candidatePreds {
+		sort.SliceStable(preds, func(i, j int) bool {
+			return rank(preds[i]) < rank(preds[j])
+		})
+	}
+	isBackEdge := func(from, to int) bool {
+		return backEdges[[2]int{from, to}]
+	}
+
+	// Every block takes its most preferred incoming fall-through.
+	chosenPred := make(map[int]int)
+	for _, id := range ids {
+		preds := candidatePreds[id]
+		if len(preds) == 0 {
+			continue
+		}
+		best := preds[0]
+		for _, pred := range preds {
+			if !isBackEdge(pred, id) {
+				best = pred
+				break
+			}
+		}
+		chosenPred[id] = best
+	}
+
+	// The chosen fall-throughs can form loops, which can't be laid out.
+	// Break each loop at the block where it costs the least.
+	for _, cycle := range g.fallthroughCycles(ids, candidateDest, chosenPred) {
+		onCycle := make(map[int]bool, len(cycle))
+		for _, id := range cycle {
+			onCycle[id] = true
+		}
+		breakAt, replacement := -1, -1
+		for _, id := range cycle {
+			for _, pred := range candidatePreds[id] {
+				if onCycle[pred] {
+					continue
+				}
+				// Prefer replacing a loop back-edge with an edge from outside the loop.
+				if breakAt == -1 || (isBackEdge(chosenPred[id], id) && !isBackEdge(chosenPred[breakAt], breakAt)) {
+					breakAt, replacement = id, pred
+				}
+				break
+			}
+		}
+		if breakAt != -1 {
+			chosenPred[breakAt] = replacement
+			continue
+		}
+		// Nothing outside the loop falls into it, so one fall-through must be dropped.
+		breakAt = cycle[0]
+		for _, id := range cycle {
+			if isBackEdge(chosenPred[id], id) {
+				breakAt = id
+				break
+			}
+		}
+		delete(chosenPred, breakAt)
+	}
+
+	// Lay out the chains of fall-throughs, starting with the entry block's chain.
+	// The remaining chains are placed in the order their blocks were created.
+	next := make(map[int]int, len(chosenPred))
+	for id, pred := range chosenPred {
+		next[pred] = id
+	}
+	heads := []int{}
+	for _, id := range ids {
+		if _, ok := chosenPred[id]; !ok {
+			heads = append(heads, id)
+		}
+	}
+	for _, head := range heads {
+		for id, ok := head, true; ok; id, ok = next[id] {
+			g.layout = append(g.layout, id)
+		}
+	}
+	return nil
+}
+
+// Walks the graph depth-first from the entry block, followed by the other entry
+// blocks. Returns the preorder index of each block, and the set of edges that jump
+// back to a block that is still being visited. Those edges are loop back-edges.
+func (g *scriptGraph) depthFirstOrder() (map[int]int, map[[2]int]bool) {
+	preorder := make(map[int]int)
+	backEdges := make(map[[2]int]bool)
+	onStack := make(map[int]bool)
+	var visit func(id int)
+	visit = func(id int) {
+		preorder[id] = len(preorder)
+		onStack[id] = true
+		// Visit the fall-through successor first, so that the main line of
+		// the script is ordered before its branches.
+		t := g.blocks[id].terminator
+		dests := []int{fallthroughDest(t)}
+		for _, e := range t.successors() {
+			dests = append(dests, e.dest)
+		}
+		for _, dest := range dests {
+			if dest == returnTarget || g.blocks[dest].isExternal() {
+				continue
+			}
+			if onStack[dest] {
+				backEdges[[2]int{id, dest}] = true
+			} else if _, ok := preorder[dest]; !ok {
+				visit(dest)
+			}
+		}
+		onStack[id] = false
+	}
+	for _, id := range g.sortedIDs() {
+		if _, ok := preorder[id]; ok {
+			continue
+		}
+		if g.isEntryBlock(id) {
+			visit(id)
+		}
+	}
+	return preorder, backEdges
+}
+
+// Returns every loop formed entirely by the chosen fall-throughs.
+func (g *scriptGraph) fallthroughCycles(ids []int, candidateDest map[int]int, chosenPred map[int]int) [][]int {
+	cycles := [][]int{}
+	state := make(map[int]int) // 0 = unvisited, 1 = in progress, 2 = done
+	for _, start := range ids {
+		path := []int{}
+		id := start
+		for state[id] == 0 {
+			state[id] = 1
+			path = append(path, id)
+			dest, ok := candidateDest[id]
+			if !ok || chosenPred[dest] != id {
+				break
+			}
+			id = dest
+			if state[id] == 1 {
+				for i, pathID := range path {
+					if pathID == id {
+						cycles = append(cycles, path[i:])
+						break
+					}
+				}
+			}
+		}
+		for _, pathID := range path {
+			state[pathID] = 2
+		}
+	}
+	return cycles
+}
@@ -1,11 +1,7 @@
 package emitter
 
 import (
-	"fmt"
-	"strings"
-
 	"github.com/huderlem/poryscript/ast"
-	"github.com/huderlem/poryscript/parser"
 )
 
 // Represents a single chunk of script output. Each chunk has an associated label in
@@ -18,73 +14,36 @@ type chunk struct {
 	branchBehavior   brancher
 }
 
-func (c *chunk) getLabel(scriptName string) string {
-	if c.id == 0 {
-		// Main script entrypoint label.
-		return scriptName
+// Converts the chunk into a basic block of the script's control-flow graph.
+func (c *chunk) toBlock() *basicBlock {
+	block := &basicBlock{
+		id:         c.id,
+		statements: c.statements,
 	}
-	return fmt.Sprintf("%s_%d", scriptName, c.id)
-}
-
-func (c *chunk) renderLabel(scriptName string, isGlobal bool, sb *strings.Builder) {
-	label := c.getLabel(scriptName)
-	isMainEntryPoint := c.id == 0
-	if isMainEntryPoint && isGlobal {
-		sb.WriteString(fmt.Sprintf("%s::\n", label))
+	if c.branchBehavior != nil {
+		block.terminator = c.branchBehavior.toTerminator()
+	} else if c.returnID == -1 || c.endsWithNoReturn() {
+		block.terminator = &exitTerminator{command: c.getTerminatorCommand()}
 	} else {
-		sb.WriteString(fmt.Sprintf("%s:\n", label))
-	}
-}
-
-func (c *chunk) renderStatements(sb *strings.Builder, chunkLabels map[string]struct{}, textLabels map[string]struct{}, enableLineMarkers bool, inputFilepath string) error {
-	// Render basic non-branching commands.
-	for _, stmt := range c.statements {
-		commandStmt, ok := stmt.(*ast.CommandStatement)
-		if ok {
-			tryEmitLineMarker(sb, commandStmt.Token, enableLineMarkers, inputFilepath)
-			sb.WriteString(renderCommandStatement(commandStmt))
-		} else {
-			labelStmt, ok := stmt.(*ast.LabelStatement)
-			if ok {
-				// Error if the user-defined label collides with one of the auto-generated
-				// chunk or text labels.
-				if _, ok := chunkLabels[labelStmt.Name.Value]; ok {
-					return parser.NewParseError(labelStmt.Token, fmt.Sprintf("duplicate script label '%s'. Choose a unique label that won't clash with the auto-generated script labels", labelStmt.Name.Value))
-				}
-				if _, ok := textLabels[labelStmt.Name.Value]; ok {
-					return parser.NewParseError(labelStmt.Token, fmt.Sprintf("duplicate text label '%s'. Choose a unique label that won't clash with the auto-generated text labels", labelStmt.Name.Value))
-				}
-				tryEmitLineMarker(sb, labelStmt.Token, enableLineMarkers, inputFilepath)
-				sb.WriteString(renderLabelStatement(labelStmt))
-			} else {
-				return fmt.Errorf("could not render chunk statement '%q' because it is not a command or label statement", stmt.TokenLiteral())
-			}
-		}
+		block.terminator = &jumpTerminator{dest: c.returnID}
 	}
-	return nil
+	return block
 }
 
-func (c *chunk) renderBranching(scriptName string, sb *strings.Builder, nextChunkID int, registerJumpChunk func(int), enableLineMarkers bool, inputFilepath string) bool {
-	if c.branchBehavior != nil {
-		isFallThrough := c.branchBehavior.renderBranchConditions(sb, scriptName, nextChunkID, registerJumpChunk, enableLineMarkers, inputFilepath)
-		return isFallThrough
-	}
-
-	// Handle natural return logic that wasn't covered by a branch behavior.
-	if c.returnID == -1 {
-		sb.WriteString(fmt.Sprintf("\t%s\n", c.getTerminatorCommand()))
-		return false
-	} else if c.returnID != nextChunkID {
-		registerJumpChunk(c.returnID)
-		sb.WriteString(fmt.Sprintf("\tgoto %s_%d\n", scriptName, c.returnID))
+// Reports whether the chunk's last statement is a raw statement that never
+// continues, so the chunk needs no terminator command.
+func (c *chunk) endsWithNoReturn() bool {
+	if len(c.statements) == 0 {
 		return false
 	}
-
-	// Fallthrough to next chunk.
-	return true
+	rawStmt, ok := c.statements[len(c.statements)-1].(*ast.RawStatement)
+	return ok && rawStmt.NoReturn
 }
 
 func (c *chunk) getTerminatorCommand() string {
+	if c.endsWithNoReturn() {
+		return ""
+	}
 	if c.useEndTerminator {
 		return "end"
 	}
@@ -122,23 +81,3 @@ func (c *chunk) createPostLogicChunk(id int, lastStatementIndex int) *chunk {
 	}
 	return newChunk
 }
-
-func renderCommandStatement(commandStmt *ast.CommandStatement) string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("\t%s", commandStmt.Name.Value))
-	if len(commandStmt.Args) > 0 {
-		sb.WriteString(fmt.Sprintf(" %s", strings.Join(commandStmt.Args, ", ")))
-	}
-	sb.WriteString("\n")
-	return sb.String()
-}
-
-func renderLabelStatement(labelStmt *ast.LabelStatement) string {
-	var sb strings.Builder
-	if labelStmt.IsGlobal {
-		sb.WriteString(fmt.Sprintf("%s::\n", labelStmt.Name.Value))
-	} else {
-		sb.WriteString(fmt.Sprintf("%s:\n", labelStmt.Name.Value))
-	}
-	return sb.String()
-}
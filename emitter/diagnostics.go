@@ -0,0 +1,337 @@
+package emitter
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/parser"
+	"github.com/huderlem/poryscript/token"
+)
+
+// Finds code that can never be executed in a script, as well as scripts that
+// can unintentionally reach their end. The control flow follows the same rules
+// as splitScriptChunks, so the two must be kept in sync.
+type scriptDiagnostics struct {
+	warnings []ast.Warning
+	// Loops and switches that contain a break statement.
+	breaks map[ast.Statement]bool
+	// Loops that contain a continue statement.
+	continues map[ast.Statement]bool
+	usesEnd   bool
+}
+
+func (e *Emitter) checkScriptStatement(scriptStmt *ast.ScriptStatement) error {
+	d := &scriptDiagnostics{
+		breaks:    make(map[ast.Statement]bool),
+		continues: make(map[ast.Statement]bool),
+	}
+	reachesEnd := d.checkStatements(scriptStmt.Body.Statements)
+	if reachesEnd && len(scriptStmt.Epilogue) > 0 {
+		reachesEnd = d.checkStatements(scriptStmt.Epilogue)
+	}
+	e.warnings = append(e.warnings, d.warnings...)
+	if !reachesEnd || !d.usesEnd {
+		return nil
+	}
+
+	// A script that uses "end" is usually not meant to be called, so reaching
+	// the end of the script, where it implicitly returns, is likely a bug.
+	message := fmt.Sprintf("script '%s' uses 'end', but it can also reach the end of the script, where it implicitly returns. Add an explicit 'end' or 'return' to the end of the script", scriptStmt.Name.Value)
+	if e.strictScriptEnds {
+		return parser.NewParseError(scriptStmt.Name.Token, message)
+	}
+	e.warnings = append(e.warnings, newWarning(ast.WarningImplicitReturn, scriptStmt.Name.Token, scriptStmt.Name.Token, message))
+	return nil
+}
+
+// Checks a list of statements, and returns whether execution can continue
+// past the last statement.
+func (d *scriptDiagnostics) checkStatements(stmts []ast.Statement) bool {
+	reachable := true
+	var exitStmt ast.Statement
+	var unreachableStmts []ast.Statement
+	for _, stmt := range stmts {
+		if !reachable && !containsLabel(stmt) {
+			unreachableStmts = append(unreachableStmts, stmt)
+			continue
+		}
+		// Labels can be jumped to from anywhere, so they make the
+		// following code reachable again.
+		d.reportUnreachable(exitStmt, unreachableStmts)
+		unreachableStmts = nil
+		reachable = d.checkStatement(stmt)
+		if !reachable {
+			exitStmt = stmt
+		}
+	}
+	d.reportUnreachable(exitStmt, unreachableStmts)
+	return reachable
+}
+
+// Checks a single statement, and returns whether execution can continue
+// to the statement that follows it.
+func (d *scriptDiagnostics) checkStatement(stmt ast.Statement) bool {
+	switch stmt := stmt.(type) {
+	case *ast.CommandStatement:
+		switch stmt.Name.Value {
+		case "end":
+			d.usesEnd = true
+			return false
+		case "return", "goto":
+			return false
+		}
+	case *ast.RawStatement:
+		return !stmt.NoReturn
+	case *ast.IfStatement:
+		return d.checkIfStatement(stmt)
+	case *ast.WhileStatement:
+		value, constant := evaluateConstantCondition(stmt.Consequence.Expression)
+		if constant && !value {
+			d.reportConstantCondition("while", stmt.Consequence, "never true", stmt.Consequence.Body.Statements)
+			return true
+		}
+		d.checkStatements(stmt.Consequence.Body.Statements)
+		// A while loop whose condition is always true only ends with a break.
+		return !constant || d.breaks[stmt]
+	case *ast.DoWhileStatement:
+		reachesCondition := d.checkStatements(stmt.Consequence.Body.Statements) || d.continues[stmt]
+		if value, constant := evaluateConstantCondition(stmt.Consequence.Expression); constant && value {
+			return d.breaks[stmt]
+		}
+		return reachesCondition || d.breaks[stmt]
+	case *ast.BreakStatement:
+		d.breaks[stmt.ScopeStatment] = true
+		return false
+	case *ast.ContinueStatement:
+		d.continues[stmt.LoopStatment] = true
+		return false
+	case *ast.SwitchStatement:
+		return d.checkSwitchStatement(stmt)
+	}
+	return true
+}
+
+func (d *scriptDiagnostics) checkIfStatement(stmt *ast.IfStatement) bool {
+	branches := append([]*ast.ConditionExpression{stmt.Consequence}, stmt.ElifConsequences...)
+	reachable := false
+	for i, branch := range branches {
+		keyword := "if"
+		if i > 0 {
+			keyword = "elif"
+		}
+		value, constant := evaluateConstantCondition(branch.Expression)
+		if constant && !value {
+			d.reportConstantCondition(keyword, branch, "never true", branch.Body.Statements)
+			continue
+		}
+		reachable = d.checkStatements(branch.Body.Statements) || reachable
+		if !constant {
+			continue
+		}
+		// The remaining branches are never taken.
+		skipped := []ast.Statement{}
+		for _, elif := range branches[i+1:] {
+			skipped = append(skipped, elif.Body.Statements...)
+		}
+		if stmt.ElseConsequence != nil {
+			skipped = append(skipped, stmt.ElseConsequence.Statements...)
+		}
+		d.reportConstantCondition(keyword, branch, "always true", skipped)
+		return reachable
+	}
+	if stmt.ElseConsequence == nil {
+		return true
+	}
+	return d.checkStatements(stmt.ElseConsequence.Statements) || reachable
+}
+
+func (d *scriptDiagnostics) checkSwitchStatement(stmt *ast.SwitchStatement) bool {
+	cases := stmt.Cases
+	if stmt.DefaultCase != nil {
+		cases = append(cases[:len(cases):len(cases)], stmt.DefaultCase)
+	}
+	reachable := stmt.DefaultCase == nil
+	for i, switchCase := range cases {
+		// Empty cases share the body of the following case.
+		if len(switchCase.Body.Statements) == 0 {
+			if i == len(cases)-1 {
+				reachable = true
+			}
+			continue
+		}
+		reachable = d.checkStatements(switchCase.Body.Statements) || reachable
+	}
+	return reachable || d.breaks[stmt]
+}
+
+func (d *scriptDiagnostics) reportUnreachable(exitStmt ast.Statement, stmts []ast.Statement) {
+	if len(stmts) == 0 {
+		return
+	}
+	message := fmt.Sprintf("unreachable code. Execution never continues past the %s on line %d", describeExit(exitStmt), statementToken(exitStmt).LineNumber)
+	d.warnings = append(d.warnings, newWarning(ast.WarningUnreachableCode, statementToken(stmts[0]), lastStatementToken(stmts[len(stmts)-1]), message))
+}
+
+// Reports statements that are skipped because of a constant condition. Statements
+// containing labels can still be jumped to, so they are checked as usual.
+func (d *scriptDiagnostics) reportConstantCondition(keyword string, condition *ast.ConditionExpression, description string, stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		if containsLabel(stmt) {
+			d.checkStatements(stmts)
+			return
+		}
+	}
+	if len(stmts) == 0 {
+		return
+	}
+	message := fmt.Sprintf("unreachable code. The '%s' condition on line %d is %s", keyword, conditionToken(condition.Expression).LineNumber, description)
+	d.warnings = append(d.warnings, newWarning(ast.WarningUnreachableCode, statementToken(stmts[0]), lastStatementToken(stmts[len(stmts)-1]), message))
+}
+
+// Evaluates a condition whose result doesn't depend on the game's state, such as
+// "var(1) == 1". Operands below the range of vars are read as plain numbers, so
+// comparing one to a value always gives the same result. A missing condition, such
+// as in "while { ... }", is always true. ok is false when the condition isn't constant.
+func evaluateConstantCondition(expression ast.BooleanExpression) (value bool, ok bool) {
+	switch expression := expression.(type) {
+	case nil:
+		return true, true
+	case *ast.BinaryExpression:
+		left, leftOk := evaluateConstantCondition(expression.Left)
+		right, rightOk := evaluateConstantCondition(expression.Right)
+		// One side can decide the result by itself, such as "false && x".
+		decisive := expression.Operator == token.OR
+		if (leftOk && left == decisive) || (rightOk && right == decisive) {
+			return decisive, true
+		}
+		return left, leftOk && rightOk
+	case *ast.OperatorExpression:
+		return evaluateConstantComparison(expression)
+	}
+	return false, false
+}
+
+func evaluateConstantComparison(expression *ast.OperatorExpression) (bool, bool) {
+	if expression.Type != token.VAR || expression.PreambleStatement != nil {
+		return false, false
+	}
+	operand, err := strconv.ParseUint(expression.Operand.Literal, 0, 16)
+	if err != nil || operand >= 0x4000 {
+		return false, false
+	}
+	value, err := strconv.ParseUint(expression.ComparisonValue, 0, 16)
+	if err != nil || (expression.ComparisonValueType != ast.StrictValueComparison && isVarValue(value)) {
+		return false, false
+	}
+	switch expression.Operator {
+	case token.EQ:
+		return operand == value, true
+	case token.NEQ:
+		return operand != value, true
+	case token.LT:
+		return operand < value, true
+	case token.LTE:
+		return operand <= value, true
+	case token.GT:
+		return operand > value, true
+	case token.GTE:
+		return operand >= value, true
+	}
+	return false, false
+}
+
+// Reports whether "compare" treats the comparison value as a var, rather than
+// a plain value.
+func isVarValue(n uint64) bool {
+	return (n >= 0x4000 && n <= 0x40FF) || (n >= 0x8000 && n <= 0x8015)
+}
+
+// Returns the token of the first comparison in a condition, which locates the
+// condition in the script.
+func conditionToken(expression ast.BooleanExpression) token.Token {
+	switch expression := expression.(type) {
+	case *ast.BinaryExpression:
+		return conditionToken(expression.Left)
+	case *ast.OperatorExpression:
+		return expression.Operand
+	}
+	return token.Token{}
+}
+
+// Describes the statement that prevents execution from continuing.
+func describeExit(stmt ast.Statement) string {
+	switch stmt := stmt.(type) {
+	case *ast.CommandStatement:
+		return fmt.Sprintf("'%s' command", stmt.Name.Value)
+	case *ast.WhileStatement:
+		if value, constant := evaluateConstantCondition(stmt.Consequence.Expression); constant && value {
+			return "infinite 'while' loop"
+		}
+	case *ast.DoWhileStatement:
+		return "'do...while' loop"
+	}
+	return fmt.Sprintf("'%s' statement", stmt.TokenLiteral())
+}
+
+func statementToken(stmt ast.Statement) token.Token {
+	switch stmt := stmt.(type) {
+	case *ast.CommandStatement:
+		return stmt.Token
+	case *ast.LabelStatement:
+		return stmt.Token
+	case *ast.RawStatement:
+		return stmt.Token
+	case *ast.IfStatement:
+		return stmt.Token
+	case *ast.WhileStatement:
+		return stmt.Token
+	case *ast.DoWhileStatement:
+		return stmt.Token
+	case *ast.BreakStatement:
+		return stmt.Token
+	case *ast.ContinueStatement:
+		return stmt.Token
+	case *ast.SwitchStatement:
+		return stmt.Token
+	}
+	return token.Token{}
+}
+
+// Returns the last token of a statement whose source position is known, so
+// that warnings can cover entire compound statements.
+func lastStatementToken(stmt ast.Statement) token.Token {
+	last := statementToken(stmt)
+	for _, child := range stmt.AllChildren() {
+		tok := statementToken(child)
+		if tok.LineNumber > last.LineNumber || (tok.LineNumber == last.LineNumber && tok.StartCharIndex > last.StartCharIndex) {
+			last = tok
+		}
+	}
+	return last
+}
+
+func containsLabel(stmt ast.Statement) bool {
+	if _, ok := stmt.(*ast.LabelStatement); ok {
+		return true
+	}
+	for _, child := range stmt.AllChildren() {
+		if _, ok := child.(*ast.LabelStatement); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func newWarning(warningType ast.WarningType, startTok, endTok token.Token, message string) ast.Warning {
+	return ast.Warning{
+		Type:            warningType,
+		LineNumberStart: startTok.LineNumber,
+		LineNumberEnd:   endTok.EndLineNumber,
+		CharStart:       startTok.StartCharIndex,
+		Utf8CharStart:   startTok.StartUtf8CharIndex,
+		CharEnd:         endTok.EndCharIndex,
+		Utf8CharEnd:     endTok.EndUtf8CharIndex,
+		Message:         message,
+	}
+}
@@ -3,22 +3,39 @@ package emitter
 import (
 	"errors"
 	"fmt"
-	"sort"
 	"strings"
 
 	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/parser"
 	"github.com/huderlem/poryscript/token"
 )
 
 // Emitter is responsible for transforming a parsed Poryscript program into
 // the target assembler bytecode script.
 type Emitter struct {
-	program           *ast.Program
-	optimize          bool
-	enableLineMarkers bool
-	inputFilepath     string
+	program                 *ast.Program
+	optimize                bool
+	optimizationGoal        OptimizationGoal
+	mergeTailsAcrossScripts bool
+	commandConfig           parser.CommandConfig
+	strictScriptEnds        bool
+	warnings                []ast.Warning
+	enableLineMarkers       bool
+	inputFilepath           string
+	scriptGraphs            map[*ast.ScriptStatement]*scriptGraph
 }
 
+// OptimizationGoal decides which optimizations are worth applying when
+// they trade script size for execution speed.
+type OptimizationGoal int
+
+const (
+	// OptimizeForSpeed never adds extra "goto" commands to the executed path.
+	OptimizeForSpeed OptimizationGoal = iota
+	// OptimizeForSize adds "goto" commands when doing so reduces the size of the compiled scripts.
+	OptimizeForSize
+)
+
 // New creates a new Poryscript program emitter.
 func New(program *ast.Program, optimize, enableLineMarkers bool, inputFilepath string) *Emitter {
 	return &Emitter{
@@ -29,6 +46,35 @@ func New(program *ast.Program, optimize, enableLineMarkers bool, inputFilepath s
 	}
 }
 
+// SetOptimizationGoal sets whether optimized output should prefer smaller
+// scripts or faster scripts. The default is OptimizeForSpeed.
+func (e *Emitter) SetOptimizationGoal(goal OptimizationGoal) {
+	e.optimizationGoal = goal
+}
+
+// SetCommandConfig provides the target project's command config, which
+// describes commands that some optimizations can make use of.
+func (e *Emitter) SetCommandConfig(config parser.CommandConfig) {
+	e.commandConfig = config
+}
+
+// SetStrictScriptEnds makes it an error for a script that uses "end" to also
+// reach the end of the script, where it implicitly returns. Otherwise, it's a warning.
+func (e *Emitter) SetStrictScriptEnds(enabled bool) {
+	e.strictScriptEnds = enabled
+}
+
+// Warnings returns the diagnostic warnings found during the most recent Emit().
+func (e *Emitter) Warnings() []ast.Warning {
+	return e.warnings
+}
+
+// SetMergeTailsAcrossScripts allows identical script endings to be shared
+// between different scripts, rather than only within a single script.
+func (e *Emitter) SetMergeTailsAcrossScripts(enabled bool) {
+	e.mergeTailsAcrossScripts = enabled
+}
+
 // Emit the target assembler bytecode script.
 func (e *Emitter) Emit() (string, error) {
 	var sb strings.Builder
@@ -39,6 +85,12 @@ func (e *Emitter) Emit() (string, error) {
 		textLabels[text.Name] = struct{}{}
 	}
 
+	// Every script's control-flow graph is built up front, since some
+	// optimizations work across multiple scripts.
+	if err := e.buildScriptGraphs(); err != nil {
+		return "", err
+	}
+
 	i := 0
 	for _, stmt := range e.program.TopLevelStatements {
 		_, ok := stmt.(*ast.TextStatement)
@@ -157,6 +209,77 @@ func (e *Emitter) emitMapScriptStatement(mapScriptStmt *ast.MapScriptsStatement,
 }
 
 func (e *Emitter) emitScriptStatement(scriptStmt *ast.ScriptStatement, textLabels map[string]struct{}) (string, error) {
+	g, ok := e.scriptGraphs[scriptStmt]
+	if !ok {
+		return "", fmt.Errorf("could not emit script '%s' because its control-flow graph was not built", scriptStmt.Name.Value)
+	}
+	output, err := e.renderScriptGraph(g, textLabels)
+	if err != nil {
+		return "", err
+	}
+	return emitScriptSignature(scriptStmt) + output, nil
+}
+
+// Documents which vars a script's parameters and return value are passed in,
+// since callers written in regular assembly need to follow the same convention.
+func emitScriptSignature(scriptStmt *ast.ScriptStatement) string {
+	if len(scriptStmt.Params) == 0 && scriptStmt.ReturnVar == "" {
+		return ""
+	}
+	params := make([]string, len(scriptStmt.Params))
+	for i, param := range scriptStmt.Params {
+		params[i] = fmt.Sprintf("%s: %s", param.Name.Value, param.Value)
+	}
+	signature := fmt.Sprintf("@ %s(%s)", scriptStmt.Name.Value, strings.Join(params, ", "))
+	if scriptStmt.ReturnVar != "" {
+		signature += fmt.Sprintf(" returns %s", scriptStmt.ReturnVar)
+	}
+	return signature + "\n"
+}
+
+// Builds the control-flow graphs of all scripts in the program, in the
+// order they are emitted, and runs the pass pipeline on them.
+func (e *Emitter) buildScriptGraphs() error {
+	scriptStmts := []*ast.ScriptStatement{}
+	for _, stmt := range e.program.TopLevelStatements {
+		switch stmt := stmt.(type) {
+		case *ast.ScriptStatement:
+			scriptStmts = append(scriptStmts, stmt)
+		case *ast.MapScriptsStatement:
+			for _, mapScript := range stmt.MapScripts {
+				if mapScript.Script != nil {
+					scriptStmts = append(scriptStmts, mapScript.Script)
+				}
+			}
+			for _, tableMapScript := range stmt.TableMapScripts {
+				for _, scriptEntry := range tableMapScript.Entries {
+					if scriptEntry.Script != nil {
+						scriptStmts = append(scriptStmts, scriptEntry.Script)
+					}
+				}
+			}
+		}
+	}
+
+	graphs := make([]*scriptGraph, 0, len(scriptStmts))
+	e.scriptGraphs = make(map[*ast.ScriptStatement]*scriptGraph, len(scriptStmts))
+	e.warnings = []ast.Warning{}
+	for _, scriptStmt := range scriptStmts {
+		if err := e.checkScriptStatement(scriptStmt); err != nil {
+			return err
+		}
+		chunks, err := splitScriptChunks(scriptStmt)
+		if err != nil {
+			return err
+		}
+		g := buildScriptGraph(chunks, scriptStmt.Name.Value, scriptStmt.Scope == token.GLOBAL)
+		graphs = append(graphs, g)
+		e.scriptGraphs[scriptStmt] = g
+	}
+	return e.runPasses(graphs)
+}
+
+func splitScriptChunks(scriptStmt *ast.ScriptStatement) (map[int]*chunk, error) {
 	// The algorithm for emitting script statements is to split the scripts into
 	// self-contained chunks that logically branch to one another. When branching logic
 	// occurs, create a new chunk for any shared logic that follows the branching, as well
@@ -165,7 +288,7 @@ func (e *Emitter) emitScriptStatement(scriptStmt *ast.ScriptStatement, textLabel
 	chunkCounter := 0
 	finalChunks := make(map[int]*chunk)
 	remainingChunks := []*chunk{
-		{id: chunkCounter, returnID: -1, statements: scriptStmt.Body.Statements[:]},
+		{id: chunkCounter, returnID: -1, statements: append(scriptStmt.Body.Statements[:len(scriptStmt.Body.Statements):len(scriptStmt.Body.Statements)], scriptStmt.Epilogue...)},
 	}
 	breakStatementReturnChunks := make(map[ast.Statement]int)
 	breakStatementOriginChunks := make(map[ast.Statement]int)
@@ -183,6 +306,11 @@ func (e *Emitter) emitScriptStatement(scriptStmt *ast.ScriptStatement, textLabel
 				i++
 				continue
 			}
+			_, ok = stmt.(*ast.RawStatement)
+			if ok {
+				i++
+				continue
+			}
 
 			commandStmt, ok := stmt.(*ast.CommandStatement)
 			if !ok {
@@ -254,7 +382,7 @@ func (e *Emitter) emitScriptStatement(scriptStmt *ast.ScriptStatement, textLabel
 		} else if stmt, ok := curChunk.statements[i].(*ast.BreakStatement); ok {
 			destChunkID, ok := breakStatementReturnChunks[stmt.ScopeStatment]
 			if !ok {
-				return "", errors.New("could not emit 'break' statement because its return point is unknown")
+				return nil, errors.New("could not emit 'break' statement because its return point is unknown")
 			}
 			completeChunk := &chunk{
 				id:             curChunk.id,
@@ -266,7 +394,7 @@ func (e *Emitter) emitScriptStatement(scriptStmt *ast.ScriptStatement, textLabel
 		} else if stmt, ok := curChunk.statements[i].(*ast.ContinueStatement); ok {
 			destChunkID, ok := breakStatementOriginChunks[stmt.LoopStatment]
 			if !ok {
-				return "", errors.New("could not emit 'continue' statement because its return point is unknown")
+				return nil, errors.New("could not emit 'continue' statement because its return point is unknown")
 			}
 			completeChunk := &chunk{
 				id:             curChunk.id,
@@ -297,7 +425,7 @@ func (e *Emitter) emitScriptStatement(scriptStmt *ast.ScriptStatement, textLabel
 		}
 	}
 
-	return e.renderChunks(finalChunks, scriptStmt.Name.Value, scriptStmt.Scope == token.GLOBAL, textLabels)
+	return finalChunks, nil
 }
 
 func createConditionDestination(destinationChunk int, operatorExpression *ast.OperatorExpression) *conditionDestination {
@@ -581,115 +709,6 @@ func createSwitchStatementChunks(stmt *ast.SwitchStatement, statementIndex int,
 	return remainingChunks, &jump{destChunkID: switchChunk.id}, returnID
 }
 
-func (e *Emitter) renderChunks(chunks map[int]*chunk, scriptName string, isGlobal bool, textLabels map[string]struct{}) (string, error) {
-	// Get sorted list of final chunk ids.
-	var chunkIDs []int
-	if e.optimize {
-		chunkIDs = optimizeChunkOrder(chunks)
-	} else {
-		chunkIDs = make([]int, 0)
-		for k := range chunks {
-			chunkIDs = append(chunkIDs, k)
-		}
-		sort.Ints(chunkIDs)
-	}
-
-	// Build a collection of chunk labels for error-reporting purposes.
-	chunkLabels := map[string]struct{}{}
-	for _, chunk := range chunks {
-		chunkLabels[chunk.getLabel(scriptName)] = struct{}{}
-	}
-
-	// First, render the bodies of each chunk. We'll
-	// render the actual chunk labels after, since there is
-	// an opportunity to skip renering unnecessary labels.
-	var nextChunkID int
-	chunkBodies := make(map[int]*strings.Builder)
-	jumpChunks := make(map[int]bool)
-	registerJumpChunk := func(chunkID int) {
-		jumpChunks[chunkID] = true
-	}
-	for i, chunkID := range chunkIDs {
-		var sb strings.Builder
-		chunkBodies[chunkID] = &sb
-		if i < len(chunkIDs)-1 {
-			nextChunkID = chunkIDs[i+1]
-		} else {
-			nextChunkID = -1
-		}
-		chunk := chunks[chunkID]
-		err := chunk.renderStatements(&sb, chunkLabels, textLabels, e.enableLineMarkers, e.inputFilepath)
-		if err != nil {
-			return "", err
-		}
-		isFallThrough := chunk.renderBranching(scriptName, &sb, nextChunkID, registerJumpChunk, e.enableLineMarkers, e.inputFilepath)
-		if !isFallThrough {
-			sb.WriteString("\n")
-		}
-	}
-
-	// Render the labels of each chunk, followed by its body.
-	// A label doesn't need to be rendered if nothing ever jumps
-	// to it.
-	var sb strings.Builder
-	for _, chunkID := range chunkIDs {
-		chunk := chunks[chunkID]
-		if chunkID == 0 || jumpChunks[chunkID] {
-			chunk.renderLabel(scriptName, isGlobal, &sb)
-		}
-		sb.WriteString(chunkBodies[chunkID].String())
-	}
-
-	return sb.String(), nil
-}
-
-// Reorders chunks to take advantage of fall-throughs, rather than using
-// unncessary wasteful "goto" commands.
-func optimizeChunkOrder(chunks map[int]*chunk) []int {
-	unvisited := make(map[int]bool)
-	for k := range chunks {
-		unvisited[k] = true
-	}
-
-	chunkIDs := make([]int, 0)
-	if len(chunks) == 0 {
-		return chunkIDs
-	}
-
-	chunkIDs = append(chunkIDs, 0)
-	delete(unvisited, 0)
-	i := 1
-	for len(chunkIDs) < len(chunks) {
-		curChunk := chunks[chunkIDs[len(chunkIDs)-1]]
-		var nextChunkID int
-		if curChunk.branchBehavior != nil {
-			nextChunkID = curChunk.branchBehavior.getTailChunkID()
-		} else {
-			nextChunkID = curChunk.returnID
-		}
-
-		if nextChunkID != -1 {
-			if _, ok := unvisited[nextChunkID]; ok {
-				chunkIDs = append(chunkIDs, nextChunkID)
-				delete(unvisited, nextChunkID)
-				continue
-			}
-		}
-
-		// Choose random unvisited chunk for the next one.
-		for i < len(chunks) {
-			_, ok := unvisited[i]
-			if ok {
-				chunkIDs = append(chunkIDs, i)
-				delete(unvisited, i)
-				break
-			}
-			i++
-		}
-	}
-	return chunkIDs
-}
-
 func shouldEmitLineMarkers(enableLineMarkers bool, inputFilepath string) bool {
 	return enableLineMarkers && len(inputFilepath) > 0
 }
@@ -1,8 +1,11 @@
 package emitter
 
 import (
+	"math/rand"
+	"strings"
 	"testing"
 
+	"github.com/huderlem/poryscript/ast"
 	"github.com/huderlem/poryscript/lexer"
 	"github.com/huderlem/poryscript/parser"
 )
@@ -196,8 +199,7 @@ Route29_EventScript_Dude_Text_1:
 	compare VAR_0x8002, TIME_NIGHT
 	goto_if_eq Route29_EventScript_WaitingMan_2
 	msgbox Route29_EventScript_WaitingMan_Text_1
-Route29_EventScript_WaitingMan_1:
-Route29_EventScript_WaitingMan_6:
+Route29_EventScript_WaitingMan_8:
 	compare VAR_0x8002, TIME_NIGHT
 	goto_if_eq Route29_EventScript_WaitingMan_7
 	release
@@ -205,19 +207,19 @@ Route29_EventScript_WaitingMan_6:
 
 Route29_EventScript_WaitingMan_2:
 	msgbox Route29_EventScript_WaitingMan_Text_0
-	goto Route29_EventScript_WaitingMan_1
+	goto Route29_EventScript_WaitingMan_8
 
 Route29_EventScript_WaitingMan_7:
 	advancetime 5
 	gettime
-	goto Route29_EventScript_WaitingMan_6
+	goto Route29_EventScript_WaitingMan_8
 
 
 Route29_EventScript_Dude:
 	lock
 	faceplayer
 	goto_if_set FLAG_LEARNED_TO_CATCH_POKEMON, Route29_EventScript_Dude_2
-	goto_if_unset FLAG_GAVE_MYSTERY_EGG_TO_ELM, Route29_EventScript_Dude_3
+	goto_if_unset FLAG_GAVE_MYSTERY_EGG_TO_ELM, Route29_EventScript_Dude_2
 	msgbox Route29_EventScript_Dude_Text_0, MSGBOX_YESNO
 	compare VAR_RESULT, 0
 	goto_if_eq Route29_EventScript_Dude_7
@@ -235,10 +237,6 @@ Route29_EventScript_Dude_2:
 	msgbox Route29_Text_PokemonInTheGrass
 	goto Route29_EventScript_Dude_1
 
-Route29_EventScript_Dude_3:
-	msgbox Route29_Text_PokemonInTheGrass
-	goto Route29_EventScript_Dude_1
-
 Route29_EventScript_Dude_7:
 	msgbox Route29_Text_Dude_CatchingTutRejected
 	goto Route29_EventScript_Dude_1
@@ -355,18 +353,18 @@ Route29_EventScript_WaitingMan_Text_1:
 	lock
 	faceplayer
 	msgbox Route29_EventScript_WaitingMan_Text_0, MSGBOX_YESNO
-Route29_EventScript_WaitingMan_3:
+Route29_EventScript_WaitingMan_7:
 	goto_if_unset FLAG_1, Route29_EventScript_WaitingMan_5
 	special OtherThing
-Route29_EventScript_WaitingMan_2:
+Route29_EventScript_WaitingMan_4:
 	compare VAR_RESULT, 0
-	goto_if_ne Route29_EventScript_WaitingMan_3
+	goto_if_ne Route29_EventScript_WaitingMan_7
 	release
 	return
 
 Route29_EventScript_WaitingMan_5:
 	msgbox Route29_EventScript_WaitingMan_Text_1, MSGBOX_YESNO
-	goto Route29_EventScript_WaitingMan_2
+	goto Route29_EventScript_WaitingMan_4
 
 
 Route29_EventScript_WaitingMan_Text_0:
@@ -476,7 +474,7 @@ MyScript_14:
 
 `
 	expectedOptimized := `MyScript::
-MyScript_2:
+MyScript_4:
 	compare_var_to_value VAR_1, 5
 	goto_if_lt MyScript_3
 	release
@@ -484,22 +482,19 @@ MyScript_2:
 
 MyScript_3:
 	first
-MyScript_7:
+MyScript_14:
 	goto_if_set FLAG_1, MyScript_13
 	last
-	goto_if_unset FLAG_2, MyScript_7
-MyScript_5:
-	goto_if_set FLAG_3, MyScript_10
+	goto_if_unset FLAG_2, MyScript_14
+MyScript_11:
+	goto_if_set FLAG_3, MyScript_4
 	lastinwhile
-	goto MyScript_2
-
-MyScript_10:
-	goto MyScript_2
+	goto MyScript_4
 
 MyScript_13:
 	stuff
 	before
-	goto MyScript_5
+	goto MyScript_11
 
 `
 
@@ -640,20 +635,20 @@ MyScript_3:
 	message
 	goto_if_unset FLAG_3, MyScript_12
 	compare_var_to_value VAR_44, ( 0x4000 + ( 3 ) + 1 )
-	goto_if_gt MyScript_15
-MyScript_11:
+	goto_if_gt MyScript_17
+MyScript_20:
 	checktrainerflag TRAINER_BLUE
 	goto_if 1, MyScript_18
 	checktrainerflag TRAINER_RED
-	goto_if 0, MyScript_21
-MyScript_2:
-	goto_if_set FLAG_1, MyScript_4
-	goto_if_set FLAG_2, MyScript_4
+	goto_if 0, MyScript_23
+MyScript_6:
+	goto_if_set FLAG_1, MyScript_9
+	goto_if_set FLAG_2, MyScript_9
 MyScript_1:
 	blah
 	return
 
-MyScript_4:
+MyScript_9:
 	compare VAR_1, 2
 	goto_if_eq MyScript_3
 	compare VAR_2, 3
@@ -662,21 +657,21 @@ MyScript_4:
 
 MyScript_12:
 	hey
-	goto MyScript_11
+	goto MyScript_20
 
-MyScript_15:
+MyScript_17:
 	compare VAR_55, 5
 	goto_if_le MyScript_12
-	goto MyScript_11
+	goto MyScript_20
 
 MyScript_18:
 	baz -24, 17
-	goto MyScript_2
+	goto MyScript_6
 
-MyScript_21:
+MyScript_23:
 	checktrainerflag TRAINER_FOO
 	goto_if 1, MyScript_18
-	goto MyScript_2
+	goto MyScript_6
 
 `
 	l := lexer.New(input)
@@ -975,7 +970,7 @@ MyScript6_9:
 `
 
 	expectedOptimized := `MyScript::
-	goto_if_set FLAG_1, MyScript_3
+	goto_if_set FLAG_1, MyScript_6
 MyScript_1:
 	release
 	return
@@ -984,7 +979,7 @@ MyScript_2:
 	dostuff
 	goto MyScript_1
 
-MyScript_3:
+MyScript_6:
 	goto_if_unset FLAG_2, MyScript_2
 	compare VAR_1, 0
 	goto_if_eq MyScript_2
@@ -994,7 +989,7 @@ MyScript_3:
 MyScript2::
 	compare VAR_2, 2
 	goto_if_ge MyScript2_2
-	goto_if_set FLAG_2, MyScript2_5
+	goto_if_set FLAG_2, MyScript2_7
 MyScript2_1:
 	release
 	return
@@ -1003,7 +998,7 @@ MyScript2_2:
 	dostuff
 	goto MyScript2_1
 
-MyScript2_5:
+MyScript2_7:
 	compare VAR_1, 3
 	goto_if_le MyScript2_2
 	goto MyScript2_1
@@ -1026,7 +1021,7 @@ MyScript3_2:
 
 
 MyScript4::
-	goto_if_set FLAG_1, MyScript4_3
+	goto_if_set FLAG_1, MyScript4_7
 MyScript4_1:
 	release
 	return
@@ -1035,14 +1030,14 @@ MyScript4_2:
 	dostuff
 	goto MyScript4_1
 
-MyScript4_3:
+MyScript4_7:
 	compare VAR_1, 1
-	goto_if_ne MyScript4_5
+	goto_if_ne MyScript4_9
 	compare VAR_2, 2
-	goto_if_ne MyScript4_5
+	goto_if_ne MyScript4_9
 	goto MyScript4_1
 
-MyScript4_5:
+MyScript4_9:
 	compare VAR_3, 3
 	goto_if_ne MyScript4_2
 	goto MyScript4_1
@@ -1051,7 +1046,7 @@ MyScript4_5:
 MyScript5::
 	goto_if_set FLAG_1, MyScript5_2
 	compare VAR_1, 1
-	goto_if_ne MyScript5_5
+	goto_if_ne MyScript5_9
 MyScript5_1:
 	release
 	return
@@ -1060,21 +1055,21 @@ MyScript5_2:
 	dostuff
 	goto MyScript5_1
 
-MyScript5_5:
+MyScript5_9:
 	compare VAR_2, 2
-	goto_if_ne MyScript5_7
+	goto_if_ne MyScript5_11
 	compare VAR_3, 3
-	goto_if_ne MyScript5_7
+	goto_if_ne MyScript5_11
 	goto MyScript5_1
 
-MyScript5_7:
+MyScript5_11:
 	checktrainerflag TRAINER_1
 	goto_if 1, MyScript5_2
 	goto MyScript5_1
 
 
 MyScript6::
-	goto_if_set FLAG_1, MyScript6_3
+	goto_if_set FLAG_1, MyScript6_6
 MyScript6_1:
 	release
 	return
@@ -1083,7 +1078,7 @@ MyScript6_2:
 	dostuff
 	goto MyScript6_1
 
-MyScript6_3:
+MyScript6_6:
 	goto_if_unset FLAG_2, MyScript6_2
 	compare VAR_1, 0
 	goto_if_ne MyScript6_2
@@ -1233,57 +1228,54 @@ MyScript_19:
 `
 
 	expectedOptimized := `MyScript::
-MyScript_2:
+MyScript_4:
 	compare VAR_2, 2
-	goto_if_eq MyScript_3
+	goto_if_eq MyScript_6
 	release
 	return
 
-MyScript_3:
+MyScript_6:
 	switch VAR_1
 	case 6, MyScript_7
 	case 5, MyScript_7
-	case 0, MyScript_8
-	case 72, MyScript_9
+	case 0, MyScript_13
+	case 72, MyScript_14
 	case 1, MyScript_10
 	case 2, MyScript_10
 MyScript_7:
 	messagedefault
 MyScript_5:
 	afterswitch
-	goto MyScript_2
+	goto MyScript_4
 
-MyScript_8:
+MyScript_10:
+	message1
+	messagedefault
+	goto MyScript_5
+
+MyScript_12:
+	delay 5
+	goto MyScript_11
+
+MyScript_13:
 	goto_if_set FLAG_1, MyScript_12
 MyScript_11:
 	message0
 	goto MyScript_5
 
-MyScript_9:
+MyScript_14:
 	switch VAR_5
 	case 434, MyScript_15
 	case 2, MyScript_15
 	seconddefault
-	goto MyScript_2
-
-MyScript_10:
-	message1
-	messagedefault
-	goto MyScript_5
-
-MyScript_12:
-	delay 5
-	goto MyScript_11
+	goto MyScript_4
 
 MyScript_15:
 	secondfirst
-	goto_if_unset FLAG_TEMP_1, MyScript_18
+	goto_if_unset FLAG_TEMP_1, MyScript_5
 	foo
 	goto MyScript_5
 
-MyScript_18:
-	goto MyScript_5
-
 `
 	l := lexer.New(input)
 	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
@@ -1379,22 +1371,19 @@ MyScript_11:
 	case 1, MyScript_3
 MyScript_1:
 	second
-	goto_if_set FLAG_1, MyScript_5
-MyScript_4:
+	goto_if_set FLAG_1, MyScript_10
+MyScript_7:
 	return
 
 MyScript_3:
 	foo
 	goto MyScript_1
 
-MyScript_5:
-MyScript_8:
-	goto_if_set FLAG_2, MyScript_9
-	goto MyScript_4
-
 MyScript_9:
 	loopstart
-	goto MyScript_8
+MyScript_10:
+	goto_if_set FLAG_2, MyScript_9
+	goto MyScript_7
 
 `
 	l := lexer.New(input)
@@ -2667,32 +2656,22 @@ MyScript_13:
 `
 	expectedOptimized := `MyScript::
 	header
-MyScript_2:
+MyScript_3:
 	firstinwhile
-	goto_if_set FLAG_1, MyScript_5
-	goto_if_set FLAG_2, MyScript_6
+	goto_if_set FLAG_1, MyScript_3
+	goto_if_set FLAG_2, MyScript_11
 	footer
-	goto MyScript_2
+	goto MyScript_3
 
-MyScript_1:
+MyScript_9:
+	aftersecond
 	release
 	return
 
-MyScript_5:
-	goto MyScript_2
-
-MyScript_6:
-MyScript_10:
+MyScript_11:
 	otherloop
-	goto_if_set FLAG_3, MyScript_12
-	goto MyScript_10
-
-MyScript_9:
-	aftersecond
-	goto MyScript_1
-
-MyScript_12:
-	goto MyScript_9
+	goto_if_set FLAG_3, MyScript_9
+	goto MyScript_11
 
 `
 
@@ -2938,7 +2917,7 @@ MyScript_Text_1:
 	goto_if_eq MyScript_2
 	specialvar VAR_SPECIAL, DoThing
 	compare VAR_SPECIAL, 0
-	goto_if_eq MyScript_4
+	goto_if_eq MyScript_6
 MyScript_1:
 	getpartysize
 	switch VAR_SIZE
@@ -2957,7 +2936,7 @@ MyScript_3:
 	second
 	goto MyScript_1
 
-MyScript_4:
+MyScript_6:
 	dotext MyScript_Text_0
 	compare VAR_1, 0
 	goto_if_eq MyScript_3
@@ -3332,28 +3311,25 @@ Script1::
 # 35 ".\\test.pory"
 	faceplayer
 # 36 ".\\test.pory"
-	goto_if_set FLAG_TEMP, Script1_2
+	goto_if_set FLAG_TEMP, Script1_8
 # 36 ".\\test.pory"
 	checktrainerflag TRAINER_WHATEVER
-	goto_if 1, Script1_2
+	goto_if 1, Script1_8
 Script1_1:
 # 42 ".\\test.pory"
 	release
 	return
 
-Script1_2:
-Script1_6:
-# 37 ".\\test.pory"
-	compare VAR_RESULT, 3
-	goto_if_gt Script1_7
-	goto Script1_1
-
 Script1_7:
 # 38 ".\\test.pory"
 	flbahoistypo
 # 39 ".\\test.pory"
 	msgbox Script1_Text_0
-	goto Script1_6
+Script1_8:
+# 37 ".\\test.pory"
+	compare VAR_RESULT, 3
+	goto_if_gt Script1_7
+	goto Script1_1
 
 
 # 49 ".\\test.pory"
@@ -3583,3 +3559,1987 @@ Route29_Text_Dude_CatchingTutRejected:
 	})
 	benchResult = result
 }
+
+func TestEmitJumpThreading(t *testing.T) {
+	input := `
+script MyScript {
+	lock
+	if (flag(FLAG_1)) {
+		goto(OtherScript)
+	}
+	if (var(VAR_1) == 2) {
+		goto(MyScript_Label)
+	} else {
+		goto(ElseScript)
+	}
+	MyScript_Label:
+	release
+}
+`
+
+	expectedUnoptimized := `MyScript::
+	lock
+	goto MyScript_3
+
+MyScript_1:
+	goto MyScript_7
+
+MyScript_2:
+	goto OtherScript
+	goto MyScript_1
+
+MyScript_3:
+	goto_if_set FLAG_1, MyScript_2
+	goto MyScript_1
+
+MyScript_4:
+MyScript_Label:
+	release
+	return
+
+MyScript_5:
+	goto MyScript_Label
+	goto MyScript_4
+
+MyScript_6:
+	goto ElseScript
+	goto MyScript_4
+
+MyScript_7:
+	compare VAR_1, 2
+	goto_if_eq MyScript_5
+	goto MyScript_6
+
+`
+
+	expectedOptimized := `MyScript::
+	lock
+	goto_if_set FLAG_1, OtherScript
+	compare VAR_1, 2
+	goto_if_eq MyScript_Label
+	goto ElseScript
+
+MyScript_Label:
+	release
+	return
+
+`
+
+	l := lexer.New(input)
+	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+
+	e = New(program, true, false, "")
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestEmitTailMerging(t *testing.T) {
+	input := `
+script ScriptA {
+	lock
+	if (flag(FLAG_1)) {
+		msgbox("Hi")
+		setvar(VAR_TEMP_1, 0)
+		closemessage
+		releaseall
+		end
+	}
+	setflag(FLAG_2)
+	setvar(VAR_TEMP_1, 0)
+	closemessage
+	releaseall
+	end
+}
+script ScriptB {
+	faceplayer
+	setvar(VAR_TEMP_1, 0)
+	closemessage
+	releaseall
+	end
+}
+`
+
+	expectedSpeed := `ScriptA::
+	lock
+	goto_if_set FLAG_1, ScriptA_2
+	setflag FLAG_2
+	setvar VAR_TEMP_1, 0
+	closemessage
+	releaseall
+	end
+
+ScriptA_2:
+	msgbox ScriptA_Text_0
+	setvar VAR_TEMP_1, 0
+	closemessage
+	releaseall
+	end
+
+
+ScriptB::
+	faceplayer
+	setvar VAR_TEMP_1, 0
+	closemessage
+	releaseall
+	end
+
+
+ScriptA_Text_0:
+	.string "Hi$"
+`
+
+	expectedSize := `ScriptA::
+	lock
+	goto_if_set FLAG_1, ScriptA_2
+	setflag FLAG_2
+ScriptA_4:
+	setvar VAR_TEMP_1, 0
+	closemessage
+	releaseall
+	end
+
+ScriptA_2:
+	msgbox ScriptA_Text_0
+	goto ScriptA_4
+
+
+ScriptB::
+	faceplayer
+	setvar VAR_TEMP_1, 0
+	closemessage
+	releaseall
+	end
+
+
+ScriptA_Text_0:
+	.string "Hi$"
+`
+
+	expectedSizeAcrossScripts := `ScriptA::
+	lock
+	goto_if_set FLAG_1, ScriptA_2
+	setflag FLAG_2
+ScriptA_4:
+	setvar VAR_TEMP_1, 0
+	closemessage
+	releaseall
+	end
+
+ScriptA_2:
+	msgbox ScriptA_Text_0
+	goto ScriptA_4
+
+
+ScriptB::
+	faceplayer
+	goto ScriptA_4
+
+
+ScriptA_Text_0:
+	.string "Hi$"
+`
+
+	tests := []struct {
+		goal          OptimizationGoal
+		acrossScripts bool
+		text          string
+	}{
+		{OptimizeForSpeed, false, expectedSpeed},
+		{OptimizeForSpeed, true, expectedSpeed},
+		{OptimizeForSize, false, expectedSize},
+		{OptimizeForSize, true, expectedSizeAcrossScripts},
+	}
+
+	for i, tt := range tests {
+		l := lexer.New(input)
+		p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+		program, err := p.ParseProgram()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		e := New(program, true, false, "")
+		e.SetOptimizationGoal(tt.goal)
+		e.SetMergeTailsAcrossScripts(tt.acrossScripts)
+		result, _ := e.Emit()
+		if result != tt.text {
+			t.Errorf("Mismatching tail merging emit %d -- Expected=%q, Got=%q", i, tt.text, result)
+		}
+	}
+}
+
+func TestEmitTailMergingWholeBlocks(t *testing.T) {
+	input := `
+script SaveScript {
+	lockall
+	msgbox("Save?", MSGBOX_YESNO)
+	if (var(VAR_RESULT) == NO) {
+		closemessage
+		releaseall
+		end
+	}
+	special(SaveGame)
+	msgbox("Saved.")
+	closemessage
+	releaseall
+	end
+}
+script TalkScript {
+	lock
+	faceplayer
+	if (flag(FLAG_1)) {
+		release
+		end
+	}
+	msgbox("Hello.")
+	release
+	end
+}
+`
+
+	expected := `SaveScript::
+	lockall
+	msgbox SaveScript_Text_0, MSGBOX_YESNO
+	compare VAR_RESULT, NO
+	goto_if_eq SaveScript_4
+	special SaveGame
+	msgbox SaveScript_Text_1
+SaveScript_4:
+	closemessage
+	releaseall
+	end
+
+
+TalkScript::
+	lock
+	faceplayer
+	goto_if_set FLAG_1, TalkScript_4
+	msgbox TalkScript_Text_0
+TalkScript_4:
+	release
+	end
+
+
+SaveScript_Text_0:
+	.string "Save?$"
+
+SaveScript_Text_1:
+	.string "Saved.$"
+
+TalkScript_Text_0:
+	.string "Hello.$"
+`
+
+	l := lexer.New(input)
+	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := New(program, true, false, "")
+	e.SetOptimizationGoal(OptimizeForSize)
+	result, _ := e.Emit()
+	if result != expected {
+		t.Errorf("Mismatching whole block tail merging emit -- Expected=%q, Got=%q", expected, result)
+	}
+}
+
+func TestRemoveUnreachableBlocksKeepsSharedBlocks(t *testing.T) {
+	g := &scriptGraph{scriptName: "MyScript", blocks: map[int]*basicBlock{
+		0: {id: 0, terminator: &exitTerminator{command: "end"}},
+		1: {id: 1, terminator: &jumpTerminator{dest: 2}, shared: true},
+		2: {id: 2, terminator: &exitTerminator{command: "end"}},
+		3: {id: 3, terminator: &exitTerminator{command: "end"}},
+	}}
+	removeUnreachableBlocks(g)
+	for id, expected := range map[int]bool{0: true, 1: true, 2: true, 3: false} {
+		if _, ok := g.blocks[id]; ok != expected {
+			t.Errorf("Incorrect reachability for block %d. Expected=%t, Got=%t", id, expected, ok)
+		}
+	}
+}
+
+func TestEmitReusedComparisons(t *testing.T) {
+	input := `
+script MyScript {
+	if (var(VAR_1) < 5) {
+		less
+	} elif (var(VAR_1) == 5) {
+		equal
+	} elif (var(VAR_1) == value(5)) {
+		strict
+	} else {
+		greater
+	}
+	if (var(VAR_2) == 1 && var(VAR_2) != 1) {
+		never
+	}
+}
+`
+
+	expectedUnoptimized := `MyScript::
+	goto MyScript_8
+
+MyScript_1:
+	goto MyScript_11
+
+MyScript_2:
+	less
+	goto MyScript_1
+
+MyScript_3:
+	equal
+	goto MyScript_1
+
+MyScript_4:
+	strict
+	goto MyScript_1
+
+MyScript_5:
+	greater
+	goto MyScript_1
+
+MyScript_6:
+	compare_var_to_value VAR_1, 5
+	goto_if_eq MyScript_4
+	goto MyScript_5
+
+MyScript_7:
+	compare VAR_1, 5
+	goto_if_eq MyScript_3
+	goto MyScript_6
+
+MyScript_8:
+	compare VAR_1, 5
+	goto_if_lt MyScript_2
+	goto MyScript_7
+
+MyScript_9:
+	never
+	return
+
+MyScript_10:
+	goto MyScript_12
+
+MyScript_11:
+	compare VAR_2, 1
+	goto_if_eq MyScript_10
+	return
+
+MyScript_12:
+	compare VAR_2, 1
+	goto_if_ne MyScript_9
+	return
+
+`
+
+	expectedOptimized := `MyScript::
+	compare VAR_1, 5
+	goto_if_lt MyScript_2
+	goto_if_eq MyScript_3
+	compare_var_to_value VAR_1, 5
+	goto_if_eq MyScript_4
+	greater
+MyScript_11:
+	compare VAR_2, 1
+	goto_if_eq MyScript_12
+	return
+
+MyScript_2:
+	less
+	goto MyScript_11
+
+MyScript_3:
+	equal
+	goto MyScript_11
+
+MyScript_4:
+	strict
+	goto MyScript_11
+
+MyScript_9:
+	never
+	return
+
+MyScript_12:
+	goto_if_ne MyScript_9
+	return
+
+`
+
+	l := lexer.New(input)
+	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+
+	e = New(program, true, false, "")
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestEmitComparisonsAgainstDifferentValues(t *testing.T) {
+	input := `
+script MyScript {
+	if (var(VAR_1) == 1) {
+		one
+	} elif (var(VAR_1) == 2) {
+		two
+	} elif (var(VAR_1) == 3) {
+		three
+	}
+}
+`
+
+	// Each condition compares against a different value, so none of the
+	// comparisons can be reused.
+	expected := `MyScript::
+	compare VAR_1, 1
+	goto_if_eq MyScript_1
+	compare VAR_1, 2
+	goto_if_eq MyScript_2
+	compare VAR_1, 3
+	goto_if_eq MyScript_3
+	return
+
+MyScript_1:
+	one
+	return
+
+MyScript_2:
+	two
+	return
+
+MyScript_3:
+	three
+	return
+
+`
+
+	l := lexer.New(input)
+	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := New(program, true, false, "")
+	result, _ := e.Emit()
+	if result != expected {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expected, result)
+	}
+}
+
+func TestEmitConditionalCalls(t *testing.T) {
+	input := `
+script MyScript {
+	lock
+	if (flag(FLAG_1)) {
+		call(Sub1)
+	}
+	if (var(VAR_1) >= 3) {
+		call(Sub2)
+	} else {
+		call(Sub3)
+	}
+	if (!defeated(TRAINER_1)) {
+		call(Sub4)
+		msgbox("Not a single call.")
+	}
+	release
+	if (flag(FLAG_2)) {
+		call(Sub5)
+	}
+}
+`
+
+	expectedUnoptimized := `MyScript::
+	lock
+	goto MyScript_3
+
+MyScript_1:
+	goto MyScript_7
+
+MyScript_2:
+	call Sub1
+	goto MyScript_1
+
+MyScript_3:
+	goto_if_set FLAG_1, MyScript_2
+	goto MyScript_1
+
+MyScript_4:
+	goto MyScript_10
+
+MyScript_5:
+	call Sub2
+	goto MyScript_4
+
+MyScript_6:
+	call Sub3
+	goto MyScript_4
+
+MyScript_7:
+	compare VAR_1, 3
+	goto_if_ge MyScript_5
+	goto MyScript_6
+
+MyScript_8:
+	release
+	goto MyScript_12
+
+MyScript_9:
+	call Sub4
+	msgbox MyScript_Text_0
+	goto MyScript_8
+
+MyScript_10:
+	checktrainerflag TRAINER_1
+	goto_if 0, MyScript_9
+	goto MyScript_8
+
+MyScript_11:
+	call Sub5
+	return
+
+MyScript_12:
+	goto_if_set FLAG_2, MyScript_11
+	return
+
+
+MyScript_Text_0:
+	.string "Not a single call.$"
+`
+
+	expectedOptimized := `MyScript::
+	lock
+	call_if_set FLAG_1, Sub1
+	compare VAR_1, 3
+	goto_if_ge MyScript_5
+	call Sub3
+MyScript_10:
+	checktrainerflag TRAINER_1
+	goto_if 0, MyScript_9
+MyScript_8:
+	release
+	call_if_set FLAG_2, Sub5
+	return
+
+MyScript_5:
+	call Sub2
+	goto MyScript_10
+
+MyScript_9:
+	call Sub4
+	msgbox MyScript_Text_0
+	goto MyScript_8
+
+
+MyScript_Text_0:
+	.string "Not a single call.$"
+`
+
+	config := parser.CommandConfig{
+		ConditionalCallCommands: map[string]string{
+			"goto_if_set":   "call_if_set",
+			"goto_if_unset": "call_if_unset",
+			"goto_if_eq":    "call_if_eq",
+			"goto_if_ne":    "call_if_ne",
+			"goto_if_lt":    "call_if_lt",
+			"goto_if_le":    "call_if_le",
+			"goto_if_gt":    "call_if_gt",
+			"goto_if_ge":    "call_if_ge",
+			"goto_if":       "call_if",
+		},
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	e.SetCommandConfig(config)
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+
+	e = New(program, true, false, "")
+	e.SetCommandConfig(config)
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestEmitConditionalCallsAcrossScripts(t *testing.T) {
+	input := `
+script ScriptA {
+	if (flag(FLAG_1)) {
+		call(Sub)
+	}
+}
+script ScriptB {
+	if (flag(FLAG_2)) {
+		call(Sub)
+	}
+}
+script ScriptC {
+	lock
+	if (flag(FLAG_3)) {
+		call(Sub)
+		setvar(VAR_TEMP_1, 0)
+		release
+		end
+	}
+	setvar(VAR_TEMP_1, 0)
+	release
+	end
+}
+script ScriptD {
+	if (flag(FLAG_4)) {
+		setvar(VAR_TEMP_1, 0)
+		release
+		end
+	}
+	call(Sub)
+}
+`
+
+	expected := `ScriptA::
+	call_if_set FLAG_1, Sub
+	return
+
+
+ScriptB::
+	call_if_set FLAG_2, Sub
+	return
+
+
+ScriptC::
+	lock
+	goto_if_set FLAG_3, ScriptC_2
+ScriptC_4:
+	setvar VAR_TEMP_1, 0
+	release
+	end
+
+ScriptC_2:
+	call Sub
+	goto ScriptC_4
+
+
+ScriptD::
+	goto_if_set FLAG_4, ScriptC_4
+	call Sub
+	return
+
+`
+
+	config := parser.CommandConfig{
+		ConditionalCallCommands: map[string]string{"goto_if_set": "call_if_set"},
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, true, false, "")
+	e.SetCommandConfig(config)
+	e.SetOptimizationGoal(OptimizeForSize)
+	e.SetMergeTailsAcrossScripts(true)
+	result, _ := e.Emit()
+	if result != expected {
+		t.Errorf("Mismatching conditional calls across scripts emit -- Expected=%q, Got=%q", expected, result)
+	}
+
+	// Every jump must land on a label that is actually emitted.
+	labels := map[string]bool{}
+	for _, line := range strings.Split(result, "\n") {
+		if strings.HasSuffix(line, ":") {
+			labels[strings.TrimRight(line, ":")] = true
+		}
+	}
+	for _, line := range strings.Split(result, "\n") {
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "goto") {
+			continue
+		}
+		if target := fields[len(fields)-1]; !labels[target] {
+			t.Errorf("Jump to label '%s' that is never emitted: %s", target, line)
+		}
+	}
+}
+
+func TestEmitUnreachableCodeWarnings(t *testing.T) {
+	input := `
+script MyScript {
+	lock
+	if (flag(FLAG_1)) {
+		end
+		msgbox("dead")
+		release
+	}
+	while {
+		if (flag(FLAG_2)) {
+			goto(Other)
+			foo
+		}
+	}
+	if (flag(FLAG_3)) {
+		bar
+	}
+	MyLabel:
+	baz
+	switch (var(VAR_1)) {
+		case 1:
+			return
+		default:
+			end
+	}
+	qux
+}
+script MyScript2 {
+	if (flag(FLAG_1)) {
+		end
+	}
+	do {
+		break
+		dead
+	} while (flag(FLAG_2))
+}
+`
+	expectedWarnings := []ast.Warning{
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 6, LineNumberEnd: 7, CharStart: 2, Utf8CharStart: 2, CharEnd: 9, Utf8CharEnd: 9, Message: "unreachable code. Execution never continues past the 'end' command on line 5"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 12, LineNumberEnd: 12, CharStart: 3, Utf8CharStart: 3, CharEnd: 6, Utf8CharEnd: 6, Message: "unreachable code. Execution never continues past the 'goto' command on line 11"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 15, LineNumberEnd: 16, CharStart: 1, Utf8CharStart: 1, CharEnd: 5, Utf8CharEnd: 5, Message: "unreachable code. Execution never continues past the infinite 'while' loop on line 9"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 26, LineNumberEnd: 26, CharStart: 1, Utf8CharStart: 1, CharEnd: 4, Utf8CharEnd: 4, Message: "unreachable code. Execution never continues past the 'switch' statement on line 20"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 34, LineNumberEnd: 34, CharStart: 2, Utf8CharStart: 2, CharEnd: 6, Utf8CharEnd: 6, Message: "unreachable code. Execution never continues past the 'break' statement on line 33"},
+		{Type: ast.WarningImplicitReturn, LineNumberStart: 28, LineNumberEnd: 28, CharStart: 7, Utf8CharStart: 7, CharEnd: 16, Utf8CharEnd: 16, Message: "script 'MyScript2' uses 'end', but it can also reach the end of the script, where it implicitly returns. Add an explicit 'end' or 'return' to the end of the script"},
+	}
+
+	l := lexer.New(input)
+	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := New(program, true, false, "")
+	if _, err := e.Emit(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	warnings := e.Warnings()
+	if len(warnings) != len(expectedWarnings) {
+		t.Fatalf("Incorrect number of warnings. Expected=%d, Got=%d: %v", len(expectedWarnings), len(warnings), warnings)
+	}
+	for i, expected := range expectedWarnings {
+		if warnings[i] != expected {
+			t.Errorf("Incorrect warning %d. Expected=%+v, Got=%+v", i, expected, warnings[i])
+		}
+	}
+
+	e.SetStrictScriptEnds(true)
+	_, err = e.Emit()
+	expectedError := "line 28: script 'MyScript2' uses 'end', but it can also reach the end of the script, where it implicitly returns. Add an explicit 'end' or 'return' to the end of the script"
+	if err == nil || err.Error() != expectedError {
+		t.Errorf("Expected strict script ends error '%s', but got '%v'", expectedError, err)
+	}
+}
+
+func TestEmitConstantConditionWarnings(t *testing.T) {
+	input := `
+const NEVER = 2
+script MyScript {
+	while (var(1) == 1) {
+		foo
+		if (flag(FLAG_1)) {
+			break
+		}
+	}
+	while (var(1) == NEVER) {
+		never
+	}
+	if (var(0) != 0) {
+		nope
+	} elif (var(5) > 2 && var(3) == 3) {
+		yes
+	} else {
+		skipped
+	}
+	if (var(VAR_1) == 1 && var(2) == 3) {
+		alsoNever
+	}
+	if (var(1) == 0x4000 || var(VAR_1) == 1) {
+		comparedToVar
+	}
+	do {
+		bar
+	} while (var(0x10) == value(0x10))
+	baz
+}
+script MyScript2 {
+	while (var(1) == 1 || flag(FLAG_1)) {
+		foo
+	}
+	dead
+}
+`
+	expectedWarnings := []ast.Warning{
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 11, LineNumberEnd: 11, CharStart: 2, Utf8CharStart: 2, CharEnd: 7, Utf8CharEnd: 7, Message: "unreachable code. The 'while' condition on line 10 is never true"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 14, LineNumberEnd: 14, CharStart: 2, Utf8CharStart: 2, CharEnd: 6, Utf8CharEnd: 6, Message: "unreachable code. The 'if' condition on line 13 is never true"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 18, LineNumberEnd: 18, CharStart: 2, Utf8CharStart: 2, CharEnd: 9, Utf8CharEnd: 9, Message: "unreachable code. The 'elif' condition on line 15 is always true"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 21, LineNumberEnd: 21, CharStart: 2, Utf8CharStart: 2, CharEnd: 11, Utf8CharEnd: 11, Message: "unreachable code. The 'if' condition on line 20 is never true"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 29, LineNumberEnd: 29, CharStart: 1, Utf8CharStart: 1, CharEnd: 4, Utf8CharEnd: 4, Message: "unreachable code. Execution never continues past the 'do...while' loop on line 26"},
+		{Type: ast.WarningUnreachableCode, LineNumberStart: 35, LineNumberEnd: 35, CharStart: 1, Utf8CharStart: 1, CharEnd: 5, Utf8CharEnd: 5, Message: "unreachable code. Execution never continues past the infinite 'while' loop on line 32"},
+	}
+
+	l := lexer.New(input)
+	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := New(program, true, false, "")
+	if _, err := e.Emit(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	warnings := e.Warnings()
+	if len(warnings) != len(expectedWarnings) {
+		t.Fatalf("Incorrect number of warnings. Expected=%d, Got=%d: %v", len(expectedWarnings), len(warnings), warnings)
+	}
+	for i, expected := range expectedWarnings {
+		if warnings[i] != expected {
+			t.Errorf("Incorrect warning %d. Expected=%+v, Got=%+v", i, expected, warnings[i])
+		}
+	}
+}
+
+func TestEmitScriptParams(t *testing.T) {
+	input := `
+script GiveReward(item, count) {
+	additem(item, count)
+	if (var(count) > 1) {
+		return(count)
+	}
+	return(0)
+}
+
+script GiveTwice(item) {
+	var(VAR_RESULT) = GiveReward(item, 2)
+}
+
+script MyScript {
+	GiveReward(ITEM_POTION, 1)
+	var(VAR_1) = GiveReward(ITEM_ANTIDOTE, VAR_0x8005)
+	end
+}
+`
+
+	expectedUnoptimized := `@ GiveReward(item: VAR_0x8004, count: VAR_0x8005) returns VAR_RESULT
+GiveReward::
+	additem VAR_0x8004, VAR_0x8005
+	goto GiveReward_3
+
+GiveReward_1:
+	setvar VAR_RESULT, 0
+	return
+
+GiveReward_2:
+	copyvar VAR_RESULT, VAR_0x8005
+	return
+
+GiveReward_3:
+	compare VAR_0x8005, 1
+	goto_if_gt GiveReward_2
+	goto GiveReward_1
+
+
+@ GiveTwice(item: VAR_0x8004)
+GiveTwice::
+	setvar VAR_0x8005, 2
+	call GiveReward
+	return
+
+
+MyScript::
+	setvar VAR_0x8004, ITEM_POTION
+	setvar VAR_0x8005, 1
+	call GiveReward
+	setvar VAR_0x8004, ITEM_ANTIDOTE
+	call GiveReward
+	copyvar VAR_1, VAR_RESULT
+	end
+
+`
+
+	expectedOptimized := `@ GiveReward(item: VAR_0x8004, count: VAR_0x8005) returns VAR_RESULT
+GiveReward::
+	additem VAR_0x8004, VAR_0x8005
+	compare VAR_0x8005, 1
+	goto_if_gt GiveReward_2
+	setvar VAR_RESULT, 0
+	return
+
+GiveReward_2:
+	copyvar VAR_RESULT, VAR_0x8005
+	return
+
+
+@ GiveTwice(item: VAR_0x8004)
+GiveTwice::
+	setvar VAR_0x8005, 2
+	call GiveReward
+	return
+
+
+MyScript::
+	setvar VAR_0x8004, ITEM_POTION
+	setvar VAR_0x8005, 1
+	call GiveReward
+	setvar VAR_0x8004, ITEM_ANTIDOTE
+	call GiveReward
+	copyvar VAR_1, VAR_RESULT
+	end
+
+`
+
+	config := parser.CommandConfig{
+		ScriptArgVars:   []string{"VAR_0x8004", "VAR_0x8005"},
+		ScriptReturnVar: "VAR_RESULT",
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+
+	e = New(program, true, false, "")
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestEmitScriptParamsReadAfterCall(t *testing.T) {
+	input := `
+script GiveReward(item, count) {
+	additem(item, count)
+	return(count)
+}
+
+script Outer(a) {
+	var(VAR_0x8000) = GiveReward(ITEM_POTION, a)
+	GiveReward(a, 2)
+}
+`
+
+	// The first call overwrites the arg var that holds 'a', so 'a' is copied
+	// into a temp var before it's read again.
+	expected := `@ GiveReward(item: VAR_0x8004, count: VAR_0x8005) returns VAR_RESULT
+GiveReward::
+	additem VAR_0x8004, VAR_0x8005
+	copyvar VAR_RESULT, VAR_0x8005
+	return
+
+
+@ Outer(a: VAR_0x8004)
+Outer::
+	copyvar VAR_TEMP_0, VAR_0x8004
+	setvar VAR_0x8004, ITEM_POTION
+	copyvar VAR_0x8005, VAR_TEMP_0
+	call GiveReward
+	copyvar VAR_0x8000, VAR_RESULT
+	copyvar VAR_0x8004, VAR_TEMP_0
+	setvar VAR_0x8005, 2
+	call GiveReward
+	return
+
+`
+
+	config := parser.CommandConfig{
+		ScriptArgVars:   []string{"VAR_0x8004", "VAR_0x8005"},
+		ScriptReturnVar: "VAR_RESULT",
+		TempVars:        []string{"VAR_TEMP_0"},
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, true, false, "")
+	result, _ := e.Emit()
+	if result != expected {
+		t.Errorf("Mismatching emit -- Expected=%q, Got=%q", expected, result)
+	}
+}
+
+func TestEmitSwappedScriptArgs(t *testing.T) {
+	input := `
+script Callee(a, b) {
+	subvar(a, b)
+}
+
+script Swap(a, b) {
+	Callee(b, a)
+	Callee(VAR_COUNT + 1, VAR_COUNT)
+}
+`
+
+	// Each argument overwrites the arg var that the other one reads, so one of
+	// them is passed through a temp var.
+	expected := `@ Callee(a: VAR_0x8004, b: VAR_0x8005)
+Callee::
+	subvar VAR_0x8004, VAR_0x8005
+	return
+
+
+@ Swap(a: VAR_0x8004, b: VAR_0x8005)
+Swap::
+	copyvar VAR_TEMP_0, VAR_0x8004
+	copyvar VAR_0x8004, VAR_0x8005
+	copyvar VAR_0x8005, VAR_TEMP_0
+	call Callee
+	setvar VAR_0x8004, VAR_COUNT + 1
+	copyvar VAR_0x8005, VAR_COUNT
+	call Callee
+	return
+
+`
+
+	config := parser.CommandConfig{
+		ScriptArgVars: []string{"VAR_0x8004", "VAR_0x8005"},
+		TempVars:      []string{"VAR_TEMP_0"},
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, true, false, "")
+	result, _ := e.Emit()
+	if result != expected {
+		t.Errorf("Mismatching emit -- Expected=%q, Got=%q", expected, result)
+	}
+}
+
+func TestEmitBlockLiteralArgs(t *testing.T) {
+	input := `
+script MyScript {
+	let count: var
+	lock
+	call({
+		setflag(FLAG_X)
+		msgbox("Hi")
+		addvar(count, 1)
+	})
+	while (var(count) < 3) {
+		call_if_set(FLAG_Y, {
+			msgbox("Nested")
+			call({ special(Foo) })
+		})
+	}
+	release
+	end
+}
+`
+
+	expectedUnoptimized := `MyScript::
+	lock
+	call MyScript_Script_0
+	goto MyScript_2
+
+MyScript_1:
+	release
+	end
+
+MyScript_2:
+	goto MyScript_4
+
+MyScript_3:
+	call_if_set FLAG_Y, MyScript_Script_1
+	goto MyScript_2
+
+MyScript_4:
+	compare VAR_TEMP_0, 3
+	goto_if_lt MyScript_3
+	goto MyScript_1
+
+
+MyScript_Script_0:
+	setflag FLAG_X
+	msgbox MyScript_Text_0
+	addvar VAR_TEMP_0, 1
+	return
+
+
+MyScript_Script_1:
+	msgbox MyScript_Text_1
+	call MyScript_Script_2
+	return
+
+
+MyScript_Script_2:
+	special Foo
+	return
+
+
+MyScript_Text_0:
+	.string "Hi$"
+
+MyScript_Text_1:
+	.string "Nested$"
+`
+
+	expectedOptimized := `MyScript::
+	lock
+	call MyScript_Script_0
+MyScript_4:
+	compare VAR_TEMP_0, 3
+	goto_if_lt MyScript_3
+	release
+	end
+
+MyScript_3:
+	call_if_set FLAG_Y, MyScript_Script_1
+	goto MyScript_4
+
+
+MyScript_Script_0:
+	setflag FLAG_X
+	msgbox MyScript_Text_0
+	addvar VAR_TEMP_0, 1
+	return
+
+
+MyScript_Script_1:
+	msgbox MyScript_Text_1
+	call MyScript_Script_2
+	return
+
+
+MyScript_Script_2:
+	special Foo
+	return
+
+
+MyScript_Text_0:
+	.string "Hi$"
+
+MyScript_Text_1:
+	.string "Nested$"
+`
+
+	config := parser.CommandConfig{
+		TempVars: []string{"VAR_TEMP_0"},
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+
+	e = New(program, true, false, "")
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestEmitMenuStatements(t *testing.T) {
+	input := `
+script Shop {
+	menu(0, 0) {
+		"Buy": { msgbox("Buying") }
+		"Sell": { msgbox("Selling") }
+		"Cancel": { msgbox("Bye") }
+	}
+	menu(1, 2) {
+		"A": { special(A) }
+		"B": { break }
+		cancel: { end }
+	}
+	release
+	end
+}
+`
+
+	expectedUnoptimized := `Shop::
+	dynmultichoice 0, 0, FALSE, 3, Shop_Text_0, Shop_Text_1, Shop_Text_2
+	goto Shop_2
+
+Shop_1:
+	dynmultichoice 1, 2, FALSE, 2, Shop_Text_6, Shop_Text_7
+	goto Shop_7
+
+Shop_2:
+	switch VAR_RESULT
+	case 0, Shop_3
+	case 1, Shop_4
+	case MULTI_B_PRESSED, Shop_5
+	case 2, Shop_5
+	goto Shop_1
+
+Shop_3:
+	msgbox Shop_Text_3
+	goto Shop_1
+
+Shop_4:
+	msgbox Shop_Text_4
+	goto Shop_1
+
+Shop_5:
+	msgbox Shop_Text_5
+	goto Shop_1
+
+Shop_6:
+	release
+	end
+
+Shop_7:
+	switch VAR_RESULT
+	case 0, Shop_8
+	case 1, Shop_9
+	case MULTI_B_PRESSED, Shop_10
+	goto Shop_6
+
+Shop_8:
+	special A
+	goto Shop_6
+
+Shop_9:
+	goto Shop_6
+
+Shop_10:
+	end
+
+
+Shop_Text_0:
+	.string "Buy$"
+
+Shop_Text_1:
+	.string "Sell$"
+
+Shop_Text_2:
+	.string "Cancel$"
+
+Shop_Text_3:
+	.string "Buying$"
+
+Shop_Text_4:
+	.string "Selling$"
+
+Shop_Text_5:
+	.string "Bye$"
+
+Shop_Text_6:
+	.string "A$"
+
+Shop_Text_7:
+	.string "B$"
+`
+
+	expectedOptimized := `Shop::
+	dynmultichoice 0, 0, FALSE, 3, Shop_Text_0, Shop_Text_1, Shop_Text_2
+	switch VAR_RESULT
+	case 0, Shop_3
+	case 1, Shop_4
+	case MULTI_B_PRESSED, Shop_5
+	case 2, Shop_5
+Shop_1:
+	dynmultichoice 1, 2, FALSE, 2, Shop_Text_6, Shop_Text_7
+	switch VAR_RESULT
+	case 0, Shop_8
+	case 1, Shop_6
+	case MULTI_B_PRESSED, Shop_10
+Shop_6:
+	release
+	end
+
+Shop_3:
+	msgbox Shop_Text_3
+	goto Shop_1
+
+Shop_4:
+	msgbox Shop_Text_4
+	goto Shop_1
+
+Shop_5:
+	msgbox Shop_Text_5
+	goto Shop_1
+
+Shop_8:
+	special A
+	goto Shop_6
+
+Shop_10:
+	end
+
+
+Shop_Text_0:
+	.string "Buy$"
+
+Shop_Text_1:
+	.string "Sell$"
+
+Shop_Text_2:
+	.string "Cancel$"
+
+Shop_Text_3:
+	.string "Buying$"
+
+Shop_Text_4:
+	.string "Selling$"
+
+Shop_Text_5:
+	.string "Bye$"
+
+Shop_Text_6:
+	.string "A$"
+
+Shop_Text_7:
+	.string "B$"
+`
+
+	config := parser.CommandConfig{
+		Menu: &parser.MenuCommand{
+			Name:        "dynmultichoice",
+			Args:        []string{"{x}", "{y}", "FALSE", "{count}", "{options}"},
+			ResultVar:   "VAR_RESULT",
+			CancelValue: "MULTI_B_PRESSED",
+		},
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+
+	e = New(program, true, false, "")
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestEmitConditionCommands(t *testing.T) {
+	input := `
+script SaveGame {
+	if (yesno("Save?")) {
+		call(DoSave)
+	} elif (!yesno(format("Quit?"))) {
+		msgbox("Okay.")
+	}
+	while (yesno("Again?") == NO) {
+		special(Retry)
+	}
+}
+`
+
+	expectedUnoptimized := `SaveGame::
+	goto SaveGame_5
+
+SaveGame_1:
+	goto SaveGame_6
+
+SaveGame_2:
+	call DoSave
+	goto SaveGame_1
+
+SaveGame_3:
+	msgbox SaveGame_Text_2
+	goto SaveGame_1
+
+SaveGame_4:
+	msgbox SaveGame_Text_1, MSGBOX_YESNO
+	compare VAR_RESULT, YES
+	goto_if_ne SaveGame_3
+	goto SaveGame_1
+
+SaveGame_5:
+	msgbox SaveGame_Text_0, MSGBOX_YESNO
+	compare VAR_RESULT, YES
+	goto_if_eq SaveGame_2
+	goto SaveGame_4
+
+SaveGame_6:
+	goto SaveGame_8
+
+SaveGame_7:
+	special Retry
+	goto SaveGame_6
+
+SaveGame_8:
+	msgbox SaveGame_Text_3, MSGBOX_YESNO
+	compare VAR_RESULT, NO
+	goto_if_eq SaveGame_7
+	return
+
+
+SaveGame_Text_0:
+	.string "Save?$"
+
+SaveGame_Text_1:
+	.string "Quit?$"
+
+SaveGame_Text_2:
+	.string "Okay.$"
+
+SaveGame_Text_3:
+	.string "Again?$"
+`
+
+	expectedOptimized := `SaveGame::
+	msgbox SaveGame_Text_0, MSGBOX_YESNO
+	compare VAR_RESULT, YES
+	goto_if_eq SaveGame_2
+	msgbox SaveGame_Text_1, MSGBOX_YESNO
+	compare VAR_RESULT, YES
+	goto_if_ne SaveGame_3
+SaveGame_8:
+	msgbox SaveGame_Text_3, MSGBOX_YESNO
+	compare VAR_RESULT, NO
+	goto_if_eq SaveGame_7
+	return
+
+SaveGame_2:
+	call DoSave
+	goto SaveGame_8
+
+SaveGame_3:
+	msgbox SaveGame_Text_2
+	goto SaveGame_8
+
+SaveGame_7:
+	special Retry
+	goto SaveGame_8
+
+
+SaveGame_Text_0:
+	.string "Save?$"
+
+SaveGame_Text_1:
+	.string "Quit?$"
+
+SaveGame_Text_2:
+	.string "Okay.$"
+
+SaveGame_Text_3:
+	.string "Again?$"
+`
+
+	config := parser.CommandConfig{
+		ConditionCommands: map[string]parser.ConditionCommand{
+			"yesno": {
+				Command: "msgbox",
+				Args:    []string{"MSGBOX_YESNO"},
+				VarName: "VAR_RESULT",
+				Value:   "YES",
+			},
+		},
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+
+	e = New(program, true, false, "")
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestEmitScriptTemplates(t *testing.T) {
+	input := `
+template npc {
+	prologue: lock, faceplayer;
+	epilogue: release, end
+}
+
+script(npc) Guard {
+	if (flag(FLAG_GUARD_MOVED)) {
+		msgbox("Move along.")
+		end
+	}
+	msgbox("Halt!")
+	if (var(VAR_RESULT)) {
+		goto({
+			msgbox("Bye.")
+			end
+		})
+	}
+}
+
+script(local, sign) Sign {
+	msgbox("A sign.")
+	end
+}
+`
+
+	expectedUnoptimized := `Guard::
+	lock
+	faceplayer
+	goto Guard_3
+
+Guard_1:
+	msgbox Guard_Text_1
+	goto Guard_6
+
+Guard_2:
+	msgbox Guard_Text_0
+	release
+	end
+
+Guard_3:
+	goto_if_set FLAG_GUARD_MOVED, Guard_2
+	goto Guard_1
+
+Guard_4:
+	release
+	end
+
+Guard_5:
+	goto Guard_Script_0
+	goto Guard_4
+
+Guard_6:
+	compare VAR_RESULT, 0
+	goto_if_ne Guard_5
+	goto Guard_4
+
+
+Sign:
+	lockall
+	msgbox Sign_Text_0
+	releaseall
+	end
+
+
+Guard_Script_0:
+	msgbox Guard_Text_2
+	release
+	end
+
+
+Guard_Text_0:
+	.string "Move along.$"
+
+Guard_Text_1:
+	.string "Halt!$"
+
+Guard_Text_2:
+	.string "Bye.$"
+
+Sign_Text_0:
+	.string "A sign.$"
+`
+
+	expectedOptimized := `Guard::
+	lock
+	faceplayer
+	goto_if_set FLAG_GUARD_MOVED, Guard_2
+	msgbox Guard_Text_1
+	compare VAR_RESULT, 0
+	goto_if_ne Guard_Script_0
+	release
+	end
+
+Guard_2:
+	msgbox Guard_Text_0
+	release
+	end
+
+
+Sign:
+	lockall
+	msgbox Sign_Text_0
+	releaseall
+	end
+
+
+Guard_Script_0:
+	msgbox Guard_Text_2
+	release
+	end
+
+
+Guard_Text_0:
+	.string "Move along.$"
+
+Guard_Text_1:
+	.string "Halt!$"
+
+Guard_Text_2:
+	.string "Bye.$"
+
+Sign_Text_0:
+	.string "A sign.$"
+`
+
+	config := parser.CommandConfig{
+		Templates: map[string]parser.ScriptTemplate{
+			"sign": {
+				Prologue: []string{"lockall"},
+				Epilogue: []string{"releaseall", "end"},
+			},
+		},
+	}
+	l := lexer.New(input)
+	p := parser.New(l, config, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+	if len(e.Warnings()) != 0 {
+		t.Errorf("Expected no warnings, but got %v", e.Warnings())
+	}
+
+	e = New(program, true, false, "")
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestEmitInlineRawStatements(t *testing.T) {
+	input := `
+script RawTest {
+	if (flag(FLAG_1)) {
+		raw ` + "`" + `
+	special DoThing
+	waitstate
+` + "`" + `
+	}
+	if (var(VAR_1) == 2) {
+		raw(noreturn) ` + "`" + `
+	goto_if_questlog EventScript_ReleaseEnd
+	end_questlog
+` + "`" + `
+	}
+	msgbox("Done.")
+}
+`
+
+	expectedUnoptimized := `RawTest::
+	goto RawTest_3
+
+RawTest_1:
+	goto RawTest_6
+
+RawTest_2:
+	special DoThing
+	waitstate
+	goto RawTest_1
+
+RawTest_3:
+	goto_if_set FLAG_1, RawTest_2
+	goto RawTest_1
+
+RawTest_4:
+	msgbox RawTest_Text_0
+	return
+
+RawTest_5:
+	goto_if_questlog EventScript_ReleaseEnd
+	end_questlog
+
+RawTest_6:
+	compare VAR_1, 2
+	goto_if_eq RawTest_5
+	goto RawTest_4
+
+
+RawTest_Text_0:
+	.string "Done.$"
+`
+
+	expectedOptimized := `RawTest::
+# 3 "test.pory"
+	goto_if_set FLAG_1, RawTest_2
+RawTest_6:
+# 9 "test.pory"
+	compare VAR_1, 2
+	goto_if_eq RawTest_5
+# 15 "test.pory"
+	msgbox RawTest_Text_0
+	return
+
+RawTest_2:
+# 5 "test.pory"
+	special DoThing
+# 6 "test.pory"
+	waitstate
+	goto RawTest_6
+
+RawTest_5:
+# 11 "test.pory"
+	goto_if_questlog EventScript_ReleaseEnd
+# 12 "test.pory"
+	end_questlog
+
+
+RawTest_Text_0:
+# 15 "test.pory"
+	.string "Done.$"
+`
+
+	l := lexer.New(input)
+	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	e := New(program, false, false, "")
+	result, _ := e.Emit()
+	if result != expectedUnoptimized {
+		t.Errorf("Mismatching unoptimized emit -- Expected=%q, Got=%q", expectedUnoptimized, result)
+	}
+
+	e = New(program, true, true, "test.pory")
+	result, _ = e.Emit()
+	if result != expectedOptimized {
+		t.Errorf("Mismatching optimized emit -- Expected=%q, Got=%q", expectedOptimized, result)
+	}
+}
+
+func TestBuildScriptGraph(t *testing.T) {
+	input := `
+script MyScript {
+	if (flag(FLAG_1)) {
+		foo
+	}
+	switch (var(VAR_1)) {
+		case 1: bar
+	}
+	end
+}
+`
+	l := lexer.New(input)
+	p := parser.New(l, parser.CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	scriptStmt := program.TopLevelStatements[0].(*ast.ScriptStatement)
+	chunks, err := splitScriptChunks(scriptStmt)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	g := buildScriptGraph(chunks, scriptStmt.Name.Value, true)
+
+	expectedSuccessors := map[int][]edge{
+		0: {{dest: 3, kind: edgeJump}},
+		1: {{dest: 5, kind: edgeJump}},
+		2: {{dest: 1, kind: edgeJump}},
+		3: {{dest: 2, kind: edgeTrue}, {dest: 1, kind: edgeFalse}},
+		4: {},
+		5: {{dest: 6, kind: edgeCase}, {dest: 4, kind: edgeDefault}},
+		6: {{dest: 4, kind: edgeJump}},
+	}
+	if len(g.blocks) != len(expectedSuccessors) {
+		t.Fatalf("Incorrect number of blocks. Expected=%d, Got=%d", len(expectedSuccessors), len(g.blocks))
+	}
+	for id, expected := range expectedSuccessors {
+		block, ok := g.blocks[id]
+		if !ok {
+			t.Fatalf("Missing block %d", id)
+		}
+		successors := block.terminator.successors()
+		if len(successors) != len(expected) {
+			t.Fatalf("Incorrect number of successors for block %d. Expected=%d, Got=%d", id, len(expected), len(successors))
+		}
+		for i, e := range expected {
+			if successors[i].dest != e.dest || successors[i].kind != e.kind {
+				t.Errorf("Incorrect successor %d for block %d. Expected=%v, Got=%v", i, id, e, successors[i])
+			}
+		}
+	}
+	if exit, ok := g.blocks[4].terminator.(*exitTerminator); !ok || exit.command != "end" {
+		t.Errorf("Expected block 4 to exit with 'end'. Got=%v", g.blocks[4].terminator)
+	}
+	if cond := g.blocks[3].terminator.(*conditionalTerminator); cond.condition.Operand.Literal != "FLAG_1" {
+		t.Errorf("Expected block 3 to branch on FLAG_1. Got=%s", cond.condition.Operand.Literal)
+	}
+}
+
+// The block ordering that was used before the cost-aware layout. It follows a single
+// chain of fall-throughs, and then picks the next unvisited block in id order.
+func legacyBlockOrder(g *scriptGraph) error {
+	sortedIDs := g.sortedIDs()
+	unvisited := make(map[int]bool)
+	for _, id := range sortedIDs {
+		unvisited[id] = true
+	}
+	g.layout = make([]int, 0, len(sortedIDs))
+	if len(sortedIDs) == 0 {
+		return nil
+	}
+	g.layout = append(g.layout, 0)
+	delete(unvisited, 0)
+	i := 1
+	for len(g.layout) < len(sortedIDs) {
+		curBlock := g.blocks[g.layout[len(g.layout)-1]]
+		nextID := fallthroughDest(curBlock.terminator)
+		if nextID != returnTarget && unvisited[nextID] {
+			g.layout = append(g.layout, nextID)
+			delete(unvisited, nextID)
+			continue
+		}
+		for i < len(sortedIDs) {
+			id := sortedIDs[i]
+			i++
+			if unvisited[id] {
+				g.layout = append(g.layout, id)
+				delete(unvisited, id)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Counts the "goto" commands that the graph's layout requires.
+func countLayoutGotos(g *scriptGraph) int {
+	count := 0
+	for i, id := range g.layout {
+		dest := fallthroughDest(g.blocks[id].terminator)
+		if dest == returnTarget {
+			continue
+		}
+		if i == len(g.layout)-1 || g.layout[i+1] != dest {
+			count++
+		}
+	}
+	return count
+}
+
+func buildRandomScriptGraph(r *rand.Rand) *scriptGraph {
+	numBlocks := 1 + r.Intn(12)
+	randomDest := func() int {
+		return r.Intn(numBlocks+1) - 1
+	}
+	g := &scriptGraph{scriptName: "MyScript", blocks: make(map[int]*basicBlock)}
+	for id := 0; id < numBlocks; id++ {
+		var t terminator
+		switch r.Intn(4) {
+		case 0:
+			t = &exitTerminator{command: "end"}
+		case 1:
+			t = &jumpTerminator{dest: randomDest()}
+		case 2:
+			t = &conditionalTerminator{trueDest: randomDest(), falseDest: randomDest()}
+		case 3:
+			t = &switchTerminator{
+				cases:       []switchTerminatorCase{{dest: randomDest()}, {dest: randomDest()}},
+				defaultDest: randomDest(),
+			}
+		}
+		g.blocks[id] = &basicBlock{id: id, terminator: t}
+	}
+	return g
+}
+
+func TestOptimizeBlockOrderNeverRegresses(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		g := buildRandomScriptGraph(r)
+		legacyBlockOrder(g)
+		legacyGotos := countLayoutGotos(g)
+		optimizeBlockOrder(g)
+		gotos := countLayoutGotos(g)
+		if gotos > legacyGotos {
+			t.Fatalf("Layout %d uses more goto commands than the legacy layout. Expected<=%d, Got=%d", i, legacyGotos, gotos)
+		}
+
+		if len(g.layout) != len(g.blocks) || g.layout[0] != 0 {
+			t.Fatalf("Layout %d doesn't start with the entry block, or has the wrong number of blocks: %v", i, g.layout)
+		}
+		seen := make(map[int]bool)
+		for _, id := range g.layout {
+			if seen[id] {
+				t.Fatalf("Layout %d contains block %d more than once: %v", i, id, g.layout)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestOptimizeBlockOrderIsDeterministic(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 500; i++ {
+		g := buildRandomScriptGraph(r)
+		optimizeBlockOrder(g)
+		expected := append([]int{}, g.layout...)
+		for j := 0; j < 5; j++ {
+			optimizeBlockOrder(g)
+			for k := range expected {
+				if g.layout[k] != expected[k] {
+					t.Fatalf("Layout %d is not deterministic. Expected=%v, Got=%v", i, expected, g.layout)
+				}
+			}
+		}
+	}
+}
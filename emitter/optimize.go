@@ -0,0 +1,350 @@
+package emitter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/token"
+)
+
+// Converts a trailing "goto" command into a jump to an external block, so that
+// other passes can see where control flow actually goes. Any terminator that
+// followed the "goto" was unreachable, so it is discarded.
+func lowerGotoCommands(g *scriptGraph) error {
+	for _, id := range g.sortedIDs() {
+		block := g.blocks[id]
+		if len(block.statements) == 0 {
+			continue
+		}
+		commandStmt, ok := block.statements[len(block.statements)-1].(*ast.CommandStatement)
+		if !ok || commandStmt.Name.Value != "goto" || len(commandStmt.Args) != 1 {
+			continue
+		}
+		block.statements = block.statements[:len(block.statements)-1]
+		block.terminator = &jumpTerminator{dest: g.externalBlock(commandStmt.Args[0])}
+	}
+	return nil
+}
+
+// Retargets jumps that land on a block which does nothing but jump somewhere
+// else, so that they go directly to the final destination. Conditions whose
+// destinations end up identical are folded into a plain jump.
+func threadJumps(g *scriptGraph) error {
+	for _, id := range g.sortedIDs() {
+		block := g.blocks[id]
+		block.terminator.retarget(func(e edge) int {
+			return g.threadDest(e.dest)
+		})
+		if cond, ok := block.terminator.(*conditionalTerminator); ok && cond.trueDest == cond.falseDest && cond.trueDest != returnTarget {
+			if cond.preamble != nil {
+				block.statements = append(block.statements[:len(block.statements):len(block.statements)], cond.preamble)
+			}
+			block.terminator = &jumpTerminator{dest: cond.trueDest}
+		}
+	}
+	return nil
+}
+
+// Follows a chain of empty, jump-only blocks to its final destination.
+func (g *scriptGraph) threadDest(dest int) int {
+	visited := make(map[int]bool)
+	for dest != returnTarget && !visited[dest] {
+		visited[dest] = true
+		block := g.blocks[dest]
+		if block.isExternal() || len(block.statements) > 0 {
+			break
+		}
+		jump, ok := block.terminator.(*jumpTerminator)
+		if !ok {
+			break
+		}
+		dest = jump.dest
+	}
+	return dest
+}
+
+// Removes blocks that can never be executed.
+func removeUnreachableBlocks(g *scriptGraph) error {
+	reachable := g.reachableBlocks()
+	for id := range g.blocks {
+		if !reachable[id] {
+			delete(g.blocks, id)
+		}
+	}
+	return nil
+}
+
+// The estimated size, in bytes, of a "goto" command.
+const gotoCommandSize = 5
+
+// Estimates the compiled size of a command, in bytes. Every command has a
+// one-byte opcode, and most arguments are two bytes wide.
+func estimatedCommandSize(commandStmt *ast.CommandStatement) int {
+	return 1 + 2*len(commandStmt.Args)
+}
+
+// Estimates the compiled size of a terminator that can end a shared tail.
+// Jumps are assumed to be free, since they can often fall through.
+func estimatedTerminatorSize(t terminator) int {
+	switch t := t.(type) {
+	case *exitTerminator:
+		return 1
+	case *jumpTerminator:
+		if t.dest == returnTarget {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Identifies where a block's terminator sends control flow. Blocks can only share
+// a tail when their keys match. Jumps to the script's own blocks are only meaningful
+// within that script, so their key includes the graph.
+type tailKey struct {
+	g      *scriptGraph
+	target string
+}
+
+// A block that other blocks can jump to, instead of duplicating its statements.
+type tailCandidate struct {
+	g  *scriptGraph
+	id int
+	// Set once other blocks jump to the candidate, so it must stay in place.
+	merged bool
+}
+
+func getTailKey(g *scriptGraph, t terminator) (tailKey, bool) {
+	switch t := t.(type) {
+	case *exitTerminator:
+		if t.command == "" {
+			// The block exits with its own raw statement, so there is no
+			// shared terminator.
+			return tailKey{}, false
+		}
+		return tailKey{target: "exit " + t.command}, true
+	case *jumpTerminator:
+		if t.dest == returnTarget {
+			return tailKey{target: "exit return"}, true
+		}
+		if g.blocks[t.dest].isExternal() {
+			return tailKey{target: "goto " + g.blocks[t.dest].externalLabel}, true
+		}
+		return tailKey{g: g, target: fmt.Sprintf("jump %d", t.dest)}, true
+	}
+	return tailKey{}, false
+}
+
+// Returns the number of identical commands at the end of both statement lists.
+func commonSuffixLength(a, b []ast.Statement) int {
+	n := 0
+	for n < len(a) && n < len(b) {
+		cmdA, ok := a[len(a)-1-n].(*ast.CommandStatement)
+		if !ok {
+			break
+		}
+		cmdB, ok := b[len(b)-1-n].(*ast.CommandStatement)
+		if !ok {
+			break
+		}
+		if cmdA.Name.Value != cmdB.Name.Value || strings.Join(cmdA.Args, ",") != strings.Join(cmdB.Args, ",") {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// Shares identical block endings, so that only one copy of the commands is
+// emitted. Other blocks jump to the shared copy instead.
+func (e *Emitter) mergeTails(graphs []*scriptGraph) error {
+	if e.mergeTailsAcrossScripts {
+		e.mergeTailsInGraphs(graphs)
+		return nil
+	}
+	for _, g := range graphs {
+		e.mergeTailsInGraphs([]*scriptGraph{g})
+	}
+	return nil
+}
+
+func (e *Emitter) mergeTailsInGraphs(graphs []*scriptGraph) {
+	candidates := make(map[tailKey][]tailCandidate)
+	for _, g := range graphs {
+		for _, id := range g.sortedIDs() {
+			block := g.blocks[id]
+			key, ok := getTailKey(g, block.terminator)
+			if !ok {
+				continue
+			}
+			best, length := -1, 0
+			for i, c := range candidates[key] {
+				if n := commonSuffixLength(c.g.blocks[c.id].statements, block.statements); best == -1 || n > length {
+					best, length = i, n
+				}
+			}
+			if best == -1 || !e.shouldMergeTail(candidates[key][best], g, id, length) {
+				candidates[key] = append(candidates[key], tailCandidate{g: g, id: id})
+				continue
+			}
+
+			c := candidates[key][best]
+			current := tailCandidate{g: g, id: id}
+			if !c.merged && !current.isWholeTail(length) && c.isWholeTail(length) {
+				// The candidate's block is nothing but the tail, so it's the
+				// one that jumps to the other copy. That way, jumps into it
+				// are retargeted, rather than adding a "goto" to this block.
+				c, current = current, c
+			}
+			shared := c.splitTail(length)
+			shared.merged = true
+			candidates[key][best] = shared
+			current.jumpTo(shared, length)
+		}
+	}
+}
+
+// Reports whether the candidate's block consists of nothing but its last length
+// statements and its terminator. Jumps into such a block can be retargeted to
+// another copy of the tail, so the block itself disappears. The entry block is
+// never removed, since the script's label must stay in place.
+func (c tailCandidate) isWholeTail(length int) bool {
+	return c.id != 0 && length == len(c.g.blocks[c.id].statements)
+}
+
+// Replaces the last length statements of the candidate's block, along with its
+// terminator, with a jump to the shared copy of them.
+func (c tailCandidate) jumpTo(shared tailCandidate, length int) {
+	block := c.g.blocks[c.id]
+	block.statements = block.statements[:len(block.statements)-length]
+	if shared.g == c.g {
+		block.terminator = &jumpTerminator{dest: shared.id}
+	} else {
+		shared.g.blocks[shared.id].shared = true
+		block.terminator = &jumpTerminator{dest: c.g.externalBlock(shared.g.getLabel(shared.id))}
+	}
+}
+
+// Decides whether the last length commands of a block are worth sharing with
+// the candidate's copy of them.
+//
+// When either block is nothing but the tail, jumps into that block can simply
+// be retargeted, so sharing is free. Otherwise, one of the blocks needs a
+// "goto" to the shared copy, which is estimated at 5 bytes. A partial tail is
+// therefore only shared when its commands and terminator are larger than that.
+// For example, "release" followed by "end" is only 2 bytes, so it is shared
+// with a block that ends in "release" and "end" only when one of the blocks
+// contains nothing else.
+func (e *Emitter) shouldMergeTail(c tailCandidate, g *scriptGraph, id int, length int) bool {
+	block := g.blocks[id]
+	current := tailCandidate{g: g, id: id}
+	if e.optimizationGoal == OptimizeForSpeed {
+		return current.isWholeTail(length) && length == len(c.g.blocks[c.id].statements)
+	}
+	removesBlock := current.isWholeTail(length) || (!c.merged && c.isWholeTail(length))
+
+	savings := estimatedTerminatorSize(block.terminator)
+	for _, stmt := range block.statements[len(block.statements)-length:] {
+		savings += estimatedCommandSize(stmt.(*ast.CommandStatement))
+	}
+	cost := gotoCommandSize
+	if removesBlock {
+		cost = 0
+	}
+	return savings > cost
+}
+
+// Moves the last length statements of the candidate block, along with its
+// terminator, into a new block. Returns the block containing the tail.
+func (c tailCandidate) splitTail(length int) tailCandidate {
+	block := c.g.blocks[c.id]
+	if length == len(block.statements) {
+		return c
+	}
+	id := c.g.newBlockID()
+	c.g.blocks[id] = &basicBlock{
+		id:         id,
+		statements: block.statements[len(block.statements)-length:],
+		terminator: block.terminator,
+	}
+	block.statements = block.statements[:len(block.statements)-length]
+	block.terminator = &jumpTerminator{dest: id}
+	return tailCandidate{g: c.g, id: id}
+}
+
+// Skips "compare" commands whose result is already known. For example, in
+// "if (var(VAR_1) < 5) {...} elif (var(VAR_1) == 5) {...}", the second
+// condition can reuse the result of the first comparison, since the
+// "goto_if_*" commands don't modify it.
+//
+// Only comparisons against the same value are reused. A comparison only tells
+// whether the var is less than, equal to, or greater than that value, so it
+// can't decide a condition against a different value. For example,
+// "if (var(VAR_1) == 1) {...} elif (var(VAR_1) == 2) {...}" intentionally
+// keeps a "compare" for each condition.
+func reuseComparisons(g *scriptGraph) error {
+	preds := g.predecessors()
+	for _, id := range g.sortedIDs() {
+		block := g.blocks[id]
+		cond, ok := block.terminator.(*conditionalTerminator)
+		// The entry block can be reached from anywhere, and any statements
+		// could modify the comparison result.
+		if !ok || id == 0 || len(block.statements) > 0 || cond.preamble != nil || cond.condition.Type != token.VAR {
+			continue
+		}
+		reusable := len(preds[id]) > 0
+		for _, predID := range preds[id] {
+			predCond, ok := g.blocks[predID].terminator.(*conditionalTerminator)
+			if !ok || !isSameComparison(predCond.condition, cond.condition) {
+				reusable = false
+				break
+			}
+		}
+		cond.reusesComparison = reusable
+	}
+	return nil
+}
+
+// Reports whether two var conditions emit the same comparison command.
+func isSameComparison(a, b *ast.OperatorExpression) bool {
+	return a.Type == token.VAR && b.Type == token.VAR &&
+		a.Operand.Literal == b.Operand.Literal &&
+		a.ComparisonValue == b.ComparisonValue &&
+		a.ComparisonValueType == b.ComparisonValueType
+}
+
+// Replaces a branch to a block that only calls another script with a conditional
+// call, such as "call_if_set". The conditional call commands are supplied by the
+// command config, since they are defined by the target project.
+func (e *Emitter) lowerConditionalCalls(g *scriptGraph) error {
+	for _, id := range g.sortedIDs() {
+		block := g.blocks[id]
+		cond, ok := block.terminator.(*conditionalTerminator)
+		if !ok {
+			continue
+		}
+		callCommand, ok := e.commandConfig.ConditionalCallCommands[branchCommand(cond.condition)]
+		if !ok {
+			continue
+		}
+		dest := g.blocks[cond.trueDest]
+		if dest == nil || dest.isExternal() || len(dest.statements) != 1 {
+			continue
+		}
+		callStmt, ok := dest.statements[0].(*ast.CommandStatement)
+		if !ok || callStmt.Name.Value != "call" || len(callStmt.Args) != 1 {
+			continue
+		}
+		if next, ok := continuationDest(dest.terminator); !ok || next != cond.falseDest {
+			continue
+		}
+		block.terminator = &conditionalCallTerminator{
+			condition: cond.condition,
+			preamble:  cond.preamble,
+			command:   callCommand,
+			callee:    callStmt.Args[0],
+			dest:      cond.falseDest,
+		}
+	}
+	return nil
+}
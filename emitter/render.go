@@ -0,0 +1,271 @@
+package emitter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/parser"
+	"github.com/huderlem/poryscript/token"
+)
+
+// Renders a script's control-flow graph, using the graph's block layout.
+func (e *Emitter) renderScriptGraph(g *scriptGraph, textLabels map[string]struct{}) (string, error) {
+	// Build a collection of block labels for error-reporting purposes.
+	blockLabels := map[string]struct{}{}
+	for _, id := range g.sortedIDs() {
+		blockLabels[g.getLabel(id)] = struct{}{}
+	}
+
+	// First, render the bodies of each block. We'll
+	// render the actual block labels after, since there is
+	// an opportunity to skip renering unnecessary labels.
+	var nextID int
+	blockBodies := make(map[int]*strings.Builder)
+	jumpBlocks := make(map[int]bool)
+	registerJumpBlock := func(id int) {
+		jumpBlocks[id] = true
+	}
+	for i, id := range g.layout {
+		var sb strings.Builder
+		blockBodies[id] = &sb
+		if i < len(g.layout)-1 {
+			nextID = g.layout[i+1]
+		} else {
+			nextID = -1
+		}
+		block := g.blocks[id]
+		err := renderStatements(&sb, block.statements, blockLabels, textLabels, e.enableLineMarkers, e.inputFilepath)
+		if err != nil {
+			return "", err
+		}
+		isFallThrough := g.renderTerminator(&sb, block.terminator, nextID, registerJumpBlock, e.enableLineMarkers, e.inputFilepath)
+		if !isFallThrough {
+			sb.WriteString("\n")
+		}
+	}
+
+	// Render the labels of each block, followed by its body.
+	// A label doesn't need to be rendered if nothing ever jumps
+	// to it.
+	var sb strings.Builder
+	for _, id := range g.layout {
+		if id == 0 || jumpBlocks[id] || g.blocks[id].shared {
+			g.renderLabel(id, &sb)
+		}
+		sb.WriteString(blockBodies[id].String())
+	}
+
+	return sb.String(), nil
+}
+
+func (g *scriptGraph) getLabel(id int) string {
+	if block, ok := g.blocks[id]; ok && block.isExternal() {
+		return block.externalLabel
+	}
+	if id == 0 {
+		// Main script entrypoint label.
+		return g.scriptName
+	}
+	return fmt.Sprintf("%s_%d", g.scriptName, id)
+}
+
+func (g *scriptGraph) renderLabel(id int, sb *strings.Builder) {
+	label := g.getLabel(id)
+	isMainEntryPoint := id == 0
+	if isMainEntryPoint && g.isGlobal {
+		sb.WriteString(fmt.Sprintf("%s::\n", label))
+	} else {
+		sb.WriteString(fmt.Sprintf("%s:\n", label))
+	}
+}
+
+func renderStatements(sb *strings.Builder, statements []ast.Statement, blockLabels map[string]struct{}, textLabels map[string]struct{}, enableLineMarkers bool, inputFilepath string) error {
+	// Render basic non-branching commands.
+	for _, stmt := range statements {
+		commandStmt, ok := stmt.(*ast.CommandStatement)
+		if ok {
+			tryEmitLineMarker(sb, commandStmt.Token, enableLineMarkers, inputFilepath)
+			sb.WriteString(renderCommandStatement(commandStmt))
+		} else if rawStmt, ok := stmt.(*ast.RawStatement); ok {
+			renderRawStatement(sb, rawStmt, enableLineMarkers, inputFilepath)
+		} else {
+			labelStmt, ok := stmt.(*ast.LabelStatement)
+			if ok {
+				// Error if the user-defined label collides with one of the auto-generated
+				// block or text labels.
+				if _, ok := blockLabels[labelStmt.Name.Value]; ok {
+					return parser.NewParseError(labelStmt.Token, fmt.Sprintf("duplicate script label '%s'. Choose a unique label that won't clash with the auto-generated script labels", labelStmt.Name.Value))
+				}
+				if _, ok := textLabels[labelStmt.Name.Value]; ok {
+					return parser.NewParseError(labelStmt.Token, fmt.Sprintf("duplicate text label '%s'. Choose a unique label that won't clash with the auto-generated text labels", labelStmt.Name.Value))
+				}
+				tryEmitLineMarker(sb, labelStmt.Token, enableLineMarkers, inputFilepath)
+				sb.WriteString(renderLabelStatement(labelStmt))
+			} else {
+				return fmt.Errorf("could not render chunk statement '%q' because it is not a command or label statement", stmt.TokenLiteral())
+			}
+		}
+	}
+	return nil
+}
+
+// Renders the commands for the given block terminator. Returns true if the block
+// falls through to the next block, rather than explicitly jumping or exiting.
+func (g *scriptGraph) renderTerminator(sb *strings.Builder, t terminator, nextID int, registerJumpBlock func(int), enableLineMarkers bool, inputFilepath string) bool {
+	switch t := t.(type) {
+	case *exitTerminator:
+		if t.command != "" {
+			sb.WriteString(fmt.Sprintf("\t%s\n", t.command))
+		}
+		return false
+	case *jumpTerminator:
+		return g.renderJump(sb, t.dest, nextID, registerJumpBlock)
+	case *conditionalTerminator:
+		registerJumpBlock(t.trueDest)
+		if t.preamble != nil {
+			sb.WriteString(renderCommandStatement(t.preamble))
+		}
+		renderBranchComparison(sb, t.condition, branchCommand(t.condition), g.getLabel(t.trueDest), t.reusesComparison, enableLineMarkers, inputFilepath)
+		return g.renderJump(sb, t.falseDest, nextID, registerJumpBlock)
+	case *conditionalCallTerminator:
+		if t.preamble != nil {
+			sb.WriteString(renderCommandStatement(t.preamble))
+		}
+		renderBranchComparison(sb, t.condition, t.command, t.callee, false, enableLineMarkers, inputFilepath)
+		return g.renderJump(sb, t.dest, nextID, registerJumpBlock)
+	case *switchTerminator:
+		tryEmitLineMarker(sb, t.operand, enableLineMarkers, inputFilepath)
+		sb.WriteString(fmt.Sprintf("\tswitch %s\n", t.operand.Literal))
+		for _, switchCase := range t.cases {
+			registerJumpBlock(switchCase.dest)
+			tryEmitLineMarker(sb, switchCase.value, enableLineMarkers, inputFilepath)
+			sb.WriteString(fmt.Sprintf("\tcase %s, %s\n", switchCase.value.Literal, g.getLabel(switchCase.dest)))
+		}
+		return g.renderJump(sb, t.defaultDest, nextID, registerJumpBlock)
+	}
+	return false
+}
+
+// Renders a jump to the given destination, unless it can simply fall through
+// to the next block.
+func (g *scriptGraph) renderJump(sb *strings.Builder, dest int, nextID int, registerJumpBlock func(int)) bool {
+	if dest == returnTarget {
+		sb.WriteString("\treturn\n")
+		return false
+	} else if dest != nextID {
+		registerJumpBlock(dest)
+		sb.WriteString(fmt.Sprintf("\tgoto %s\n", g.getLabel(dest)))
+		return false
+	}
+	return true
+}
+
+// Returns the command that jumps when the condition holds, such as "goto_if_set".
+func branchCommand(condition *ast.OperatorExpression) string {
+	switch condition.Type {
+	case token.FLAG:
+		if isTruthyComparison(condition) {
+			return "goto_if_set"
+		}
+		return "goto_if_unset"
+	case token.VAR:
+		switch condition.Operator {
+		case token.EQ:
+			return "goto_if_eq"
+		case token.NEQ:
+			return "goto_if_ne"
+		case token.LT:
+			return "goto_if_lt"
+		case token.LTE:
+			return "goto_if_le"
+		case token.GT:
+			return "goto_if_gt"
+		case token.GTE:
+			return "goto_if_ge"
+		}
+	case token.DEFEATED:
+		return "goto_if"
+	}
+	return ""
+}
+
+func isTruthyComparison(condition *ast.OperatorExpression) bool {
+	return (condition.Operator == token.EQ && condition.ComparisonValue == token.TRUE) ||
+		(condition.Operator == token.NEQ && condition.ComparisonValue == token.FALSE)
+}
+
+// Renders the condition's comparison, followed by the given branch command, which
+// is either the condition's branchCommand() or an equivalent, such as "call_if_set".
+func renderBranchComparison(sb *strings.Builder, condition *ast.OperatorExpression, command string, destLabel string, reusesComparison bool, enableLineMarkers bool, inputFilepath string) {
+	tryEmitLineMarker(sb, condition.Operand, enableLineMarkers, inputFilepath)
+	switch condition.Type {
+	case token.FLAG:
+		renderFlagComparison(sb, condition, command, destLabel)
+	case token.VAR:
+		renderVarComparison(sb, condition, command, destLabel, reusesComparison)
+	case token.DEFEATED:
+		renderDefeatedComparison(sb, condition, command, destLabel)
+	}
+}
+
+func renderFlagComparison(sb *strings.Builder, condition *ast.OperatorExpression, command string, destLabel string) {
+	sb.WriteString(fmt.Sprintf("\t%s %s, %s\n", command, condition.Operand.Literal, destLabel))
+}
+
+func renderVarComparison(sb *strings.Builder, condition *ast.OperatorExpression, command string, destLabel string, reusesComparison bool) {
+	if !reusesComparison {
+		compareCommand := "compare"
+		if condition.ComparisonValueType == ast.StrictValueComparison {
+			compareCommand = "compare_var_to_value"
+		}
+		sb.WriteString(fmt.Sprintf("\t%s %s, %s\n", compareCommand, condition.Operand.Literal, condition.ComparisonValue))
+	}
+	sb.WriteString(fmt.Sprintf("\t%s %s\n", command, destLabel))
+}
+
+func renderDefeatedComparison(sb *strings.Builder, condition *ast.OperatorExpression, command string, destLabel string) {
+	sb.WriteString(fmt.Sprintf("\tchecktrainerflag %s\n", condition.Operand.Literal))
+	if isTruthyComparison(condition) {
+		sb.WriteString(fmt.Sprintf("\t%s 1, %s\n", command, destLabel))
+	} else {
+		sb.WriteString(fmt.Sprintf("\t%s 0, %s\n", command, destLabel))
+	}
+}
+
+func renderCommandStatement(commandStmt *ast.CommandStatement) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("\t%s", commandStmt.Name.Value))
+	if len(commandStmt.Args) > 0 {
+		sb.WriteString(fmt.Sprintf(" %s", strings.Join(commandStmt.Args, ", ")))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// Renders a raw statement inside of a script. The blank line that directly
+// follows the opening backtick is skipped.
+func renderRawStatement(sb *strings.Builder, rawStmt *ast.RawStatement, enableLineMarkers bool, inputFilepath string) {
+	lines := strings.Split(rawStmt.Value, "\n")
+	lineNumber := rawStmt.Token.LineNumber
+	if len(lines) > 1 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+		lineNumber++
+	}
+	for i, line := range lines {
+		if shouldEmitLineMarkers(enableLineMarkers, inputFilepath) {
+			emitLineMarker(sb, lineNumber+i, inputFilepath)
+		}
+		sb.WriteString(fmt.Sprintf("%s\n", line))
+	}
+}
+
+func renderLabelStatement(labelStmt *ast.LabelStatement) string {
+	var sb strings.Builder
+	if labelStmt.IsGlobal {
+		sb.WriteString(fmt.Sprintf("%s::\n", labelStmt.Name.Value))
+	} else {
+		sb.WriteString(fmt.Sprintf("%s:\n", labelStmt.Name.Value))
+	}
+	return sb.String()
+}
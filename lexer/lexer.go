@@ -30,6 +30,20 @@ func New(input string) *Lexer {
 	return l
 }
 
+// Snapshot returns a copy of the lexer's current state. Passing the copy to
+// Restore rewinds the lexer, so that it produces the same tokens again.
+func (l *Lexer) Snapshot() Lexer {
+	snapshot := *l
+	snapshot.queuedTokens = append([]token.Token{}, l.queuedTokens...)
+	return snapshot
+}
+
+// Restore rewinds the lexer to a state returned by Snapshot.
+func (l *Lexer) Restore(snapshot Lexer) {
+	*l = snapshot
+	l.queuedTokens = append([]token.Token{}, snapshot.queuedTokens...)
+}
+
 func (l *Lexer) readChar() {
 	prevCh := l.ch
 	var charSize int
@@ -86,7 +100,11 @@ func (l *Lexer) NextToken() token.Token {
 
 	// Check for single-line comment.
 	// Both '#' and '//' are valid comment styles.
+	// Compile-time directives, such as '#if', also start with '#'.
 	for l.ch == '#' || (l.ch == '/' && l.peekChar() == '/') {
+		if l.ch == '#' && l.isDirective() {
+			return l.readDirective()
+		}
 		l.skipToNextLine()
 		l.skipWhitespace()
 	}
@@ -208,6 +226,8 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newSingleCharToken(token.COMMA, l.ch, l.lineNumber, l.charNumber, l.utf8CharNumber)
 	case ':':
 		tok = newSingleCharToken(token.COLON, l.ch, l.lineNumber, l.charNumber, l.utf8CharNumber)
+	case ';':
+		tok = newSingleCharToken(token.SEMICOLON, l.ch, l.lineNumber, l.charNumber, l.utf8CharNumber)
 	case '"':
 		return l.readStringToken()
 	case '`':
@@ -326,6 +346,126 @@ func (l *Lexer) skipToNextLine() {
 	l.readChar()
 }
 
+var directiveNames = []string{"if", "elif", "else", "endif"}
+
+// Checks if the current '#' starts a compile-time directive. Directives must be
+// the first thing on their line. '#if' and '#elif' must be followed by a valid
+// condition, and '#else' and '#endif' must be alone, so that comments like
+// "# if the player..." or "#else branch" still work.
+func (l *Lexer) isDirective() bool {
+	lineStart := strings.LastIndexByte(l.input[:l.position], '\n') + 1
+	if strings.TrimSpace(l.input[lineStart:l.position]) != "" {
+		return false
+	}
+	line := l.input[l.readPosition:]
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	name, condition := line, ""
+	if i := strings.IndexAny(line, " \t\r"); i != -1 {
+		name, condition = line[:i], line[i:]
+	}
+	switch name {
+	case "if", "elif":
+		return isDirectiveCondition(condition)
+	case "else", "endif":
+		return strings.TrimSpace(condition) == ""
+	}
+	return false
+}
+
+// Checks that a directive's condition is a boolean expression of compile
+// switches, such as "VERSION == RUBY && !DEBUG". The parser evaluates it.
+func isDirectiveCondition(condition string) bool {
+	tokens := []token.Token{}
+	l := New(condition)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		tokens = append(tokens, tok)
+	}
+	pos := 0
+	accept := func(tokenType token.Type) bool {
+		if pos < len(tokens) && tokens[pos].Type == tokenType {
+			pos++
+			return true
+		}
+		return false
+	}
+	acceptOperand := func() bool {
+		if pos >= len(tokens) {
+			return false
+		}
+		tok := tokens[pos]
+		if tok.Type == token.IDENT || tok.Type == token.INT || token.GetIdentType(tok.Literal) == tok.Type {
+			pos++
+			return true
+		}
+		return false
+	}
+	var parseOr, parseUnary func() bool
+	parseUnary = func() bool {
+		if accept(token.NOT) {
+			return parseUnary()
+		}
+		if accept(token.LPAREN) {
+			return parseOr() && accept(token.RPAREN)
+		}
+		if !acceptOperand() {
+			return false
+		}
+		if accept(token.EQ) || accept(token.NEQ) {
+			return acceptOperand()
+		}
+		return true
+	}
+	parseAnd := func() bool {
+		if !parseUnary() {
+			return false
+		}
+		for accept(token.AND) {
+			if !parseUnary() {
+				return false
+			}
+		}
+		return true
+	}
+	parseOr = func() bool {
+		if !parseAnd() {
+			return false
+		}
+		for accept(token.OR) {
+			if !parseAnd() {
+				return false
+			}
+		}
+		return true
+	}
+	return parseOr() && pos == len(tokens)
+}
+
+// Reads a compile-time directive, such as "#if VERSION == RUBY". The token's
+// literal is the entire directive, up to the end of the line.
+func (l *Lexer) readDirective() token.Token {
+	tok := token.Token{
+		Type:               token.DIRECTIVE,
+		LineNumber:         l.lineNumber,
+		EndLineNumber:      l.lineNumber,
+		StartCharIndex:     l.charNumber - 1,
+		StartUtf8CharIndex: l.utf8CharNumber - 1,
+	}
+	start := l.position
+	end := l.position
+	for l.ch != '\n' && l.ch != 0 {
+		if l.ch != ' ' && l.ch != '\t' && l.ch != '\r' {
+			end = l.readPosition
+			tok.EndCharIndex = l.charNumber
+			tok.EndUtf8CharIndex = l.utf8CharNumber
+		}
+		l.readChar()
+	}
+	tok.Literal = l.input[start:end]
+	return tok
+}
+
 func (l *Lexer) skipNewlineWhitespace() bool {
 	skipped := false
 	for l.ch == '\n' || l.ch == '\r' {
@@ -53,7 +53,7 @@ func TestNextToken(t *testing.T) {
 		mart
 		"multiline text
 		string"
-	moves`
+	moves; template switch_default`
 
 	tests := []struct {
 		expectedType          token.Type
@@ -164,7 +164,10 @@ func TestNextToken(t *testing.T) {
 		{token.MART, "mart", 44, 2, 2, 44, 6, 6},
 		{token.AUTOSTRING, "multiline text\\n\nstring", 45, 2, 2, 46, 9, 9},
 		{token.MOVES, "moves", 47, 1, 1, 47, 6, 6},
-		{token.EOF, "", 47, 6, 6, 47, 6, 6},
+		{token.SEMICOLON, ";", 47, 6, 6, 47, 7, 7},
+		{token.IDENT, "template", 47, 8, 8, 47, 16, 16},
+		{token.IDENT, "switch_default", 47, 17, 17, 47, 31, 31},
+		{token.EOF, "", 47, 31, 31, 47, 31, 31},
 	}
 
 	l := New(input)
@@ -319,3 +322,96 @@ world"`
 		t.Errorf("second token literal wrong. Expected=%q, Got=%q", expectedLiteral, tok.Literal)
 	}
 }
+
+func TestSnapshot(t *testing.T) {
+	l := New(`script MyScript { ascii"text" }`)
+	// Read up to the string type, so that the string token is queued.
+	for i := 0; i < 4; i++ {
+		l.NextToken()
+	}
+	snapshot := l.Snapshot()
+	first := []token.Token{l.NextToken(), l.NextToken(), l.NextToken()}
+	l.Restore(snapshot)
+	for i, expected := range first {
+		tok := l.NextToken()
+		if tok.Type != expected.Type || tok.Literal != expected.Literal || tok.StartCharIndex != expected.StartCharIndex {
+			t.Fatalf("token %d after restore is wrong. expected=%q, got=%q", i, expected.Literal, tok.Literal)
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	input := `#if VERSION == RUBY  
+  foo # if this is a comment
+	#else
+#elifx
+#endif`
+	tests := []struct {
+		expectedType         token.Type
+		expectedLiteral      string
+		expectedLineNumber   int
+		expectedStartCharIdx int
+		expectedEndCharIdx   int
+	}{
+		{token.DIRECTIVE, "#if VERSION == RUBY", 1, 0, 19},
+		{token.IDENT, "foo", 2, 2, 5},
+		{token.DIRECTIVE, "#else", 3, 1, 6},
+		{token.DIRECTIVE, "#endif", 5, 0, 6},
+		{token.EOF, "", 5, 0, 0},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Type == token.EOF {
+			continue
+		}
+		if tok.LineNumber != tt.expectedLineNumber {
+			t.Fatalf("tests[%d] - line number wrong. expected=%d, got=%d", i, tt.expectedLineNumber, tok.LineNumber)
+		}
+		if tok.StartCharIndex != tt.expectedStartCharIdx || tok.EndCharIndex != tt.expectedEndCharIdx {
+			t.Fatalf("tests[%d] - char range wrong. expected=%d-%d, got=%d-%d", i, tt.expectedStartCharIdx, tt.expectedEndCharIdx, tok.StartCharIndex, tok.EndCharIndex)
+		}
+	}
+}
+
+func TestDirectiveLikeComments(t *testing.T) {
+	// Lines that start with '#' are only directives when they're well-formed,
+	// so older comments still lex as comments.
+	input := `# if the player has the badge
+#else branch
+#if
+#if (VERSION == RUBY
+#elif VERSION ==
+#if VERSION == RUBY SAPPHIRE
+#endif VERSION
+foo
+#else
+#if VERSION == RUBY || (!DEBUG && LANGUAGE != JAPANESE)`
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "foo"},
+		{token.DIRECTIVE, "#else"},
+		{token.DIRECTIVE, "#if VERSION == RUBY || (!DEBUG && LANGUAGE != JAPANESE)"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
@@ -8,10 +8,14 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/cheader"
 	"github.com/huderlem/poryscript/emitter"
 	"github.com/huderlem/poryscript/lexer"
+	"github.com/huderlem/poryscript/movement"
 	"github.com/huderlem/poryscript/parser"
 )
 
@@ -32,6 +36,17 @@ func (opt mapOption) Set(value string) error {
 	return nil
 }
 
+type listOption []string
+
+func (opt *listOption) String() string {
+	return ""
+}
+
+func (opt *listOption) Set(value string) error {
+	*opt = append(*opt, value)
+	return nil
+}
+
 type options struct {
 	inputFilepath         string
 	outputFilepath        string
@@ -40,8 +55,20 @@ type options struct {
 	defaultFontID         string
 	maxLineLength         int
 	optimize              bool
+	optimizationGoal      emitter.OptimizationGoal
+	mergeScriptTails      bool
+	strictScriptEnds      bool
 	enableLineMarkers     bool
 	compileSwitches       map[string]string
+	checkAllSwitches      bool
+	constants             map[string]string
+	constOverridePolicy   parser.ConstOverridePolicy
+	cHeaderPatterns       []string
+	symbolConfig          parser.SymbolConfig
+	undefinedSymbolMode   parser.UndefinedSymbolMode
+	strictCommands        bool
+	movementCatalogue     *movement.Catalogue
+	movementDurations     bool
 }
 
 func parseOptions() options {
@@ -54,9 +81,25 @@ func parseOptions() options {
 	fontIDPtr := flag.String("f", "", "set default font id (leave empty to use default defined in font config file)")
 	lengthPtr := flag.Int("l", 0, "set default line length in pixels for formatted text (uses font config file for default)")
 	optimizePtr := flag.Bool("optimize", true, "optimize compiled script size (To disable, use '-optimize=false')")
+	optimizeForPtr := flag.String("optimize-for", "speed", "choose whether optimized output prefers faster scripts or smaller scripts ('speed' or 'size')")
+	mergeScriptTailsPtr := flag.Bool("merge-script-tails", false, "allow optimized scripts to share identical script endings with other scripts in the same file")
+	strictScriptEndsPtr := flag.Bool("strict-script-ends", false, "treat scripts that use 'end', but can also reach the end of the script, as an error instead of a warning")
+	strictCommandsPtr := flag.Bool("strict-commands", false, "treat commands that aren't in the \"commands\" or \"known_commands\" sections of the command config as errors")
 	enableLineMarkersPtr := flag.Bool("lm", true, "include line markers in output (enables more helpful error messages when compiling the ROM). (To disable, use '-lm=false')")
 	compileSwitches := make(mapOption)
 	flag.Var(compileSwitches, "s", "set a compile-time switch. Multiple -s options can be set. Example: -s VERSION=RUBY -s LANGUAGE=GERMAN")
+	switchFilePtr := flag.String("sf", "", "load compile-time switches from a file, which has one KEY=VALUE switch per line. Switches set with -s take priority")
+	constants := make(mapOption)
+	flag.Var(constants, "D", "define a const. Multiple -D options can be set. Example: -D MAX_BADGES=8")
+	constOverridePtr := flag.String("const-override", "error", "choose what happens when a const in the script has the same name as a -D const ('error', 'keep', or 'allow'). 'keep' uses the -D value, and 'allow' uses the script's value")
+	var cHeaderPatterns listOption
+	flag.Var(&cHeaderPatterns, "ch", "read #define and enum constants from C header files. Multiple -ch options can be set, and each one can be a glob pattern. Example: -ch \"include/constants/*.h\"")
+	var movementFiles listOption
+	flag.Var(&movementFiles, "movements", "read the movement commands from a JSON file or from asm/macros/movement.inc. They're used to catch misspelled movement commands. Multiple -movements options can be set")
+	movementDurationsPtr := flag.Bool("movement-durations", false, "print the number of frames that each movement takes. Frame counts are read from -movements JSON files")
+	symbolsPtr := flag.String("symbols", "", "JSON file that lists the symbols and movement commands scripts can reference. They're used with the constants from -ch to catch misspelled names")
+	undefinedSymbolsPtr := flag.String("undefined-symbols", "", "choose what happens when a script references an unknown symbol ('off', 'warn', or 'error'). Defaults to 'warn' when -symbols or -movements is set, and 'off' otherwise")
+	checkAllSwitchesPtr := flag.Bool("check-all-switches", false, "compile every combination of compile-time switch values, and report the ones that fail. Switches can list their values with -s, such as -s VERSION=RUBY,SAPPHIRE")
 	flag.Parse()
 
 	if *helpPtr {
@@ -69,6 +112,72 @@ func parseOptions() options {
 		os.Exit(0)
 	}
 
+	if *switchFilePtr != "" {
+		readSwitchFile(*switchFilePtr, compileSwitches)
+	}
+
+	var constOverridePolicy parser.ConstOverridePolicy
+	switch *constOverridePtr {
+	case "error":
+		constOverridePolicy = parser.ConstOverrideError
+	case "keep":
+		constOverridePolicy = parser.ConstOverrideKeepDefined
+	case "allow":
+		constOverridePolicy = parser.ConstOverrideAllow
+	default:
+		log.Fatalf("PORYSCRIPT ERROR: Invalid -const-override value '%s'. Expected 'error', 'keep', or 'allow'\n", *constOverridePtr)
+	}
+
+	var symbolConfig parser.SymbolConfig
+	if *symbolsPtr != "" {
+		var err error
+		symbolConfig, err = parser.LoadSymbolConfig(*symbolsPtr)
+		if err != nil {
+			log.Fatalf("PORYSCRIPT ERROR: Failed to load symbols file: %s\n", err.Error())
+		}
+	}
+
+	var movementCatalogue *movement.Catalogue
+	if len(movementFiles) > 0 {
+		movementCatalogue = movement.New()
+		for _, path := range movementFiles {
+			if err := movementCatalogue.ParseFile(path); err != nil {
+				log.Fatalf("PORYSCRIPT ERROR: Failed to load movements file: %s\n", err.Error())
+			}
+		}
+	} else if *movementDurationsPtr {
+		log.Fatalf("PORYSCRIPT ERROR: -movement-durations requires a -movements file with frame counts\n")
+	}
+
+	undefinedSymbols := *undefinedSymbolsPtr
+	if undefinedSymbols == "" {
+		undefinedSymbols = "off"
+		if *symbolsPtr != "" || len(movementFiles) > 0 {
+			undefinedSymbols = "warn"
+		}
+	}
+	var undefinedSymbolMode parser.UndefinedSymbolMode
+	switch undefinedSymbols {
+	case "off":
+		undefinedSymbolMode = parser.UndefinedSymbolsOff
+	case "warn":
+		undefinedSymbolMode = parser.UndefinedSymbolsWarn
+	case "error":
+		undefinedSymbolMode = parser.UndefinedSymbolsError
+	default:
+		log.Fatalf("PORYSCRIPT ERROR: Invalid -undefined-symbols value '%s'. Expected 'off', 'warn', or 'error'\n", undefinedSymbols)
+	}
+
+	var optimizationGoal emitter.OptimizationGoal
+	switch *optimizeForPtr {
+	case "speed":
+		optimizationGoal = emitter.OptimizeForSpeed
+	case "size":
+		optimizationGoal = emitter.OptimizeForSize
+	default:
+		log.Fatalf("PORYSCRIPT ERROR: Invalid -optimize-for value '%s'. Expected 'speed' or 'size'\n", *optimizeForPtr)
+	}
+
 	return options{
 		inputFilepath:         *inputPtr,
 		outputFilepath:        *outputPtr,
@@ -77,8 +186,20 @@ func parseOptions() options {
 		defaultFontID:         *fontIDPtr,
 		maxLineLength:         *lengthPtr,
 		optimize:              *optimizePtr,
+		optimizationGoal:      optimizationGoal,
+		mergeScriptTails:      *mergeScriptTailsPtr,
+		strictScriptEnds:      *strictScriptEndsPtr,
 		enableLineMarkers:     *enableLineMarkersPtr,
 		compileSwitches:       compileSwitches,
+		checkAllSwitches:      *checkAllSwitchesPtr,
+		constants:             constants,
+		constOverridePolicy:   constOverridePolicy,
+		cHeaderPatterns:       cHeaderPatterns,
+		symbolConfig:          symbolConfig,
+		undefinedSymbolMode:   undefinedSymbolMode,
+		strictCommands:        *strictCommandsPtr,
+		movementCatalogue:     movementCatalogue,
+		movementDurations:     *movementDurationsPtr,
 	}
 }
 
@@ -128,6 +249,106 @@ func readCommandConfig(filepath string) parser.CommandConfig {
 	return config
 }
 
+// Reads compile-time switches from a file, which has one KEY=VALUE switch per
+// line. Empty lines and lines starting with '#' or '//' are ignored. Switches
+// that are already set aren't overwritten.
+func readSwitchFile(filepath string, switches mapOption) {
+	bytes, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		log.Fatalf("PORYSCRIPT ERROR: Failed to read switch file: %s\n", err.Error())
+	}
+
+	for i, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		result := strings.SplitN(line, "=", 2)
+		if len(result) != 2 {
+			log.Fatalf("PORYSCRIPT ERROR: Failed to load switch file: line %d: expected switch to be separated by '=', but got '%s' instead\n", i+1, line)
+		}
+		key := strings.TrimSpace(result[0])
+		if _, ok := switches[key]; !ok {
+			switches[key] = strings.TrimSpace(result[1])
+		}
+	}
+}
+
+type compileResult struct {
+	output           string
+	warnings         []ast.Warning
+	switchReferences []parser.SwitchReference
+	movements        []*ast.MovementStatement
+}
+
+// Reads the constants from the C headers that match the given glob patterns.
+func readCHeaders(patterns []string) *cheader.Constants {
+	constants := cheader.New()
+	for _, pattern := range patterns {
+		filepaths, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Fatalf("PORYSCRIPT ERROR: Invalid C header pattern '%s': %s\n", pattern, err.Error())
+		}
+		if len(filepaths) == 0 {
+			log.Fatalf("PORYSCRIPT ERROR: No C header files match '%s'\n", pattern)
+		}
+		for _, path := range filepaths {
+			if err := constants.ParseFile(path); err != nil {
+				log.Fatalf("PORYSCRIPT ERROR: Failed to read C header file: %s\n", err.Error())
+			}
+		}
+	}
+	return constants
+}
+
+func compile(input string, commandConfig parser.CommandConfig, headerConstants *cheader.Constants, options options, compileSwitches map[string]string) (compileResult, error) {
+	var result compileResult
+	parser := parser.New(lexer.New(input), commandConfig, options.fontConfigFilepath, options.defaultFontID, options.maxLineLength, compileSwitches)
+	parser.DefineConstants(options.constants, options.constOverridePolicy)
+	parser.SetHeaderConstants(headerConstants)
+	parser.SetKnownSymbols(options.symbolConfig, options.undefinedSymbolMode)
+	parser.SetStrictCommands(options.strictCommands)
+	parser.SetMovementCatalogue(options.movementCatalogue)
+	program, err := parser.ParseProgram()
+	result.switchReferences = parser.SwitchReferences()
+	if err != nil {
+		return result, err
+	}
+
+	emitter := emitter.New(program, options.optimize, options.enableLineMarkers, options.inputFilepath)
+	emitter.SetOptimizationGoal(options.optimizationGoal)
+	emitter.SetMergeTailsAcrossScripts(options.mergeScriptTails)
+	emitter.SetCommandConfig(commandConfig)
+	emitter.SetStrictScriptEnds(options.strictScriptEnds)
+	result.output, err = emitter.Emit()
+	if err != nil {
+		return result, err
+	}
+	result.warnings = append(program.Warnings, emitter.Warnings()...)
+	for _, stmt := range program.TopLevelStatements {
+		if movementStmt, ok := stmt.(*ast.MovementStatement); ok {
+			result.movements = append(result.movements, movementStmt)
+		}
+	}
+	return result, nil
+}
+
+// Prints the number of frames that each movement takes.
+func reportMovementDurations(movements []*ast.MovementStatement, catalogue *movement.Catalogue) {
+	for _, movementStmt := range movements {
+		names := make([]string, len(movementStmt.MovementCommands))
+		for i, cmd := range movementStmt.MovementCommands {
+			names[i] = cmd.Literal
+		}
+		frames, unknown := catalogue.Duration(names)
+		if len(unknown) > 0 {
+			log.Printf("PORYSCRIPT: line %d: movement '%s' takes at least %d frames. Unknown frame counts: %s\n", movementStmt.Token.LineNumber, movementStmt.Name.Value, frames, strings.Join(unknown, ", "))
+		} else {
+			log.Printf("PORYSCRIPT: line %d: movement '%s' takes %d frames\n", movementStmt.Token.LineNumber, movementStmt.Name.Value, frames)
+		}
+	}
+}
+
 func main() {
 	log.SetFlags(0)
 	options := parseOptions()
@@ -137,18 +358,25 @@ func main() {
 	}
 
 	commandConfig := readCommandConfig(options.commandConfigFilepath)
-	parser := parser.New(lexer.New(input), commandConfig, options.fontConfigFilepath, options.defaultFontID, options.maxLineLength, options.compileSwitches)
-	program, err := parser.ParseProgram()
-	if err != nil {
-		log.Fatalf("PORYSCRIPT ERROR: %s\n", err.Error())
+	headerConstants := readCHeaders(options.cHeaderPatterns)
+	if options.checkAllSwitches {
+		if !reportSwitchCheck(checkAllSwitches(input, commandConfig, headerConstants, options)) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	emitter := emitter.New(program, options.optimize, options.enableLineMarkers, options.inputFilepath)
-	result, err := emitter.Emit()
+	result, err := compile(input, commandConfig, headerConstants, options, options.compileSwitches)
 	if err != nil {
 		log.Fatalf("PORYSCRIPT ERROR: %s\n", err.Error())
 	}
-	err = writeOutput(result, options.outputFilepath)
+	for _, warning := range result.warnings {
+		log.Printf("PORYSCRIPT WARNING: line %d: %s\n", warning.LineNumberStart, warning.Message)
+	}
+	if options.movementDurations {
+		reportMovementDurations(result.movements, options.movementCatalogue)
+	}
+	err = writeOutput(result.output, options.outputFilepath)
 	if err != nil {
 		log.Fatalf("PORYSCRIPT ERROR: %s\n", err.Error())
 	}
@@ -0,0 +1,185 @@
+// Package movement reads catalogues of movement commands, such as the ones
+// defined in the decomp projects' asm/macros/movement.inc file.
+package movement
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Command describes a movement command.
+type Command struct {
+	Name string
+	// Number of frames that the movement takes, or -1 if it isn't known.
+	Frames int
+	// Terminating commands, such as step_end, end the movement. Commands after
+	// them are never run.
+	Terminator bool
+}
+
+// Catalogue is a set of movement commands.
+type Catalogue struct {
+	commands map[string]Command
+	names    []string
+}
+
+// New creates an empty catalogue.
+func New() *Catalogue {
+	return &Catalogue{
+		commands: make(map[string]Command),
+	}
+}
+
+// ParseFile reads the movement commands from a file. JSON files are read with
+// ParseJSON, and other files are read as assembly macros with ParseMacros.
+func (c *Catalogue) ParseFile(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return c.ParseJSON(bytes)
+	}
+	c.ParseMacros(string(bytes))
+	return nil
+}
+
+// ParseJSON reads movement commands from JSON, such as:
+//
+//	{
+//	    "walk_up": {"frames": 16},
+//	    "step_end": {"terminator": true}
+//	}
+//
+// Commands that are already in the catalogue are replaced.
+func (c *Catalogue) ParseJSON(bytes []byte) error {
+	var commands map[string]struct {
+		Frames     *int `json:"frames"`
+		Terminator bool `json:"terminator"`
+	}
+	if err := json.Unmarshal(bytes, &commands); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	// Map iteration order is random, so keep the order of the names stable.
+	sort.Strings(names)
+	for _, name := range names {
+		command := Command{
+			Name:       name,
+			Frames:     -1,
+			Terminator: commands[name].Terminator,
+		}
+		if commands[name].Frames != nil {
+			command.Frames = *commands[name].Frames
+		}
+		c.Add(command)
+	}
+	return nil
+}
+
+// ParseMacros reads movement commands from assembly macros, such as
+// asm/macros/movement.inc. Commands are created with the create_movement_action
+// macro in pokeemerald and pokefirered, and with the create_movement macro in
+// pokeruby:
+//
+//	create_movement_action walk_up, MOVEMENT_ACTION_WALK_NORMAL_UP
+//	create_movement walk_up
+//
+// Other macros without parameters are also movement commands, unless they're
+// defined inside of another macro. step_end is a terminator. Frame counts
+// aren't known, since they're defined by the game's code.
+func (c *Catalogue) ParseMacros(input string) {
+	depth := 0
+	for _, line := range strings.Split(input, "\n") {
+		if i := strings.IndexAny(line, "@;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case ".macro":
+			if depth == 0 && len(fields) == 2 && !strings.Contains(fields[1], "\\") {
+				c.addMacro(fields[1])
+			}
+			depth++
+		case ".endm":
+			if depth > 0 {
+				depth--
+			}
+		case "create_movement_action", "create_movement":
+			if depth == 0 && len(fields) >= 2 {
+				c.addMacro(fields[1])
+			}
+		}
+	}
+}
+
+func (c *Catalogue) addMacro(name string) {
+	if _, ok := c.commands[name]; ok {
+		return
+	}
+	c.Add(Command{Name: name, Frames: -1, Terminator: name == "step_end"})
+}
+
+// Add adds a command to the catalogue, replacing any command with the same name.
+func (c *Catalogue) Add(command Command) {
+	if _, ok := c.commands[command.Name]; !ok {
+		c.names = append(c.names, command.Name)
+	}
+	c.commands[command.Name] = command
+}
+
+// Lookup returns the command with the given name.
+func (c *Catalogue) Lookup(name string) (Command, bool) {
+	command, ok := c.commands[name]
+	return command, ok
+}
+
+// Names returns the names of all commands, in the order they were added.
+func (c *Catalogue) Names() []string {
+	return c.names
+}
+
+// Len returns the number of commands.
+func (c *Catalogue) Len() int {
+	return len(c.names)
+}
+
+// Duration returns the total number of frames that a sequence of movement
+// commands takes, up to the first terminator. It also returns the commands
+// whose frame counts aren't known.
+func (c *Catalogue) Duration(names []string) (int, []string) {
+	frames := 0
+	unknown := []string{}
+	for _, name := range names {
+		command, ok := c.commands[name]
+		if ok && command.Terminator {
+			break
+		}
+		if !ok || command.Frames < 0 {
+			if !containsString(unknown, name) {
+				unknown = append(unknown, name)
+			}
+			continue
+		}
+		frames += command.Frames
+	}
+	return frames, unknown
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package movement
+
+import (
+	"testing"
+)
+
+func TestParseMacros(t *testing.T) {
+	input := `	.macro create_movement_action name:req, value:req
+	.macro \name
+	.byte \value
+	.endm
+	.endm
+
+	create_movement_action face_down, MOVEMENT_ACTION_FACE_DOWN @ Comment
+	create_movement_action walk_up, MOVEMENT_ACTION_WALK_NORMAL_UP
+	create_movement jump_in_place
+	create_movement_action step_end, MOVEMENT_ACTION_STEP_END
+
+	.macro face_player_custom
+	.byte 0x4A
+	.endm
+`
+	c := New()
+	c.ParseMacros(input)
+
+	tests := []struct {
+		name       string
+		terminator bool
+	}{
+		{"face_down", false},
+		{"walk_up", false},
+		{"jump_in_place", false},
+		{"step_end", true},
+		{"face_player_custom", false},
+	}
+	if c.Len() != len(tests) {
+		t.Fatalf("Incorrect number of commands. Expected %d, got %d: %v", len(tests), c.Len(), c.Names())
+	}
+	for i, tt := range tests {
+		if name := c.Names()[i]; name != tt.name {
+			t.Fatalf("Incorrect command %d. Expected %s, got %s", i, tt.name, name)
+		}
+		command, _ := c.Lookup(tt.name)
+		if command.Terminator != tt.terminator {
+			t.Errorf("Incorrect terminator for %s. Expected %t, got %t", tt.name, tt.terminator, command.Terminator)
+		}
+		if command.Frames != -1 {
+			t.Errorf("Incorrect frames for %s. Expected -1, got %d", tt.name, command.Frames)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	c := New()
+	c.ParseMacros("\tcreate_movement_action step_end, MOVEMENT_ACTION_STEP_END\n")
+	err := c.ParseJSON([]byte(`{
+		"walk_up": {"frames": 16},
+		"walk_fast_up": {"frames": 8},
+		"set_invisible": {"frames": 0},
+		"face_down": {}
+	}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		names           []string
+		expectedFrames  int
+		expectedUnknown []string
+	}{
+		{[]string{"walk_up", "walk_up", "walk_fast_up", "set_invisible"}, 40, []string{}},
+		{[]string{"walk_up", "step_end", "walk_up"}, 16, []string{}},
+		{[]string{"walk_up", "face_down", "unknown", "face_down"}, 16, []string{"face_down", "unknown"}},
+	}
+	for i, tt := range tests {
+		frames, unknown := c.Duration(tt.names)
+		if frames != tt.expectedFrames {
+			t.Errorf("Test %d: Incorrect frames. Expected %d, got %d", i, tt.expectedFrames, frames)
+		}
+		if len(unknown) != len(tt.expectedUnknown) {
+			t.Fatalf("Test %d: Incorrect unknown commands. Expected %v, got %v", i, tt.expectedUnknown, unknown)
+		}
+		for j := range unknown {
+			if unknown[j] != tt.expectedUnknown[j] {
+				t.Errorf("Test %d: Incorrect unknown commands. Expected %v, got %v", i, tt.expectedUnknown, unknown)
+			}
+		}
+	}
+}
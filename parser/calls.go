@@ -0,0 +1,496 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/token"
+)
+
+// Parses a script's parameter list, such as "(item, count)". Each parameter is
+// passed in the configured arg var at the same position.
+func (p *Parser) parseScriptParams(scriptName string) ([]*ast.LocalDeclaration, error) {
+	startToken := p.curToken
+	params := []*ast.LocalDeclaration{}
+	p.nextToken()
+	for p.curToken.Type != token.RPAREN {
+		if p.curToken.Type == token.EOF {
+			return nil, NewParseError(startToken, fmt.Sprintf("missing closing parenthesis for parameters of script '%s'", scriptName))
+		}
+		if p.curToken.Type != token.IDENT {
+			return nil, NewParseError(p.curToken, fmt.Sprintf("expected parameter name for script '%s', but got '%s' instead", scriptName, p.curToken.Literal))
+		}
+		name := p.curToken.Literal
+		if _, ok := p.constants[name]; ok {
+			return nil, NewParseError(p.curToken, fmt.Sprintf("parameter '%s' has the same name as a const. Choose a different name for the parameter", name))
+		}
+		for _, other := range params {
+			if other.Name.Value == name {
+				return nil, NewParseError(p.curToken, fmt.Sprintf("duplicate parameter '%s' for script '%s'", name, scriptName))
+			}
+		}
+		if len(params) >= len(p.commandConfig.ScriptArgVars) {
+			return nil, NewParseError(p.curToken, fmt.Sprintf("script '%s' has too many parameters. Only %d script arg vars are configured in \"script_arg_vars\"", scriptName, len(p.commandConfig.ScriptArgVars)))
+		}
+		params = append(params, &ast.LocalDeclaration{
+			Token: p.curToken,
+			Name: &ast.Identifier{
+				Token: p.curToken,
+				Value: name,
+			},
+			Type:  token.VAR,
+			Value: p.commandConfig.ScriptArgVars[len(params)],
+		})
+		p.nextToken()
+		if p.curToken.Type == token.COMMA {
+			p.nextToken()
+		} else if p.curToken.Type != token.RPAREN {
+			return nil, NewParseError(p.curToken, fmt.Sprintf("expected ',' or ')' after parameter '%s', but got '%s' instead", name, p.curToken.Literal))
+		}
+	}
+	return params, nil
+}
+
+// Parses an assignment of a script's return value to a var, such as
+// "var(VAR_1) = GetCount()".
+func (p *Parser) parseScriptCallAssignment(scriptName string) ([]ast.Statement, *impData, error) {
+	varToken := p.curToken
+	returnVar := p.commandConfig.ScriptReturnVar
+	if returnVar == "" {
+		return nil, nil, NewParseError(varToken, "cannot assign a script's return value, because no \"script_return_var\" is configured")
+	}
+	if err := p.expectPeek(token.LPAREN); err != nil {
+		return nil, nil, NewRangeParseError(varToken, p.peekToken, "missing opening parenthesis for var operator")
+	}
+	p.nextToken()
+	parts := []string{}
+	for p.curToken.Type != token.RPAREN {
+		if p.curToken.Type == token.EOF {
+			return nil, nil, NewParseError(varToken, "missing closing ')' for var operator")
+		}
+		parts = append(parts, p.tryReplaceWithConstant(p.curToken.Literal))
+		p.nextToken()
+	}
+	if len(parts) == 0 {
+		return nil, nil, NewRangeParseError(varToken, p.curToken, "missing value for var operator")
+	}
+	if err := p.expectPeek(token.ASSIGN); err != nil {
+		return nil, nil, NewRangeParseError(varToken, p.peekToken, "expected '=' after var operator. Only the return values of scripts can be assigned to vars")
+	}
+	if err := p.expectPeek(token.IDENT); err != nil {
+		return nil, nil, NewParseError(p.peekToken, fmt.Sprintf("expected script call after '=', but got '%s' instead", p.peekToken.Literal))
+	}
+	callStmt, impData, err := p.parseCommandStatement(scriptName)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.assignedCalls = append(p.assignedCalls, callStmt)
+
+	statements := []ast.Statement{callStmt}
+	target := strings.Join(parts, " ")
+	if target != returnVar {
+		statements = append(statements, &ast.CommandStatement{
+			Token: varToken,
+			Name: &ast.Identifier{
+				Token: varToken,
+				Value: "copyvar",
+			},
+			Args: []string{target, returnVar},
+		})
+	}
+	return statements, impData, nil
+}
+
+// Lowers calls to scripts with parameters, and values returned with
+// "return(value)", into regular commands that pass the values in vars.
+func (p *Parser) lowerScriptCalls(program *ast.Program) error {
+	scripts := []*ast.ScriptStatement{}
+	functions := map[string]*ast.ScriptStatement{}
+	for _, stmt := range program.TopLevelStatements {
+		switch stmt := stmt.(type) {
+		case *ast.ScriptStatement:
+			scripts = append(scripts, stmt)
+			if stmt.Params != nil {
+				functions[stmt.Name.Value] = stmt
+			}
+		case *ast.MapScriptsStatement:
+			for _, child := range stmt.AllChildren() {
+				if scriptStmt, ok := child.(*ast.ScriptStatement); ok {
+					scripts = append(scripts, scriptStmt)
+				}
+			}
+		}
+	}
+
+	// A script's parameters live in arg vars, which can be overwritten by the
+	// scripts it calls. So, parameters that are read after a call are copied
+	// into locals when the script starts.
+	scopes := []*ast.ScriptStatement{}
+	scopeScripts := map[*ast.ScriptStatement][]*ast.ScriptStatement{}
+	for _, scriptStmt := range scripts {
+		scope := p.localScope(scriptStmt)
+		if len(scope.Params) == 0 {
+			continue
+		}
+		if _, ok := scopeScripts[scope]; !ok {
+			scopes = append(scopes, scope)
+		}
+		scopeScripts[scope] = append(scopeScripts[scope], scriptStmt)
+	}
+	for _, scope := range scopes {
+		copyParamsToLocals(scope, paramsReadAfterCalls(scope, scopeScripts[scope], functions))
+	}
+
+	for _, scriptStmt := range scripts {
+		blocks := []*ast.BlockStatement{scriptStmt.Body}
+		for _, child := range scriptStmt.Body.AllChildren() {
+			if block, ok := child.(*ast.BlockStatement); ok {
+				blocks = append(blocks, block)
+			}
+		}
+		for _, block := range blocks {
+			statements := make([]ast.Statement, 0, len(block.Statements))
+			for _, stmt := range block.Statements {
+				commandStmt, ok := stmt.(*ast.CommandStatement)
+				if !ok {
+					statements = append(statements, stmt)
+					continue
+				}
+				if commandStmt.Name.Value == "return" && len(commandStmt.Args) > 0 {
+					returnStmts, err := p.lowerReturnValue(commandStmt, scriptStmt)
+					if err != nil {
+						return err
+					}
+					statements = append(statements, returnStmts...)
+				} else if callee, ok := functions[commandStmt.Name.Value]; ok {
+					callStmts, err := p.lowerScriptCall(commandStmt, callee, scriptStmt)
+					if err != nil {
+						return err
+					}
+					statements = append(statements, callStmts...)
+				} else {
+					statements = append(statements, stmt)
+				}
+			}
+			block.Statements = statements
+		}
+	}
+
+	for _, callStmt := range p.assignedCalls {
+		callee, ok := functions[callStmt.Name.Value]
+		if !ok {
+			return NewParseError(callStmt.Token, fmt.Sprintf("cannot assign the return value of '%s', because it isn't a script with a parameter list", callStmt.Name.Value))
+		}
+		if callee.ReturnVar == "" {
+			return NewParseError(callStmt.Token, fmt.Sprintf("cannot assign the return value of script '%s', because it never returns a value with 'return(value)'", callStmt.Name.Value))
+		}
+	}
+	return nil
+}
+
+// Finds the parameters of the scope that are read after a call to another
+// script. Scripts hoisted from block literals can run after any of the scope's
+// calls, so all of their reads count when the scope calls other scripts.
+func paramsReadAfterCalls(scope *ast.ScriptStatement, scripts []*ast.ScriptStatement, functions map[string]*ast.ScriptStatement) map[string]bool {
+	params := map[string]bool{}
+	for _, param := range scope.Params {
+		params[param.Name.Value] = true
+	}
+	result := map[string]bool{}
+	markReads := func(stmts []ast.Statement) {
+		visitStatementOperands(stmts, func(value string, operator token.Type, tok token.Token) (string, error) {
+			for _, word := range identifierRegex.FindAllString(value, -1) {
+				if params[word] {
+					result[word] = true
+				}
+			}
+			return value, nil
+		})
+	}
+	scopeCalls := false
+	for _, scriptStmt := range scripts {
+		scopeCalls = scopeCalls || callsScripts(scriptStmt.Body.AllChildren(), functions)
+	}
+
+	var walk func(block *ast.BlockStatement)
+	walk = func(block *ast.BlockStatement) {
+		called := false
+		for _, stmt := range block.Statements {
+			subtree := append([]ast.Statement{stmt}, stmt.AllChildren()...)
+			if called {
+				markReads(subtree)
+				continue
+			}
+			switch stmt := stmt.(type) {
+			case *ast.WhileStatement, *ast.DoWhileStatement:
+				// The loop runs its body again after the calls inside of it.
+				if callsScripts(subtree, functions) {
+					markReads(subtree)
+				}
+			case *ast.IfStatement:
+				bodies := []*ast.BlockStatement{stmt.Consequence.Body, stmt.ElseConsequence}
+				for _, elif := range stmt.ElifConsequences {
+					bodies = append(bodies, elif.Body)
+				}
+				for _, body := range bodies {
+					if body != nil {
+						walk(body)
+					}
+				}
+			case *ast.SwitchStatement:
+				for _, c := range append([]*ast.SwitchCase{stmt.DefaultCase}, stmt.Cases...) {
+					if c != nil && c.Body != nil {
+						walk(c.Body)
+					}
+				}
+			}
+			called = callsScripts(subtree, functions)
+		}
+	}
+	for _, scriptStmt := range scripts {
+		if scriptStmt == scope {
+			walk(scriptStmt.Body)
+		} else if scopeCalls {
+			markReads(scriptStmt.Body.AllChildren())
+		}
+	}
+	return result
+}
+
+// Reports whether any of the statements call another script, which can
+// overwrite the arg vars.
+func callsScripts(stmts []ast.Statement, functions map[string]*ast.ScriptStatement) bool {
+	for _, stmt := range stmts {
+		commandStmt, ok := stmt.(*ast.CommandStatement)
+		if !ok {
+			continue
+		}
+		name := commandStmt.Name.Value
+		if _, ok := functions[name]; ok || name == "call" || strings.HasPrefix(name, "call_if") {
+			return true
+		}
+	}
+	return false
+}
+
+// Declares a local for each of the given parameters, which shadows the
+// parameter, and copies the parameter's arg var into it at the start of the script.
+func copyParamsToLocals(scriptStmt *ast.ScriptStatement, names map[string]bool) {
+	copies := []ast.Statement{}
+	for _, param := range scriptStmt.Params {
+		if !names[param.Name.Value] {
+			continue
+		}
+		scriptStmt.Locals = append(scriptStmt.Locals, &ast.LocalDeclaration{
+			Token: param.Token,
+			Name:  param.Name,
+			Type:  token.VAR,
+		})
+		copies = append(copies, &ast.CommandStatement{
+			Token: param.Token,
+			Name: &ast.Identifier{
+				Token: param.Token,
+				Value: "copyvar",
+			},
+			Args: []string{param.Name.Value, param.Value},
+		})
+	}
+	scriptStmt.Body.Statements = append(copies, scriptStmt.Body.Statements...)
+}
+
+func (p *Parser) lowerReturnValue(returnStmt *ast.CommandStatement, scriptStmt *ast.ScriptStatement) ([]ast.Statement, error) {
+	returnVar := p.commandConfig.ScriptReturnVar
+	if returnVar == "" {
+		return nil, NewParseError(returnStmt.Token, "cannot return a value, because no \"script_return_var\" is configured")
+	}
+	if len(returnStmt.Args) > 1 {
+		return nil, NewParseError(returnStmt.Token, fmt.Sprintf("'return' can only return one value, but got %d", len(returnStmt.Args)))
+	}
+	scriptStmt.ReturnVar = returnVar
+	statements := []ast.Statement{}
+	if returnStmt.Args[0] != returnVar {
+		statements = append(statements, p.newVarAssignment(returnVar, returnStmt.Args[0], returnStmt.Token, scriptStmt))
+	}
+	return append(statements, &ast.CommandStatement{
+		Token: returnStmt.Token,
+		Name:  returnStmt.Name,
+		Args:  []string{},
+	}), nil
+}
+
+type argMove struct {
+	dest  string
+	value string
+}
+
+// Lowers a call to a script with parameters into commands that store the
+// arguments in the callee's arg vars, followed by a regular "call".
+func (p *Parser) lowerScriptCall(callStmt *ast.CommandStatement, callee *ast.ScriptStatement, caller *ast.ScriptStatement) ([]ast.Statement, error) {
+	if len(callStmt.Args) != len(callee.Params) {
+		return nil, NewParseError(callStmt.Token, fmt.Sprintf("script '%s' expects %d arguments, but got %d", callee.Name.Value, len(callee.Params), len(callStmt.Args)))
+	}
+
+	// The caller's own parameters live in arg vars, too, so they need to be
+	// read before they're overwritten by the new arguments. Parameters that
+	// were copied into locals are safe.
+	scope := p.localScope(caller)
+	callerParams := map[string]string{}
+	for _, param := range scope.Params {
+		callerParams[param.Name.Value] = param.Value
+	}
+	for _, local := range scope.Locals {
+		delete(callerParams, local.Name.Value)
+	}
+	readsVar := func(value string, varName string) bool {
+		for _, word := range identifierRegex.FindAllString(value, -1) {
+			if word == varName || callerParams[word] == varName {
+				return true
+			}
+		}
+		return false
+	}
+
+	pending := []argMove{}
+	for i, arg := range callStmt.Args {
+		dest := callee.Params[i].Value
+		if arg == dest || callerParams[arg] == dest {
+			continue
+		}
+		pending = append(pending, argMove{dest: dest, value: arg})
+	}
+	statements := []ast.Statement{}
+	for len(pending) > 0 {
+		next := -1
+		for i, move := range pending {
+			clobbers := false
+			for j, other := range pending {
+				if i != j && readsVar(other.value, move.dest) {
+					clobbers = true
+					break
+				}
+			}
+			if !clobbers {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			// Every remaining argument overwrites a var that another one reads,
+			// such as when two parameters are swapped. Save the first one's
+			// arg var in a temporary, and read it from there instead.
+			if len(p.commandConfig.TempVars) == 0 {
+				return nil, NewParseError(callStmt.Token, fmt.Sprintf("cannot pass the arguments to script '%s' without overwriting one of them, because no temp vars are configured. Add a \"temp_vars\" list to the command config", callee.Name.Value))
+			}
+			dest := pending[0].dest
+			temp := addArgTemp(scope, callStmt.Token)
+			statements = append(statements, p.newVarAssignment(temp, dest, callStmt.Token, caller))
+			for i := range pending {
+				pending[i].value = replaceIdentifiers(pending[i].value, func(word string) string {
+					if word == dest || callerParams[word] == dest {
+						return temp
+					}
+					return word
+				})
+			}
+			continue
+		}
+		statements = append(statements, p.newVarAssignment(pending[next].dest, pending[next].value, callStmt.Token, caller))
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+
+	return append(statements, &ast.CommandStatement{
+		Token: callStmt.Token,
+		Name: &ast.Identifier{
+			Token: callStmt.Name.Token,
+			Value: "call",
+		},
+		Args: []string{callee.Name.Value},
+	}), nil
+}
+
+// Declares a var local in the scope, which holds an argument while the arg vars
+// are overwritten. Returns the local's name, which can't clash with the names of
+// the scope's other locals and parameters.
+func addArgTemp(scope *ast.ScriptStatement, tok token.Token) string {
+	names := map[string]bool{}
+	for _, local := range append(scope.Params, scope.Locals...) {
+		names[local.Name.Value] = true
+	}
+	name := ""
+	for i := 0; name == "" || names[name]; i++ {
+		name = fmt.Sprintf("__arg_temp_%d", i)
+	}
+	scope.Locals = append(scope.Locals, &ast.LocalDeclaration{
+		Token: tok,
+		Name: &ast.Identifier{
+			Token: tok,
+			Value: name,
+		},
+		Type: token.VAR,
+	})
+	return name
+}
+
+// Creates a command that stores the value in the given var. Vars are copied
+// with "copyvar", and everything else is set with "setvar".
+func (p *Parser) newVarAssignment(dest string, value string, tok token.Token, scriptStmt *ast.ScriptStatement) *ast.CommandStatement {
+	command := "setvar"
+	if p.isVarValue(value, scriptStmt) {
+		command = "copyvar"
+	}
+	return &ast.CommandStatement{
+		Token: tok,
+		Name: &ast.Identifier{
+			Token: tok,
+			Value: command,
+		},
+		Args: []string{dest, value},
+	}
+}
+
+// Reports whether the value names a var, rather than a plain value. Only a
+// bare identifier can name a var, so expressions such as "VAR_1 + 1" are plain
+// values. Constants read from C headers are checked using their values.
+func (p *Parser) isVarValue(value string, scriptStmt *ast.ScriptStatement) bool {
+	if identifierRegex.FindString(value) != value {
+		return false
+	}
+	scriptStmt = p.localScope(scriptStmt)
+	for _, local := range scriptStmt.Params {
+		if local.Name.Value == value {
+			return true
+		}
+	}
+	for _, local := range scriptStmt.Locals {
+		if local.Name.Value == value {
+			return local.Type == token.VAR
+		}
+	}
+	if value == p.commandConfig.ScriptReturnVar {
+		return true
+	}
+	for _, argVar := range p.commandConfig.ScriptArgVars {
+		if value == argVar {
+			return true
+		}
+	}
+	for _, tempVar := range p.commandConfig.TempVars {
+		if value == tempVar {
+			return true
+		}
+	}
+	if constant, ok := p.lookupHeaderConstant(value); ok && constant.Evaluated {
+		return isVarID(constant.Value)
+	}
+	if p.isSymbolKind("var") {
+		return p.symbolKind(value) == "var"
+	}
+	return strings.HasPrefix(value, "VAR_")
+}
+
+// Reports whether the number is the id of a var or a special var. Smaller
+// numbers are read as plain values by the script engine.
+func isVarID(n int64) bool {
+	return (n >= 0x4000 && n <= 0x40FF) || (n >= 0x8000 && n <= 0x8015)
+}
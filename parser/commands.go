@@ -0,0 +1,267 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/token"
+)
+
+// CommandSignature describes the parameters of a command, so that commands with
+// the wrong arguments are reported at their line in the script, rather than
+// when the ROM is built. For example:
+//
+//	"msgbox": {
+//	    "params": [
+//	        {"name": "text", "kind": "text"},
+//	        {"name": "type", "kind": "int", "optional": true}
+//	    ]
+//	}
+type CommandSignature struct {
+	Params []CommandParam `json:"params"`
+	// Deprecated commands are reported with a warning.
+	Deprecated bool `json:"deprecated"`
+	// Command that should be used instead of a deprecated command.
+	Replacement string `json:"replacement"`
+}
+
+// CommandParam describes a parameter of a command. Optional parameters must
+// come after the required ones.
+type CommandParam struct {
+	Name string `json:"name"`
+	// One of "var", "flag", "label", "text", "movement", or "int", or a kind
+	// of symbol from "symbol_prefixes", such as "item". Any argument is
+	// accepted when it's empty.
+	Kind     string `json:"kind"`
+	Optional bool   `json:"optional"`
+}
+
+type commandArgType int
+
+const (
+	argExpression commandArgType = iota
+	argNumber
+	argIdentifier
+	argString
+	argMoves
+	argBlock
+)
+
+// commandArg describes an argument of a command, as it was written in the script.
+type commandArg struct {
+	token   token.Token
+	tokens  []token.Token
+	typ     commandArgType
+	literal string
+	// Set when the argument is a local or parameter of the script.
+	local *ast.LocalDeclaration
+}
+
+func (a commandArg) String() string {
+	switch a.typ {
+	case argString:
+		return "a string"
+	case argMoves:
+		return "moves()"
+	case argBlock:
+		return "a block"
+	}
+	if a.local != nil {
+		return fmt.Sprintf("local %s '%s'", strings.ToLower(string(a.local.Type)), a.literal)
+	}
+	return fmt.Sprintf("'%s'", a.literal)
+}
+
+// commandUse is a command in the script, whose arguments are checked against
+// the command's signature after the whole file is parsed.
+type commandUse struct {
+	command *ast.CommandStatement
+	args    []commandArg
+}
+
+// Builds the description of a command argument from its tokens.
+func (p *Parser) newCommandArg(tokens []token.Token, typ commandArgType) commandArg {
+	arg := commandArg{typ: typ}
+	if len(tokens) == 0 {
+		return arg
+	}
+	arg.token = tokens[0]
+	arg.tokens = tokens
+	literals := make([]string, len(tokens))
+	for i, t := range tokens {
+		literals[i] = t.Literal
+	}
+	arg.literal = strings.Join(literals, " ")
+	if typ != argExpression || len(tokens) != 1 {
+		return arg
+	}
+	switch tokens[0].Type {
+	case token.INT:
+		arg.typ = argNumber
+	case token.IDENT:
+		arg.typ = argIdentifier
+		arg.local = p.lookupScriptLocal(tokens[0].Literal)
+	}
+	return arg
+}
+
+// SetStrictCommands sets whether commands that don't have a signature, and
+// aren't in the known commands of the command config, are errors.
+func (p *Parser) SetStrictCommands(strict bool) {
+	p.strictCommands = strict
+}
+
+// Checks the commands in the script against the command signatures in the
+// command config. Calls to scripts in the same file aren't checked.
+func (p *Parser) validateCommands(program *ast.Program) error {
+	if len(p.commandConfig.Commands) == 0 && !p.strictCommands {
+		return nil
+	}
+	scriptNames := map[string]bool{}
+	for _, stmt := range program.TopLevelStatements {
+		switch stmt := stmt.(type) {
+		case *ast.ScriptStatement:
+			scriptNames[stmt.Name.Value] = true
+		case *ast.MapScriptsStatement:
+			for _, child := range stmt.AllChildren() {
+				if scriptStmt, ok := child.(*ast.ScriptStatement); ok {
+					scriptNames[scriptStmt.Name.Value] = true
+				}
+			}
+		}
+	}
+	knownNames := map[string]bool{}
+	for _, name := range p.commandConfig.KnownCommands {
+		knownNames[name] = true
+	}
+	var knownCommands *symbolSet
+	for _, use := range p.commandUses {
+		name := use.command.Token.Literal
+		if scriptNames[name] || (name == "return" && len(use.args) > 0) {
+			continue
+		}
+		if _, ok := p.commandConfig.ConditionCommands[name]; ok {
+			continue
+		}
+		signature, ok := p.commandConfig.Commands[name]
+		if !ok {
+			if !p.strictCommands || knownNames[name] {
+				continue
+			}
+			if knownCommands == nil {
+				knownCommands = newSymbolSet()
+				for commandName := range p.commandConfig.Commands {
+					knownCommands.add(commandName)
+				}
+				for commandName := range knownNames {
+					knownCommands.add(commandName)
+				}
+				sort.Strings(knownCommands.sorted)
+			}
+			message := fmt.Sprintf("unknown command '%s'", name)
+			if suggestion := knownCommands.suggest(name); suggestion != "" {
+				message += fmt.Sprintf(". Did you mean '%s'?", suggestion)
+			}
+			return NewParseError(use.command.Token, message)
+		}
+		if signature.Deprecated {
+			message := fmt.Sprintf("command '%s' is deprecated", name)
+			if signature.Replacement != "" {
+				message += fmt.Sprintf(". Use '%s' instead", signature.Replacement)
+			}
+			p.warnings = append(p.warnings, ast.Warning{
+				Type:            ast.WarningDeprecatedCommand,
+				LineNumberStart: use.command.Token.LineNumber,
+				LineNumberEnd:   use.command.Token.EndLineNumber,
+				CharStart:       use.command.Token.StartCharIndex,
+				Utf8CharStart:   use.command.Token.StartUtf8CharIndex,
+				CharEnd:         use.command.Token.EndCharIndex,
+				Utf8CharEnd:     use.command.Token.EndUtf8CharIndex,
+				Message:         message,
+			})
+		}
+		if err := p.validateCommandArgs(use, signature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Parser) validateCommandArgs(use commandUse, signature CommandSignature) error {
+	name := use.command.Token.Literal
+	required := 0
+	for _, param := range signature.Params {
+		if !param.Optional {
+			required++
+		}
+	}
+	if len(use.args) < required || len(use.args) > len(signature.Params) {
+		expected := pluralizeArguments(required)
+		if required != len(signature.Params) {
+			expected = fmt.Sprintf("%d to %s", required, pluralizeArguments(len(signature.Params)))
+		}
+		return NewParseError(use.command.Token, fmt.Sprintf("command '%s' expects %s, but got %d", name, expected, len(use.args)))
+	}
+	for i, arg := range use.args {
+		param := signature.Params[i]
+		expected, ok := commandParamKinds[param.Kind]
+		if !ok && p.isSymbolKind(param.Kind) {
+			// Kinds of symbols from "symbol_prefixes", such as "item", are
+			// checked like integers.
+			expected, ok = commandParamKinds["int"]
+			expected.description = withArticle(param.Kind)
+		}
+		if !ok {
+			return NewParseError(use.command.Token, fmt.Sprintf("unknown kind '%s' for parameter '%s' of command '%s' in the command config", param.Kind, param.Name, name))
+		}
+		if !expected.accepts(arg) {
+			return NewParseError(arg.token, fmt.Sprintf("command '%s' expects %s for parameter '%s', but got %s", name, expected.description, param.Name, arg))
+		}
+		for _, tok := range arg.tokens {
+			p.checkSymbolKind(tok, param.Kind, fmt.Sprintf("parameter '%s' of command '%s'", param.Name, name))
+		}
+	}
+	return nil
+}
+
+func pluralizeArguments(count int) string {
+	if count == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", count)
+}
+
+// commandParamKind describes the arguments that a kind of parameter accepts.
+type commandParamKind struct {
+	description string
+	types       []commandArgType
+	// The type of locals that can be passed, if any.
+	localType token.Type
+}
+
+func (k commandParamKind) accepts(arg commandArg) bool {
+	if k.types == nil {
+		return true
+	}
+	if arg.local != nil && arg.local.Type != k.localType {
+		return false
+	}
+	for _, typ := range k.types {
+		if arg.typ == typ {
+			return true
+		}
+	}
+	return false
+}
+
+var commandParamKinds = map[string]commandParamKind{
+	"":         {},
+	"var":      {description: "a var", types: []commandArgType{argIdentifier, argNumber, argExpression}, localType: token.VAR},
+	"flag":     {description: "a flag", types: []commandArgType{argIdentifier, argNumber, argExpression}, localType: token.FLAG},
+	"int":      {description: "an integer", types: []commandArgType{argIdentifier, argNumber, argExpression}, localType: token.VAR},
+	"label":    {description: "a label", types: []commandArgType{argIdentifier, argBlock}},
+	"text":     {description: "text", types: []commandArgType{argIdentifier, argString}},
+	"movement": {description: "movement", types: []commandArgType{argIdentifier, argMoves}},
+}
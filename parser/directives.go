@@ -0,0 +1,327 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huderlem/poryscript/lexer"
+	"github.com/huderlem/poryscript/token"
+)
+
+// conditionalFrame tracks an '#if' directive whose '#endif' hasn't been reached yet.
+type conditionalFrame struct {
+	token token.Token
+	// Whether the code surrounding the '#if' directive is included.
+	parentActive bool
+	// Whether the code in the current branch is included.
+	active bool
+	// Whether one of the branches was already included.
+	taken   bool
+	sawElse bool
+}
+
+// Reads the next token from the lexer, while handling compile-time directives.
+// Tokens inside excluded '#if' branches are skipped, so the rest of the parser
+// never sees them.
+func (p *Parser) readToken() token.Token {
+	for {
+		if p.directiveErr != nil {
+			return token.Token{Type: token.EOF}
+		}
+		tok := p.l.NextToken()
+		startsLine := tok.LineNumber > p.lastLineNumber
+		p.lastLineNumber = tok.EndLineNumber
+		switch tok.Type {
+		case token.DIRECTIVE:
+			if err := p.handleDirective(tok); err != nil {
+				p.directiveErr = err
+			}
+		case token.EOF:
+			if n := len(p.conditionals); n > 0 {
+				p.directiveErr = NewParseError(p.conditionals[n-1].token, "missing '#endif' for '#if' directive")
+			}
+			return tok
+		default:
+			if !p.conditionalActive() {
+				continue
+			}
+			// Like directives, 'switch_default' declarations start their own
+			// line at the top level. Elsewhere, it's a regular identifier.
+			if tok.Type == token.IDENT && tok.Literal == "switch_default" && startsLine && p.braceDepth == 0 {
+				if err := p.readSwitchDefault(tok); err != nil {
+					p.directiveErr = err
+				}
+				continue
+			}
+			if tok.Type == token.LBRACE {
+				p.braceDepth++
+			} else if tok.Type == token.RBRACE && p.braceDepth > 0 {
+				p.braceDepth--
+			}
+			return tok
+		}
+	}
+}
+
+// Reads a compile switch's default value, such as "switch_default VERSION = EMERALD".
+// Defaults are applied as soon as they are read, so that the directives that
+// follow can use them, too. Switches specified with the '-s' option take priority.
+func (p *Parser) readSwitchDefault(switchDefaultToken token.Token) error {
+	nameToken := p.l.NextToken()
+	if !isDirectiveOperand(nameToken) {
+		return NewParseError(switchDefaultToken, fmt.Sprintf("expected compile switch name after 'switch_default', but got '%s' instead", nameToken.Literal))
+	}
+	if assignToken := p.l.NextToken(); assignToken.Type != token.ASSIGN {
+		return NewParseError(nameToken, fmt.Sprintf("missing '=' after switch_default '%s'. Got '%s' instead", nameToken.Literal, assignToken.Literal))
+	}
+	valueToken := p.l.NextToken()
+	if !isDirectiveOperand(valueToken) {
+		return NewRangeParseError(switchDefaultToken, nameToken, fmt.Sprintf("expected default value for compile switch '%s', but got '%s' instead", nameToken.Literal, valueToken.Literal))
+	}
+	if _, ok := p.switchDefaults[nameToken.Literal]; ok {
+		return NewParseError(nameToken, fmt.Sprintf("duplicate switch_default for compile switch '%s'", nameToken.Literal))
+	}
+	p.switchDefaults[nameToken.Literal] = valueToken.Literal
+	return nil
+}
+
+// Looks up a compile switch's value. Values specified with the '-s' option take
+// priority over the defaults declared with 'switch_default'.
+func (p *Parser) getCompileSwitch(name string) (string, bool) {
+	if value, ok := p.compileSwitches[name]; ok {
+		return value, true
+	}
+	value, ok := p.switchDefaults[name]
+	return value, ok
+}
+
+func (p *Parser) hasCompileSwitches() bool {
+	return len(p.compileSwitches) > 0 || len(p.switchDefaults) > 0
+}
+
+// SwitchReference is a place where a compile switch is used, such as a poryswitch
+// case or an '#if' comparison.
+type SwitchReference struct {
+	Switch string
+	// The value that the switch is compared to. It's empty when the switch
+	// is used without a value, such as in a poryswitch statement's header.
+	Value string
+	Token token.Token
+}
+
+func (p *Parser) addSwitchReference(switchName, value string, tok token.Token) {
+	p.switchReferences = append(p.switchReferences, SwitchReference{
+		Switch: switchName,
+		Value:  value,
+		Token:  tok,
+	})
+}
+
+// SwitchReferences returns the places where compile switches were used in the
+// parsed program. Code that was excluded by the compile switches isn't parsed,
+// so its references aren't included.
+func (p *Parser) SwitchReferences() []SwitchReference {
+	return p.switchReferences
+}
+
+func (p *Parser) conditionalActive() bool {
+	n := len(p.conditionals)
+	return n == 0 || p.conditionals[n-1].active
+}
+
+// Handles a compile-time directive, such as:
+//
+//	#if VERSION == EMERALD && LANGUAGE != JAPANESE
+//	#elif VERSION == RUBY || VERSION == SAPPHIRE
+//	#else
+//	#endif
+func (p *Parser) handleDirective(tok token.Token) error {
+	name := strings.TrimPrefix(tok.Literal, "#")
+	condition := ""
+	if i := strings.IndexAny(name, " \t"); i != -1 {
+		name, condition = name[:i], strings.TrimSpace(name[i:])
+	}
+
+	if name == "if" {
+		frame := conditionalFrame{token: tok, parentActive: p.conditionalActive()}
+		if frame.parentActive {
+			result, err := p.evaluateDirectiveCondition(tok, name, condition)
+			if err != nil {
+				return err
+			}
+			frame.active = result
+			frame.taken = result
+		}
+		p.conditionals = append(p.conditionals, frame)
+		return nil
+	}
+
+	n := len(p.conditionals)
+	if n == 0 {
+		return NewParseError(tok, fmt.Sprintf("'#%s' directive without a matching '#if'", name))
+	}
+	frame := &p.conditionals[n-1]
+	switch name {
+	case "elif":
+		if frame.sawElse {
+			return NewParseError(tok, "'#elif' directive can't come after '#else'")
+		}
+		frame.active = false
+		if frame.parentActive && !frame.taken {
+			result, err := p.evaluateDirectiveCondition(tok, name, condition)
+			if err != nil {
+				return err
+			}
+			frame.active = result
+			frame.taken = result
+		}
+	case "else":
+		if condition != "" {
+			return NewParseError(tok, fmt.Sprintf("unexpected '%s' after '#else' directive", condition))
+		}
+		if frame.sawElse {
+			return NewParseError(tok, "duplicate '#else' directive for '#if'")
+		}
+		frame.sawElse = true
+		frame.active = frame.parentActive && !frame.taken
+		frame.taken = true
+	case "endif":
+		if condition != "" {
+			return NewParseError(tok, fmt.Sprintf("unexpected '%s' after '#endif' directive", condition))
+		}
+		p.conditionals = p.conditionals[:n-1]
+	}
+	return nil
+}
+
+// directiveCondition evaluates the boolean expression of an '#if' or '#elif'
+// directive against the compile-time switches.
+type directiveCondition struct {
+	p         *Parser
+	directive token.Token
+	name      string
+	tokens    []token.Token
+	pos       int
+}
+
+func (p *Parser) evaluateDirectiveCondition(directive token.Token, name, condition string) (bool, error) {
+	c := &directiveCondition{
+		p:         p,
+		directive: directive,
+		name:      name,
+	}
+	l := lexer.New(condition)
+	for {
+		tok := l.NextToken()
+		c.tokens = append(c.tokens, tok)
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+	if len(c.tokens) == 1 {
+		return false, NewParseError(directive, fmt.Sprintf("missing condition for '#%s' directive", name))
+	}
+	result, err := c.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if tok := c.cur(); tok.Type != token.EOF {
+		return false, NewParseError(directive, fmt.Sprintf("unexpected '%s' in '#%s' condition", tok.Literal, name))
+	}
+	return result, nil
+}
+
+func (c *directiveCondition) cur() token.Token {
+	return c.tokens[c.pos]
+}
+
+func (c *directiveCondition) next() {
+	if c.pos < len(c.tokens)-1 {
+		c.pos++
+	}
+}
+
+func (c *directiveCondition) parseOr() (bool, error) {
+	result, err := c.parseAnd()
+	if err != nil {
+		return false, err
+	}
+	for c.cur().Type == token.OR {
+		c.next()
+		right, err := c.parseAnd()
+		if err != nil {
+			return false, err
+		}
+		result = result || right
+	}
+	return result, nil
+}
+
+func (c *directiveCondition) parseAnd() (bool, error) {
+	result, err := c.parseUnary()
+	if err != nil {
+		return false, err
+	}
+	for c.cur().Type == token.AND {
+		c.next()
+		right, err := c.parseUnary()
+		if err != nil {
+			return false, err
+		}
+		result = result && right
+	}
+	return result, nil
+}
+
+func (c *directiveCondition) parseUnary() (bool, error) {
+	tok := c.cur()
+	switch tok.Type {
+	case token.NOT:
+		c.next()
+		result, err := c.parseUnary()
+		return !result, err
+	case token.LPAREN:
+		c.next()
+		result, err := c.parseOr()
+		if err != nil {
+			return false, err
+		}
+		if c.cur().Type != token.RPAREN {
+			return false, NewParseError(c.directive, fmt.Sprintf("missing ')' in '#%s' condition", c.name))
+		}
+		c.next()
+		return result, nil
+	}
+	if !isDirectiveOperand(tok) {
+		return false, NewParseError(c.directive, fmt.Sprintf("expected compile switch in '#%s' condition, but got '%s' instead", c.name, tok.Literal))
+	}
+	c.next()
+	operator := c.cur()
+	if operator.Type != token.EQ && operator.Type != token.NEQ {
+		// A lone compile switch is true when it was specified.
+		c.p.addSwitchReference(tok.Literal, "", c.directive)
+		_, ok := c.p.getCompileSwitch(tok.Literal)
+		return ok, nil
+	}
+	c.next()
+	valueToken := c.cur()
+	if !isDirectiveOperand(valueToken) {
+		return false, NewParseError(c.directive, fmt.Sprintf("expected compile switch value after '%s' in '#%s' condition, but got '%s' instead", operator.Literal, c.name, valueToken.Literal))
+	}
+	c.next()
+	c.p.addSwitchReference(tok.Literal, valueToken.Literal, c.directive)
+	value, ok := c.p.getCompileSwitch(tok.Literal)
+	if !ok && c.p.enableEnvironmentErrors {
+		return false, NewParseError(c.directive, fmt.Sprintf("no compile switch for '%s' was specified with the '-s' option", tok.Literal))
+	}
+	if operator.Type == token.EQ {
+		return value == valueToken.Literal, nil
+	}
+	return value != valueToken.Literal, nil
+}
+
+// Compile switch names and values are identifiers or numbers. Keywords, such as
+// 'TRUE', are allowed, too.
+func isDirectiveOperand(tok token.Token) bool {
+	return tok.Type == token.IDENT || tok.Type == token.INT || (tok.Literal != "" && token.GetIdentType(tok.Literal) == tok.Type)
+}
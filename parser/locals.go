@@ -0,0 +1,353 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/lexer"
+	"github.com/huderlem/poryscript/token"
+)
+
+var identifierRegex = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// Describes a pool of temporaries that locals of a given type are allocated from.
+type tempPool struct {
+	temps      []string
+	name       string
+	configName string
+}
+
+func (p *Parser) getTempPools() map[token.Type]tempPool {
+	return map[token.Type]tempPool{
+		token.VAR:  {temps: p.commandConfig.TempVars, name: "temp vars", configName: "temp_vars"},
+		token.FLAG: {temps: p.commandConfig.TempFlags, name: "temp flags", configName: "temp_flags"},
+	}
+}
+
+// Reports whether the current token starts a local declaration. "let" is only a
+// keyword at the start of a statement, when it's followed by the local's name,
+// so it can still be used as the name of a label, text, or command.
+func (p *Parser) isLocalDeclaration() bool {
+	return p.curToken.Literal == "let" && p.peekTokenIs(token.IDENT)
+}
+
+// Parses a script-local temporary declaration, such as "let counter: var" or
+// "let talkedTwice: flag".
+func (p *Parser) parseLocalDeclaration() error {
+	letToken := p.curToken
+	if p.scriptLocals == nil {
+		return NewParseError(letToken, "'let' declarations are only allowed inside of scripts")
+	}
+	if err := p.expectPeek(token.IDENT); err != nil {
+		return NewRangeParseError(letToken, p.peekToken, "missing name for 'let' declaration")
+	}
+	name := p.curToken.Literal
+	local := &ast.LocalDeclaration{
+		Token: letToken,
+		Name: &ast.Identifier{
+			Token: p.curToken,
+			Value: name,
+		},
+	}
+	if _, ok := p.constants[name]; ok {
+		return NewParseError(p.curToken, fmt.Sprintf("local '%s' has the same name as a const. Choose a different name for the local", name))
+	}
+	for _, other := range append(p.scriptParams, p.scriptLocals...) {
+		if other.Name.Value == name {
+			return NewParseError(p.curToken, fmt.Sprintf("duplicate local '%s'. Must use unique local and parameter names within a script", name))
+		}
+	}
+	if err := p.expectPeek(token.COLON); err != nil {
+		return NewRangeParseError(letToken, p.peekToken, fmt.Sprintf("missing ':' after local name '%s'", name))
+	}
+	if !p.peekTokenIs(token.VAR) && !p.peekTokenIs(token.FLAG) {
+		return NewParseError(p.peekToken, fmt.Sprintf("invalid type '%s' for local '%s'. Expected 'var' or 'flag'", p.peekToken.Literal, name))
+	}
+	p.nextToken()
+	local.Type = p.curToken.Type
+	p.scriptLocals = append(p.scriptLocals, local)
+	return nil
+}
+
+// Allocates every script's locals to temporaries from the configured pools, and
+// substitutes the allocated temporaries into the scripts. A script's locals
+// must stay intact while the scripts it calls run, and they must not clobber
+// the locals of the scripts that call it. So, a local is never allocated to a
+// temporary that is used by a script in the same call chain, whether that use
+// is another local or a direct reference to the temporary.
+func (p *Parser) allocateLocals(program *ast.Program) error {
+	scripts := []*ast.ScriptStatement{}
+	scriptsByName := map[string]*ast.ScriptStatement{}
+	hasLocals := false
+	addScript := func(scriptStmt *ast.ScriptStatement) {
+		scripts = append(scripts, scriptStmt)
+		scriptsByName[scriptStmt.Name.Value] = scriptStmt
+		hasLocals = hasLocals || len(scriptStmt.Locals) > 0 || len(scriptStmt.Params) > 0
+	}
+	for _, stmt := range program.TopLevelStatements {
+		switch stmt := stmt.(type) {
+		case *ast.ScriptStatement:
+			addScript(stmt)
+		case *ast.MapScriptsStatement:
+			for _, child := range stmt.AllChildren() {
+				if scriptStmt, ok := child.(*ast.ScriptStatement); ok {
+					addScript(scriptStmt)
+				}
+			}
+		}
+	}
+	if !hasLocals {
+		return nil
+	}
+
+	pools := p.getTempPools()
+	pool := map[string]bool{}
+	for _, tempPool := range pools {
+		for _, temp := range tempPool.temps {
+			pool[temp] = true
+		}
+	}
+
+	// Collect the temporaries that each script references directly, along with
+	// the scripts it calls.
+	usedTemps := map[string]map[string]bool{}
+	callees := map[string][]string{}
+	callers := map[string][]string{}
+	for _, scriptStmt := range scripts {
+		name := scriptStmt.Name.Value
+		usedTemps[name] = map[string]bool{}
+		visitLocalOperands(scriptStmt, func(value string, operator token.Type, tok token.Token) (string, error) {
+			for _, word := range identifierRegex.FindAllString(value, -1) {
+				if pool[word] {
+					usedTemps[name][word] = true
+				}
+			}
+			return value, nil
+		})
+		for _, callee := range getCallees(scriptStmt) {
+			if _, ok := scriptsByName[callee]; ok && callee != name {
+				callees[name] = append(callees[name], callee)
+				callers[callee] = append(callers[callee], name)
+			}
+		}
+	}
+
+	for _, scriptStmt := range scripts {
+		if len(scriptStmt.Locals) == 0 {
+			continue
+		}
+		name := scriptStmt.Name.Value
+		unavailable := map[string]bool{}
+		for temp := range usedTemps[name] {
+			unavailable[temp] = true
+		}
+		for _, related := range append(reachableScripts(name, callees), reachableScripts(name, callers)...) {
+			for temp := range usedTemps[related] {
+				unavailable[temp] = true
+			}
+		}
+		for _, local := range scriptStmt.Locals {
+			tempPool := pools[local.Type]
+			if len(tempPool.temps) == 0 {
+				return NewParseError(local.Name.Token, fmt.Sprintf("cannot allocate local '%s' because no %s are configured. Add a \"%s\" list to the command config", local.Name.Value, tempPool.name, tempPool.configName))
+			}
+			for _, temp := range tempPool.temps {
+				if !unavailable[temp] {
+					local.Value = temp
+					break
+				}
+			}
+			if local.Value == "" {
+				return NewParseError(local.Name.Token, fmt.Sprintf("cannot allocate local '%s' because all %d %s are already used by script '%s' or the scripts in its call chain", local.Name.Value, len(tempPool.temps), tempPool.name, name))
+			}
+			unavailable[local.Value] = true
+			usedTemps[name][local.Value] = true
+		}
+	}
+
+	for _, scriptStmt := range scripts {
+		if err := substituteLocals(scriptStmt, p.localScope(scriptStmt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the script whose locals and parameters are visible in the given
+// script. Scripts hoisted from block literals see the locals of the script
+// they were written in.
+func (p *Parser) localScope(scriptStmt *ast.ScriptStatement) *ast.ScriptStatement {
+	if parent, ok := p.scriptParents[scriptStmt]; ok {
+		return parent
+	}
+	return scriptStmt
+}
+
+// Replaces references to the scope's locals and parameters in a script with
+// their allocated temporaries and arg vars.
+func substituteLocals(scriptStmt *ast.ScriptStatement, scope *ast.ScriptStatement) error {
+	if len(scope.Locals) == 0 && len(scope.Params) == 0 {
+		return nil
+	}
+	locals := map[string]*ast.LocalDeclaration{}
+	for _, local := range append(scope.Params, scope.Locals...) {
+		locals[local.Name.Value] = local
+	}
+	return visitLocalOperands(scriptStmt, func(value string, operator token.Type, tok token.Token) (string, error) {
+		var err error
+		result := replaceIdentifiers(value, func(word string) string {
+			local, ok := locals[word]
+			if !ok {
+				return word
+			}
+			if operator != "" && operator != local.Type && err == nil {
+				localType := strings.ToLower(string(local.Type))
+				err = NewParseError(tok, fmt.Sprintf("local '%s' is a %s, so it can't be used in %s()", word, localType, strings.ToLower(string(operator))))
+			}
+			return local.Value
+		})
+		return result, err
+	})
+}
+
+// Replaces the identifier tokens in a value with the results of f. Text inside
+// of strings and other tokens is left alone.
+func replaceIdentifiers(value string, f func(word string) string) string {
+	var sb strings.Builder
+	start := 0
+	l := lexer.New(value)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		if tok.Type != token.IDENT {
+			continue
+		}
+		sb.WriteString(value[start:tok.StartCharIndex])
+		sb.WriteString(f(tok.Literal))
+		start = tok.EndCharIndex
+	}
+	sb.WriteString(value[start:])
+	return sb.String()
+}
+
+// Calls f for every value in the script that can refer to a local, and replaces
+// the value with f's result. operator is the condition operator that the value is
+// used in, or empty for command arguments.
+func visitLocalOperands(scriptStmt *ast.ScriptStatement, f func(value string, operator token.Type, tok token.Token) (string, error)) error {
+	return visitStatementOperands(scriptStmt.Body.AllChildren(), f)
+}
+
+// Calls f for every value in the statements that can refer to a local. Nested
+// statements aren't visited, unless they're in the list, too.
+func visitStatementOperands(stmts []ast.Statement, f func(value string, operator token.Type, tok token.Token) (string, error)) error {
+	visitCommand := func(commandStmt *ast.CommandStatement) error {
+		for i, arg := range commandStmt.Args {
+			value, err := f(arg, "", commandStmt.Token)
+			if err != nil {
+				return err
+			}
+			commandStmt.Args[i] = value
+		}
+		return nil
+	}
+	var visitExpression func(expression ast.BooleanExpression) error
+	visitExpression = func(expression ast.BooleanExpression) error {
+		switch expression := expression.(type) {
+		case *ast.BinaryExpression:
+			if err := visitExpression(expression.Left); err != nil {
+				return err
+			}
+			return visitExpression(expression.Right)
+		case *ast.OperatorExpression:
+			if expression.PreambleStatement != nil {
+				if err := visitCommand(expression.PreambleStatement); err != nil {
+					return err
+				}
+			}
+			operand, err := f(expression.Operand.Literal, expression.Type, expression.Operand)
+			if err != nil {
+				return err
+			}
+			expression.Operand.Literal = operand
+			if expression.Type == token.VAR {
+				value, err := f(expression.ComparisonValue, token.VAR, expression.Operand)
+				if err != nil {
+					return err
+				}
+				expression.ComparisonValue = value
+			}
+		}
+		return nil
+	}
+	visitCondition := func(condition *ast.ConditionExpression) error {
+		if condition == nil || condition.Expression == nil {
+			return nil
+		}
+		return visitExpression(condition.Expression)
+	}
+
+	for _, stmt := range stmts {
+		var err error
+		switch stmt := stmt.(type) {
+		case *ast.CommandStatement:
+			err = visitCommand(stmt)
+		case *ast.IfStatement:
+			err = visitCondition(stmt.Consequence)
+			for _, elif := range stmt.ElifConsequences {
+				if err == nil {
+					err = visitCondition(elif)
+				}
+			}
+		case *ast.WhileStatement:
+			err = visitCondition(stmt.Consequence)
+		case *ast.DoWhileStatement:
+			err = visitCondition(stmt.Consequence)
+		case *ast.SwitchStatement:
+			var operand string
+			operand, err = f(stmt.Operand.Literal, token.VAR, stmt.Operand)
+			stmt.Operand.Literal = operand
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the names of the scripts that the script calls or jumps to.
+func getCallees(scriptStmt *ast.ScriptStatement) []string {
+	callees := []string{}
+	for _, stmt := range scriptStmt.Body.AllChildren() {
+		commandStmt, ok := stmt.(*ast.CommandStatement)
+		if !ok || len(commandStmt.Args) == 0 {
+			continue
+		}
+		switch name := commandStmt.Name.Value; {
+		case name == "call" || name == "goto":
+			callees = append(callees, commandStmt.Args[0])
+		case strings.HasPrefix(name, "call_if") || strings.HasPrefix(name, "goto_if"):
+			callees = append(callees, commandStmt.Args[len(commandStmt.Args)-1])
+		}
+	}
+	return callees
+}
+
+// Returns the scripts that are transitively reachable from the given script
+// by following the given edges.
+func reachableScripts(name string, edges map[string][]string) []string {
+	visited := map[string]bool{name: true}
+	result := []string{}
+	queue := []string{name}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, next := range edges[cur] {
+			if !visited[next] {
+				visited[next] = true
+				result = append(result, next)
+				queue = append(queue, next)
+			}
+		}
+	}
+	return result
+}
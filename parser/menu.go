@@ -0,0 +1,270 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/token"
+)
+
+type impMenuList struct {
+	command    *ast.CommandStatement
+	argPos     int
+	options    *ast.CommandStatement
+	token      token.Token
+	scriptName string
+}
+
+type menuOption struct {
+	token      token.Token
+	text       token.Token
+	stringType string
+	body       *ast.BlockStatement
+}
+
+func getImplicitMenuListLabel(scriptName string, i int) string {
+	return fmt.Sprintf("%s_MenuList_%d", scriptName, i)
+}
+
+// Reports whether the current token starts a menu statement. "menu" is only a
+// keyword at the start of a statement, when its position is followed by the
+// menu's options, so it can still be used as the name of a label, text, or
+// command.
+func (p *Parser) isMenuStatement() bool {
+	if p.curToken.Literal != "menu" || !p.peekTokenIs(token.LPAREN) {
+		return false
+	}
+	state := p.saveState()
+	numSwitchReferences := len(p.switchReferences)
+	defer func() {
+		p.restoreState(state)
+		p.switchReferences = p.switchReferences[:numSwitchReferences]
+	}()
+	p.nextToken()
+	for p.curToken.Type != token.RPAREN {
+		if p.curToken.Type == token.EOF {
+			return false
+		}
+		p.nextToken()
+	}
+	return p.peekTokenIs(token.LBRACE)
+}
+
+// Parses a menu statement, such as:
+//
+//	menu(1, 2) {
+//	    "Buy": { ... }
+//	    "Sell": { ... }
+//	    cancel: { ... }
+//	}
+//
+// It becomes the configured menu command, followed by a switch statement over
+// the menu's result.
+func (p *Parser) parseMenuStatement(scriptName string) ([]ast.Statement, *impData, error) {
+	menuToken := p.curToken
+	config := p.commandConfig.Menu
+	if config == nil {
+		return nil, nil, NewParseError(menuToken, "cannot use 'menu' statement, because no \"menu\" command is configured")
+	}
+	if err := p.expectPeek(token.LPAREN); err != nil {
+		return nil, nil, NewRangeParseError(menuToken, p.peekToken, "missing opening parenthesis for menu position")
+	}
+	p.nextToken()
+	position := []string{}
+	parts := []string{}
+	for p.curToken.Type != token.RPAREN {
+		if p.curToken.Type == token.EOF {
+			return nil, nil, NewParseError(menuToken, "missing closing parenthesis for menu position")
+		}
+		if p.curToken.Type == token.COMMA {
+			position = append(position, strings.Join(parts, " "))
+			parts = []string{}
+		} else {
+			parts = append(parts, p.tryReplaceWithConstant(p.curToken.Literal))
+		}
+		p.nextToken()
+	}
+	if len(parts) > 0 {
+		position = append(position, strings.Join(parts, " "))
+	}
+	if len(position) != 2 {
+		return nil, nil, NewRangeParseError(menuToken, p.curToken, fmt.Sprintf("menu position must have 2 values, x and y, but got %d", len(position)))
+	}
+	if err := p.expectPeek(token.LBRACE); err != nil {
+		return nil, nil, NewRangeParseError(menuToken, p.peekToken, "missing opening curly brace for menu statement")
+	}
+	braceToken := p.curToken
+	p.nextToken()
+
+	switchStmt := &ast.SwitchStatement{
+		Token:   menuToken,
+		Operand: newMenuToken(menuToken, token.IDENT, config.ResultVar),
+		Cases:   []*ast.SwitchCase{},
+	}
+	resultImpData := &impData{}
+	p.pushBreakStack(switchStmt)
+	options := []menuOption{}
+	var cancelBody *ast.BlockStatement
+	var cancelToken token.Token
+	for p.curToken.Type != token.RBRACE {
+		if p.curToken.Type == token.EOF {
+			return nil, nil, NewParseError(braceToken, "missing closing curly brace for menu statement")
+		}
+		option := menuOption{}
+		isCancel := false
+		if p.curToken.Type == token.IDENT && p.curToken.Literal == "cancel" {
+			if cancelBody != nil {
+				return nil, nil, NewParseError(p.curToken, "multiple 'cancel' options found in menu statement. Only one 'cancel' option is allowed")
+			}
+			isCancel = true
+			cancelToken = p.curToken
+		} else {
+			stringType := ""
+			if p.curToken.Type == token.STRINGTYPE {
+				stringType = p.curToken.Literal
+				p.nextToken()
+			}
+			if !token.IsStringLikeToken(p.curToken.Type) {
+				return nil, nil, NewParseError(p.curToken, fmt.Sprintf("invalid menu option '%s'. Expected a string or 'cancel'", p.curToken.Literal))
+			}
+			literal := p.applyTextReplacements(p.curToken.Literal)
+			option.text = p.curToken
+			option.text.Literal = p.formatTextTerminator(literal, stringType)
+			option.stringType = stringType
+		}
+		optionToken := p.curToken
+		option.token = optionToken
+		if err := p.expectPeek(token.COLON); err != nil {
+			return nil, nil, NewParseError(optionToken, "missing ':' after menu option")
+		}
+		if err := p.expectPeek(token.LBRACE); err != nil {
+			return nil, nil, NewRangeParseError(optionToken, p.peekToken, "missing opening curly brace for menu option body")
+		}
+		optionBraceToken := p.curToken
+		p.nextToken()
+		body, stmtImpData, err := p.parseBlockStatement(scriptName, optionBraceToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		resultImpData.add(stmtImpData)
+		p.nextToken()
+		if isCancel {
+			cancelBody = body
+		} else {
+			option.body = body
+			options = append(options, option)
+		}
+	}
+	p.popBreakStack()
+	if len(options) == 0 {
+		return nil, nil, NewRangeParseError(menuToken, p.curToken, "menu statement has no options")
+	}
+	if cancelBody != nil && config.CancelValue == "" {
+		return nil, nil, NewParseError(cancelToken, "cannot use 'cancel' option, because no \"cancel_value\" is configured for the \"menu\" command")
+	}
+
+	// The options' texts come before the texts in the options' bodies.
+	commandStmt, commandImpData := p.createMenuCommand(menuToken, position, options, scriptName)
+	commandImpData.add(resultImpData)
+	resultImpData = commandImpData
+
+	for i, option := range options {
+		if i == len(options)-1 && cancelBody == nil && config.CancelValue != "" {
+			// Without an explicit cancel option, pressing B selects the last option.
+			switchStmt.Cases = append(switchStmt.Cases, &ast.SwitchCase{
+				Value: newMenuToken(option.token, token.IDENT, config.CancelValue),
+				Body:  &ast.BlockStatement{Token: option.body.Token, Statements: []ast.Statement{}},
+			})
+		}
+		switchStmt.Cases = append(switchStmt.Cases, &ast.SwitchCase{
+			Value: newMenuToken(option.token, token.INT, strconv.Itoa(i)),
+			Body:  option.body,
+		})
+	}
+	if cancelBody != nil {
+		switchStmt.Cases = append(switchStmt.Cases, &ast.SwitchCase{
+			Value: newMenuToken(cancelToken, token.IDENT, config.CancelValue),
+			Body:  cancelBody,
+		})
+	}
+	return []ast.Statement{commandStmt, switchStmt}, resultImpData, nil
+}
+
+// Creates a token for generated code, which points at the source location of
+// the menu statement or option that it was generated from.
+func newMenuToken(sourceToken token.Token, tokenType token.Type, literal string) token.Token {
+	tok := sourceToken
+	tok.Type = tokenType
+	tok.Literal = literal
+	return tok
+}
+
+// Creates the configured menu command, by filling in the placeholders of its
+// argument template.
+func (p *Parser) createMenuCommand(menuToken token.Token, position []string, options []menuOption, scriptName string) (*ast.CommandStatement, *impData) {
+	config := p.commandConfig.Menu
+	commandStmt := &ast.CommandStatement{
+		Token: menuToken,
+		Name: &ast.Identifier{
+			Token: menuToken,
+			Value: config.Name,
+		},
+		Args: []string{},
+	}
+	resultImpData := &impData{}
+	addOptionTexts := func(command *ast.CommandStatement) {
+		for _, option := range options {
+			resultImpData.texts = append(resultImpData.texts, impText{
+				command:    command,
+				argPos:     len(command.Args),
+				text:       option.text,
+				stringType: option.stringType,
+				scriptName: scriptName,
+			})
+			command.Args = append(command.Args, "")
+		}
+	}
+	for _, arg := range config.Args {
+		switch arg {
+		case "{options}":
+			addOptionTexts(commandStmt)
+		case "{list}":
+			list := &ast.CommandStatement{Args: []string{}}
+			addOptionTexts(list)
+			resultImpData.menuLists = append(resultImpData.menuLists, impMenuList{
+				command:    commandStmt,
+				argPos:     len(commandStmt.Args),
+				options:    list,
+				token:      menuToken,
+				scriptName: scriptName,
+			})
+			commandStmt.Args = append(commandStmt.Args, "")
+		default:
+			arg = strings.ReplaceAll(arg, "{x}", position[0])
+			arg = strings.ReplaceAll(arg, "{y}", position[1])
+			arg = strings.ReplaceAll(arg, "{count}", strconv.Itoa(len(options)))
+			commandStmt.Args = append(commandStmt.Args, arg)
+		}
+	}
+	return commandStmt, resultImpData
+}
+
+// Adds the lists of option text labels for menus. This must happen after the
+// implicit texts are added, since the lists refer to the texts' labels.
+func (p *Parser) addImplicitMenuLists(lists []impMenuList) {
+	for _, list := range lists {
+		label := getImplicitMenuListLabel(list.scriptName, p.inlineMenuListCounts[list.scriptName])
+		list.command.Args[list.argPos] = label
+		p.inlineMenuListCounts[list.scriptName]++
+		lines := []string{fmt.Sprintf("%s:", label)}
+		for _, textLabel := range list.options.Args {
+			lines = append(lines, fmt.Sprintf("\t.4byte %s", textLabel))
+		}
+		p.inlineMenuLists = append(p.inlineMenuLists, &ast.RawStatement{
+			Token: list.token,
+			Value: strings.Join(lines, "\n"),
+		})
+	}
+}
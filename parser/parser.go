@@ -7,7 +7,9 @@ import (
 	"strings"
 
 	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/cheader"
 	"github.com/huderlem/poryscript/lexer"
+	"github.com/huderlem/poryscript/movement"
 	"github.com/huderlem/poryscript/token"
 )
 
@@ -19,6 +21,7 @@ var topLevelTokens = map[token.Type]bool{
 	token.MART:       true,
 	token.MAPSCRIPTS: true,
 	token.CONST:      true,
+	token.PORYSWITCH: true,
 }
 
 type impMovement struct {
@@ -36,9 +39,20 @@ type impText struct {
 	scriptName string
 }
 
+type impScript struct {
+	command    *ast.CommandStatement
+	argPos     int
+	body       *ast.BlockStatement
+	token      token.Token
+	scriptName string
+	parent     *ast.ScriptStatement
+}
+
 type impData struct {
 	texts     []impText
 	movements []impMovement
+	scripts   []impScript
+	menuLists []impMenuList
 }
 
 func (d *impData) add(other *impData) {
@@ -47,6 +61,8 @@ func (d *impData) add(other *impData) {
 	}
 	d.texts = append(d.texts, other.texts...)
 	d.movements = append(d.movements, other.movements...)
+	d.scripts = append(d.scripts, other.scripts...)
+	d.menuLists = append(d.menuLists, other.menuLists...)
 }
 
 type textKey struct {
@@ -56,6 +72,54 @@ type textKey struct {
 
 type CommandConfig struct {
 	AutoVarCommands map[string]AutoVarCommand `json:"autovar_commands"`
+	// Maps branch commands, such as "goto_if_set", to their conditional call
+	// equivalents, such as "call_if_set".
+	ConditionalCallCommands map[string]string `json:"conditional_call_commands"`
+	// Pool of temporary vars that 'let' locals are allocated from.
+	TempVars []string `json:"temp_vars"`
+	// Pool of temporary flags that 'let' locals are allocated from.
+	TempFlags []string `json:"temp_flags"`
+	// Vars that script parameters are passed in, in parameter order.
+	ScriptArgVars []string `json:"script_arg_vars"`
+	// Var that scripts return their values in.
+	ScriptReturnVar string `json:"script_return_var"`
+	// Command that 'menu' statements display their options with.
+	Menu *MenuCommand `json:"menu"`
+	// Commands that can be used as conditions, such as "yesno".
+	ConditionCommands map[string]ConditionCommand `json:"condition_commands"`
+	// Script templates, which can be applied to scripts with "script(name)".
+	Templates map[string]ScriptTemplate `json:"templates"`
+	// Signatures of commands, which are used to check their arguments.
+	Commands map[string]CommandSignature `json:"commands"`
+	// Names of all commands and macros that scripts can use. Commands that
+	// don't have a signature aren't checked, but -strict-commands accepts them.
+	KnownCommands []string `json:"known_commands"`
+	// Maps symbol prefixes, such as "FLAG_", to the kinds of symbols that
+	// use them, such as "flag".
+	SymbolPrefixes map[string]string `json:"symbol_prefixes"`
+}
+
+// ConditionCommand describes a command that can be used directly as a
+// condition. It expands into the configured command, followed by a comparison
+// of the command's result var to the value that means the condition is true.
+type ConditionCommand struct {
+	// Command that is emitted. Defaults to the condition command's own name.
+	Command string `json:"command"`
+	// Args that are appended to the arguments written in the script.
+	Args    []string `json:"args"`
+	VarName string   `json:"var_name"`
+	Value   string   `json:"value"`
+}
+
+// MenuCommand describes the command that displays a 'menu' statement's options.
+// Args can contain the placeholders "{x}", "{y}", and "{count}", as well as
+// "{options}", which expands to one argument per option text, and "{list}",
+// which is replaced by the label of a generated list of the option texts.
+type MenuCommand struct {
+	Name        string   `json:"name"`
+	Args        []string `json:"args"`
+	ResultVar   string   `json:"result_var"`
+	CancelValue string   `json:"cancel_value"`
 }
 
 type AutoVarCommand struct {
@@ -78,6 +142,10 @@ type Parser struct {
 	inlineMovements          []*ast.MovementStatement
 	inlineMovementsSet       map[string]string
 	inlineMovementCounts     map[string]int
+	inlineScripts            []*ast.ScriptStatement
+	inlineScriptCounts       map[string]int
+	inlineMenuLists          []*ast.RawStatement
+	inlineMenuListCounts     map[string]int
 	textStatements           []*ast.TextStatement
 	breakStack               []ast.Statement
 	continueStack            []ast.Statement
@@ -91,6 +159,47 @@ type Parser struct {
 	enableEnvironmentErrors  bool
 	enableDiagnosticWarnings bool
 	warnings                 []ast.Warning
+	// Locals and parameters of the script currently being parsed. scriptLocals
+	// is nil outside of script statements.
+	scriptLocals  []*ast.LocalDeclaration
+	scriptParams  []*ast.LocalDeclaration
+	currentScript *ast.ScriptStatement
+	// Maps scripts hoisted from block literals to the scripts they were
+	// written in. Hoisted scripts share the locals of their parent scripts.
+	scriptParents map[*ast.ScriptStatement]*ast.ScriptStatement
+	// Script calls whose return values are assigned to vars.
+	assignedCalls []*ast.CommandStatement
+	// Script templates declared with 'template' statements.
+	templates map[string]*scriptTemplate
+	// '#if' directives whose '#endif' hasn't been reached yet.
+	conditionals []conditionalFrame
+	directiveErr error
+	// Default values of compile switches, declared with 'switch_default'.
+	switchDefaults map[string]string
+	// Curly brace depth of the tokens read so far. 'switch_default' can only
+	// be used at the top level.
+	braceDepth int
+	// Line number where the last token read so far ends.
+	lastLineNumber   int
+	switchReferences []SwitchReference
+	// Constants defined outside of the script, such as with the '-D' option,
+	// that haven't been overridden by a const in the script yet.
+	definedConstants    map[string]bool
+	constOverridePolicy ConstOverridePolicy
+	// Constants read from C headers. They can't be redefined with const.
+	headerConstants *cheader.Constants
+	// Symbols that scripts can reference, which are used to catch misspelled
+	// flags, vars, items, and movement commands.
+	symbolConfig        SymbolConfig
+	undefinedSymbolMode UndefinedSymbolMode
+	knownSymbols        *symbolSet
+	knownMovements      *symbolSet
+	// Commands in the script, which are checked against the command
+	// signatures in the command config.
+	commandUses    []commandUse
+	strictCommands bool
+	// Catalogue of movement commands, such as one read from movement.inc.
+	movementCatalogue *movement.Catalogue
 }
 
 // New creates a new Poryscript AST Parser.
@@ -104,6 +213,11 @@ func New(l *lexer.Lexer, commandConfig CommandConfig, fontConfigFilepath, defaul
 		inlineMovements:          make([]*ast.MovementStatement, 0),
 		inlineMovementsSet:       make(map[string]string),
 		inlineMovementCounts:     make(map[string]int),
+		inlineScriptCounts:       make(map[string]int),
+		inlineMenuListCounts:     make(map[string]int),
+		scriptParents:            make(map[*ast.ScriptStatement]*ast.ScriptStatement),
+		templates:                make(map[string]*scriptTemplate),
+		switchDefaults:           make(map[string]string),
 		textStatements:           make([]*ast.TextStatement, 0),
 		commandConfig:            commandConfig,
 		fontConfigFilepath:       fontConfigFilepath,
@@ -111,6 +225,7 @@ func New(l *lexer.Lexer, commandConfig CommandConfig, fontConfigFilepath, defaul
 		maxLineLength:            maxLineLength,
 		compileSwitches:          compileSwitches,
 		constants:                make(map[string]string),
+		definedConstants:         make(map[string]bool),
 		enableEnvironmentErrors:  true,
 		enableDiagnosticWarnings: false,
 	}
@@ -235,7 +350,7 @@ func (p *Parser) nextToken() {
 	p.peekToken = p.peek2Token
 	p.peek2Token = p.peek3Token
 	p.peek3Token = p.peek4Token
-	p.peek4Token = p.l.NextToken()
+	p.peek4Token = p.readToken()
 }
 
 func (p *Parser) peekTokenIs(expectedType token.Type) bool {
@@ -308,12 +423,18 @@ func getImplicitMovementLabel(scriptName string, i int) string {
 	return fmt.Sprintf("%s_Movement_%d", scriptName, i)
 }
 
+func getImplicitScriptLabel(scriptName string, i int) string {
+	return fmt.Sprintf("%s_Script_%d", scriptName, i)
+}
+
 // ParseProgram parses a Poryscript file into an AST.
 func (p *Parser) ParseProgram() (*ast.Program, error) {
 	p.inlineTexts = make([]ast.Text, 0)
 	p.inlineTextsSet = make(map[textKey]string)
 	p.inlineMovements = make([]*ast.MovementStatement, 0)
 	p.inlineMovementsSet = make(map[string]string)
+	p.inlineScripts = make([]*ast.ScriptStatement, 0)
+	p.inlineMenuLists = make([]*ast.RawStatement, 0)
 	p.textStatements = make([]*ast.TextStatement, 0)
 	program := &ast.Program{
 		TopLevelStatements: []ast.Statement{},
@@ -321,15 +442,19 @@ func (p *Parser) ParseProgram() (*ast.Program, error) {
 	}
 
 	for p.curToken.Type != token.EOF {
-		statement, err := p.parseTopLevelStatement()
+		statements, err := p.parseTopLevelStatementOrPoryswitch()
+		if p.directiveErr != nil {
+			return nil, p.directiveErr
+		}
 		if err != nil {
 			return nil, err
 		}
-		if statement != nil {
-			program.TopLevelStatements = append(program.TopLevelStatements, statement)
-		}
+		program.TopLevelStatements = append(program.TopLevelStatements, statements...)
 		p.nextToken()
 	}
+	if p.directiveErr != nil {
+		return nil, p.directiveErr
+	}
 
 	// Build list of Texts from both inline and explicit texts.
 	// Generate error if there are any name clashes.
@@ -369,10 +494,58 @@ func (p *Parser) ParseProgram() (*ast.Program, error) {
 		}
 	}
 
+	for _, list := range p.inlineMenuLists {
+		program.TopLevelStatements = append(program.TopLevelStatements, list)
+	}
+
+	// Scripts from block literals are emitted after the other statements.
+	// Generate error if their labels clash with the other scripts.
+	scriptTokens := make(map[string]token.Token, 0)
+	for _, stmt := range program.TopLevelStatements {
+		switch stmt := stmt.(type) {
+		case *ast.ScriptStatement:
+			scriptTokens[stmt.Name.Value] = stmt.Name.Token
+		case *ast.MapScriptsStatement:
+			for _, child := range stmt.AllChildren() {
+				if scriptStmt, ok := child.(*ast.ScriptStatement); ok {
+					scriptTokens[scriptStmt.Name.Value] = stmt.Name.Token
+				}
+			}
+		}
+	}
+	for _, scriptStmt := range p.inlineScripts {
+		if existingToken, ok := scriptTokens[scriptStmt.Name.Value]; ok {
+			return nil, NewParseError(existingToken, fmt.Sprintf("duplicate script label '%s'. Choose a unique label that won't clash with the auto-generated script labels", scriptStmt.Name.Value))
+		}
+		scriptTokens[scriptStmt.Name.Value] = scriptStmt.Token
+		program.TopLevelStatements = append(program.TopLevelStatements, scriptStmt)
+	}
+
+	if err := p.validateCommands(program); err != nil {
+		return nil, err
+	}
+	if err := p.lowerScriptCalls(program); err != nil {
+		return nil, err
+	}
+	if err := p.allocateLocals(program); err != nil {
+		return nil, err
+	}
+
 	program.Warnings = p.warnings
 	return program, nil
 }
 
+func (p *Parser) parseTopLevelStatementOrPoryswitch() ([]ast.Statement, error) {
+	if p.curToken.Type == token.PORYSWITCH {
+		return p.parseTopLevelPoryswitchStatement()
+	}
+	statement, err := p.parseTopLevelStatement()
+	if err != nil || statement == nil {
+		return nil, err
+	}
+	return []ast.Statement{statement}, nil
+}
+
 func (p *Parser) parseTopLevelStatement() (ast.Statement, error) {
 	switch p.curToken.Type {
 	case token.SCRIPT:
@@ -416,17 +589,37 @@ func (p *Parser) parseTopLevelStatement() (ast.Statement, error) {
 	case token.CONST:
 		err := p.parseConstant()
 		return nil, err
+	case token.IDENT:
+		if p.curToken.Literal == "template" {
+			err := p.parseTemplateStatement()
+			return nil, err
+		}
+		if p.curToken.Literal == "switch_default" {
+			return nil, NewParseError(p.curToken, "switch_default can't be used inside a poryswitch statement")
+		}
 	}
 
 	return nil, NewParseError(p.curToken, fmt.Sprintf("could not parse top-level statement for '%s'", p.curToken.Literal))
 }
 
+// Reports whether the peek token starts a top-level statement. "template" is
+// only a keyword when it starts a template statement, so it can still be used
+// as the name of a script, label, or text.
+func (p *Parser) peekTokenStartsTopLevelStatement() bool {
+	if topLevelTokens[p.peekToken.Type] {
+		return true
+	}
+	return p.peekToken.Literal == "template" && p.peek2TokenIs(token.IDENT) && p.peek3TokenIs(token.LBRACE)
+}
+
 func (p *Parser) addImplicitData(implicitData *impData) {
 	if implicitData == nil {
 		return
 	}
 	p.addImplicitTexts(implicitData.texts)
 	p.addImplicitMovements(implicitData.movements)
+	p.addImplicitScripts(implicitData.scripts)
+	p.addImplicitMenuLists(implicitData.menuLists)
 }
 
 func (p *Parser) addImplicitTexts(texts []impText) {
@@ -480,6 +673,27 @@ func (p *Parser) addImplicitMovements(movements []impMovement) {
 	}
 }
 
+func (p *Parser) addImplicitScripts(scripts []impScript) {
+	for _, s := range scripts {
+		label := getImplicitScriptLabel(s.scriptName, p.inlineScriptCounts[s.scriptName])
+		s.command.Args[s.argPos] = label
+		p.inlineScriptCounts[s.scriptName]++
+		scriptStmt := &ast.ScriptStatement{
+			Token: s.token,
+			Name: &ast.Identifier{
+				Token: s.token,
+				Value: label,
+			},
+			Body:  s.body,
+			Scope: token.LOCAL,
+		}
+		if s.parent != nil {
+			p.scriptParents[scriptStmt] = s.parent
+		}
+		p.inlineScripts = append(p.inlineScripts, scriptStmt)
+	}
+}
+
 func (p *Parser) parseScopeModifier(defaultScope token.Type) (token.Type, error) {
 	var scope = defaultScope
 	if !p.peekTokenIs(token.LPAREN) {
@@ -500,7 +714,7 @@ func (p *Parser) parseScopeModifier(defaultScope token.Type) (token.Type, error)
 
 func (p *Parser) parseScriptStatement() (*ast.ScriptStatement, *impData, error) {
 	statement := &ast.ScriptStatement{Token: p.curToken}
-	scope, err := p.parseScopeModifier(token.GLOBAL)
+	scope, template, err := p.parseScriptModifiers()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -514,6 +728,15 @@ func (p *Parser) parseScriptStatement() (*ast.ScriptStatement, *impData, error)
 		Value: p.curToken.Literal,
 	}
 
+	if p.peekTokenIs(token.LPAREN) {
+		p.nextToken()
+		params, err := p.parseScriptParams(statement.Name.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		statement.Params = params
+	}
+
 	if err := p.expectPeek(token.LBRACE); err != nil {
 		return nil, nil, NewRangeParseError(statement.Token, p.peekToken, fmt.Sprintf("missing opening curly brace for script '%s'", statement.Name.Value))
 	}
@@ -521,11 +744,49 @@ func (p *Parser) parseScriptStatement() (*ast.ScriptStatement, *impData, error)
 	braceToken := p.curToken
 	p.nextToken()
 
+	p.scriptLocals = []*ast.LocalDeclaration{}
+	p.scriptParams = statement.Params
+	p.currentScript = statement
+	defer func() {
+		p.scriptLocals = nil
+		p.scriptParams = nil
+		p.currentScript = nil
+	}()
 	blockStmt, impData, err := p.parseBlockStatement(statement.Name.Value, braceToken)
 	if err != nil {
 		return nil, nil, err
 	}
 	statement.Body = blockStmt
+	statement.Locals = p.scriptLocals
+	if template != nil {
+		p.applyTemplate(template, statement, impData)
+	}
+	return statement, impData, nil
+}
+
+// Parses the body of a script that's written inline in a mapscripts statement.
+// Like other scripts, it can declare locals.
+func (p *Parser) parseMapScriptBody(scriptName string, braceToken token.Token) (*ast.ScriptStatement, *impData, error) {
+	statement := &ast.ScriptStatement{
+		Name: &ast.Identifier{
+			Value: scriptName,
+		},
+		Scope: token.LOCAL,
+	}
+	p.scriptLocals = []*ast.LocalDeclaration{}
+	p.scriptParams = nil
+	p.currentScript = statement
+	defer func() {
+		p.scriptLocals = nil
+		p.scriptParams = nil
+		p.currentScript = nil
+	}()
+	blockStmt, impData, err := p.parseBlockStatement(scriptName, braceToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	statement.Body = blockStmt
+	statement.Locals = p.scriptLocals
 	return statement, impData, nil
 }
 
@@ -590,6 +851,12 @@ func (p *Parser) parseStatement(scriptName string) ([]ast.Statement, *impData, e
 		label := p.tryParseLabelStatement()
 		if label != nil {
 			statements = append(statements, label)
+		} else if p.isLocalDeclaration() {
+			err = p.parseLocalDeclaration()
+		} else if p.isMenuStatement() {
+			statements, impData, err = p.parseMenuStatement(scriptName)
+		} else if p.curToken.Literal == "switch_default" && p.peekTokenIs(token.IDENT) && p.peek2TokenIs(token.ASSIGN) {
+			err = NewParseError(p.curToken, "switch_default can only be used at the top level")
 		} else {
 			statement, impData, err = p.parseCommandStatement(scriptName)
 			statements = append(statements, statement)
@@ -619,6 +886,11 @@ func (p *Parser) parseStatement(scriptName string) ([]ast.Statement, *impData, e
 		var stmts []ast.Statement
 		stmts, impData, err = p.parsePoryswitchStatement(scriptName)
 		statements = append(statements, stmts...)
+	case token.RAW:
+		statement, err = p.parseScriptRawStatement()
+		statements = append(statements, statement)
+	case token.VAR:
+		statements, impData, err = p.parseScriptCallAssignment(scriptName)
 	default:
 		err = NewParseError(p.curToken, fmt.Sprintf("could not parse statement for '%s'", p.curToken.Literal))
 	}
@@ -641,21 +913,30 @@ func (p *Parser) parseCommandStatement(scriptName string) (*ast.CommandStatement
 	}
 
 	impData := &impData{}
+	args := []commandArg{}
 
 	if p.peekTokenIs(token.LPAREN) {
 		p.nextToken()
 		p.nextToken()
 		argParts := []string{}
+		argTokens := []token.Token{}
+		argType := argExpression
 		numOpenParens := 0
 		for !(p.curToken.Type == token.RPAREN && numOpenParens == 0) {
 			if p.curToken.Type == token.EOF {
 				return nil, nil, NewParseError(command.Token, fmt.Sprintf("missing closing parenthesis for command '%s'", command.Name.TokenLiteral()))
 			}
 
+			if p.curToken.Type != token.COMMA {
+				argTokens = append(argTokens, p.curToken)
+			}
 			if p.curToken.Type == token.COMMA {
 				arg := strings.Join(argParts, " ")
 				command.Args = append(command.Args, arg)
+				args = append(args, p.newCommandArg(argTokens, argType))
 				argParts = []string{}
+				argTokens = []token.Token{}
+				argType = argExpression
 			} else if p.curToken.Type == token.LPAREN {
 				numOpenParens++
 				argParts = append(argParts, p.curToken.Literal)
@@ -668,6 +949,7 @@ func (p *Parser) parseCommandStatement(scriptName string) (*ast.CommandStatement
 					return nil, nil, err
 				}
 				strToken.Literal = p.formatTextTerminator(strValue, strType)
+				argType = argString
 				impData.texts = append(impData.texts, impText{
 					command:    command,
 					argPos:     len(command.Args),
@@ -681,6 +963,7 @@ func (p *Parser) parseCommandStatement(scriptName string) (*ast.CommandStatement
 				p.validateTextLineWidth(p.curToken, literal)
 				strToken := p.curToken
 				strToken.Literal = p.formatTextTerminator(literal, "")
+				argType = argString
 				impData.texts = append(impData.texts, impText{
 					command:    command,
 					argPos:     len(command.Args),
@@ -698,6 +981,7 @@ func (p *Parser) parseCommandStatement(scriptName string) (*ast.CommandStatement
 				p.validateTextLineWidth(p.curToken, literal)
 				strToken := p.curToken
 				strToken.Literal = p.formatTextTerminator(literal, stringType)
+				argType = argString
 				impData.texts = append(impData.texts, impText{
 					command:    command,
 					argPos:     len(command.Args),
@@ -706,6 +990,14 @@ func (p *Parser) parseCommandStatement(scriptName string) (*ast.CommandStatement
 					scriptName: scriptName,
 				})
 				argParts = append(argParts, "")
+			} else if p.curToken.Type == token.LBRACE {
+				blockImpData, err := p.parseBlockLiteralArg(command, len(command.Args), scriptName)
+				if err != nil {
+					return nil, nil, err
+				}
+				impData.add(blockImpData)
+				argParts = append(argParts, "")
+				argType = argBlock
 			} else if p.curToken.Type == token.MOVES {
 				movements, err := p.parseMovesOperator()
 				if err != nil {
@@ -718,6 +1010,7 @@ func (p *Parser) parseCommandStatement(scriptName string) (*ast.CommandStatement
 					scriptName: scriptName,
 				})
 				argParts = append(argParts, "")
+				argType = argMoves
 			} else {
 				argParts = append(argParts, p.tryReplaceWithConstant(p.curToken.Literal))
 			}
@@ -728,12 +1021,45 @@ func (p *Parser) parseCommandStatement(scriptName string) (*ast.CommandStatement
 		if len(argParts) > 0 {
 			arg := strings.Join(argParts, " ")
 			command.Args = append(command.Args, arg)
+			args = append(args, p.newCommandArg(argTokens, argType))
 		}
 	}
+	p.commandUses = append(p.commandUses, commandUse{command: command, args: args})
 
 	return command, impData, nil
 }
 
+// Parses a block literal that is passed to a command, such as
+// "call({ setflag(FLAG_1) })". The block is hoisted into its own script,
+// whose label replaces the block in the command's arguments.
+func (p *Parser) parseBlockLiteralArg(command *ast.CommandStatement, argPos int, scriptName string) (*impData, error) {
+	braceToken := p.curToken
+	p.nextToken()
+
+	// The block is a separate script, so it can't break out of, or continue,
+	// the loops that surround the command.
+	breakStack, continueStack := p.breakStack, p.continueStack
+	p.breakStack, p.continueStack = nil, nil
+	blockStmt, blockImpData, err := p.parseBlockStatement(scriptName, braceToken)
+	p.breakStack, p.continueStack = breakStack, continueStack
+	if err != nil {
+		return nil, err
+	}
+
+	resultImpData := &impData{
+		scripts: []impScript{{
+			command:    command,
+			argPos:     argPos,
+			body:       blockStmt,
+			token:      braceToken,
+			scriptName: scriptName,
+			parent:     p.currentScript,
+		}},
+	}
+	resultImpData.add(blockImpData)
+	return resultImpData, nil
+}
+
 func (p *Parser) tryParseLabelStatement() *ast.LabelStatement {
 	// From a parsing perspective, label statements are similar
 	// to command statements because they can either be simple identifiers
@@ -781,6 +1107,33 @@ func (p *Parser) parseRawStatement() (*ast.RawStatement, error) {
 	return statement, nil
 }
 
+// Parses a raw statement inside of a script. The "noreturn" modifier declares
+// that execution never continues past the raw statement, such as "raw(noreturn) `...`".
+func (p *Parser) parseScriptRawStatement() (*ast.RawStatement, error) {
+	statement := &ast.RawStatement{
+		Token: p.curToken,
+	}
+	if p.peekTokenIs(token.LPAREN) {
+		p.nextToken()
+		if !p.peekTokenIs(token.IDENT) || p.peekToken.Literal != "noreturn" {
+			return nil, NewParseError(p.peekToken, fmt.Sprintf("raw statement modifier must be 'noreturn', but got '%s' instead", p.peekToken.Literal))
+		}
+		p.nextToken()
+		if !p.peekTokenIs(token.RPAREN) {
+			return nil, NewParseError(p.curToken, fmt.Sprintf("missing ')' after raw statement modifier. Got '%s' instead", p.peekToken.Literal))
+		}
+		p.nextToken()
+		statement.NoReturn = true
+	}
+
+	if err := p.expectPeek(token.RAWSTRING); err != nil {
+		return nil, NewRangeParseError(statement.Token, p.peekToken, "raw statement must begin with a backtick character '`'")
+	}
+
+	statement.Value = p.curToken.Literal
+	return statement, nil
+}
+
 func (p *Parser) parseTextStatement() (*ast.TextStatement, error) {
 	statement := &ast.TextStatement{
 		Token: p.curToken,
@@ -854,7 +1207,12 @@ func (p *Parser) parseTextValue() (string, string, error) {
 }
 
 func (p *Parser) parsePoryswitchHeader() (string, string, error) {
-	if len(p.compileSwitches) == 0 && p.enableEnvironmentErrors {
+	// The switch is recorded before any errors, so that -check-all-switches
+	// can discover it.
+	if p.peekTokenIs(token.LPAREN) && p.peek2TokenIs(token.IDENT) {
+		p.addSwitchReference(p.peek2Token.Literal, "", p.peek2Token)
+	}
+	if !p.hasCompileSwitches() && p.enableEnvironmentErrors {
 		return "", "", NewParseError(p.curToken, "poryswitch used, but no compile switches were specified with the '-s' option")
 	}
 	if err := p.expectPeek(token.LPAREN); err != nil {
@@ -866,7 +1224,7 @@ func (p *Parser) parsePoryswitchHeader() (string, string, error) {
 	switchCase := p.curToken.Literal
 	var switchValue string
 	var ok bool
-	if switchValue, ok = p.compileSwitches[switchCase]; p.enableEnvironmentErrors && !ok {
+	if switchValue, ok = p.getCompileSwitch(switchCase); p.enableEnvironmentErrors && !ok {
 		return "", "", NewParseError(p.curToken, fmt.Sprintf("no poryswitch for '%s' was specified with the '-s' option", switchCase))
 	}
 
@@ -880,7 +1238,7 @@ func (p *Parser) parsePoryswitchHeader() (string, string, error) {
 	return switchCase, switchValue, nil
 }
 
-func (p *Parser) parsePoryswitchTextCases() (map[string]string, map[string]string, error) {
+func (p *Parser) parsePoryswitchTextCases(switchName string) (map[string]string, map[string]string, error) {
 	textCases := make(map[string]string)
 	textStringTypeCases := make(map[string]string)
 	startToken := p.curToken
@@ -891,8 +1249,11 @@ func (p *Parser) parsePoryswitchTextCases() (map[string]string, map[string]strin
 		if p.curToken.Type != token.IDENT && p.curToken.Type != token.INT {
 			return nil, nil, NewParseError(p.curToken, fmt.Sprintf("invalid poryswitch case '%s'. Expected a simple identifier", p.curToken.Literal))
 		}
-		caseValue := p.curToken.Literal
-		p.nextToken()
+		caseValues, err := p.parsePoryswitchCaseValues(switchName)
+		if err != nil {
+			return nil, nil, err
+		}
+		caseName := strings.Join(caseValues, ", ")
 		if p.curToken.Type == token.COLON || p.curToken.Type == token.LBRACE {
 			usedBrace := p.curToken.Type == token.LBRACE
 			p.nextToken()
@@ -900,17 +1261,19 @@ func (p *Parser) parsePoryswitchTextCases() (map[string]string, map[string]strin
 			if err != nil {
 				return nil, nil, err
 			}
-			textCases[caseValue] = strValue
-			textStringTypeCases[caseValue] = strType
+			for _, caseValue := range caseValues {
+				textCases[caseValue] = strValue
+				textStringTypeCases[caseValue] = strType
+			}
 			p.nextToken()
 			if usedBrace {
 				if p.curToken.Type != token.RBRACE {
-					return nil, nil, NewParseError(startToken, fmt.Sprintf("missing closing curly brace for poryswitch case '%s'", caseValue))
+					return nil, nil, NewParseError(startToken, fmt.Sprintf("missing closing curly brace for poryswitch case '%s'", caseName))
 				}
 				p.nextToken()
 			}
 		} else {
-			return nil, nil, NewParseError(p.curToken, fmt.Sprintf("invalid token '%s' after poryswitch case '%s'. Expected ':' or '{'", p.curToken.Literal, caseValue))
+			return nil, nil, NewParseError(p.curToken, fmt.Sprintf("invalid token '%s' after poryswitch case '%s'. Expected ':' or '{'", p.curToken.Literal, caseName))
 		}
 	}
 	return textCases, textStringTypeCases, nil
@@ -922,7 +1285,7 @@ func (p *Parser) parsePoryswitchTextStatement() (string, string, error) {
 	if err != nil {
 		return "", "", err
 	}
-	cases, strTypeCases, err := p.parsePoryswitchTextCases()
+	cases, strTypeCases, err := p.parsePoryswitchTextCases(switchCase)
 	if err != nil {
 		return "", "", err
 	}
@@ -964,6 +1327,7 @@ func (p *Parser) parseMovementStatement() (*ast.MovementStatement, error) {
 	if err != nil {
 		return nil, err
 	}
+	p.checkMovementTerminators(statement.MovementCommands)
 
 	return statement, nil
 }
@@ -983,6 +1347,9 @@ func parseMovementValue(p *Parser, allowMultiple bool, closingToken token.Type)
 			movementCommands = append(movementCommands, poryswitchCommands...)
 		} else if p.curToken.Type == token.IDENT {
 			moveCommand := p.curToken
+			if err := p.validateMovement(moveCommand); err != nil {
+				return nil, err
+			}
 			p.nextToken()
 			if p.curToken.Type == token.MUL {
 				p.nextToken()
@@ -1027,7 +1394,7 @@ func (p *Parser) parsePoryswitchListStatement(parseFunc poryswitchListValueParse
 	if err != nil {
 		return nil, err
 	}
-	cases, err := p.parsePoryswitchListCases(parseFunc)
+	cases, err := p.parsePoryswitchListCases(switchCase, parseFunc)
 	if err != nil {
 		return nil, err
 	}
@@ -1042,7 +1409,7 @@ func (p *Parser) parsePoryswitchListStatement(parseFunc poryswitchListValueParse
 	return listItems, nil
 }
 
-func (p *Parser) parsePoryswitchListCases(parseFunc poryswitchListValueParser) (map[string][]token.Token, error) {
+func (p *Parser) parsePoryswitchListCases(switchName string, parseFunc poryswitchListValueParser) (map[string][]token.Token, error) {
 	listCases := make(map[string][]token.Token)
 	startToken := p.curToken
 	for p.curToken.Type != token.RBRACE {
@@ -1052,8 +1419,11 @@ func (p *Parser) parsePoryswitchListCases(parseFunc poryswitchListValueParser) (
 		if p.curToken.Type != token.IDENT && p.curToken.Type != token.INT {
 			return nil, NewParseError(p.curToken, fmt.Sprintf("invalid poryswitch case '%s'. Expected a simple identifier", p.curToken.Literal))
 		}
-		caseValue := p.curToken.Literal
-		p.nextToken()
+		caseValues, err := p.parsePoryswitchCaseValues(switchName)
+		if err != nil {
+			return nil, err
+		}
+		caseName := strings.Join(caseValues, ", ")
 		if p.curToken.Type == token.COLON || p.curToken.Type == token.LBRACE {
 			usedBrace := p.curToken.Type == token.LBRACE
 			p.nextToken()
@@ -1061,15 +1431,17 @@ func (p *Parser) parsePoryswitchListCases(parseFunc poryswitchListValueParser) (
 			if err != nil {
 				return nil, err
 			}
-			listCases[caseValue] = listItems
+			for _, caseValue := range caseValues {
+				listCases[caseValue] = listItems
+			}
 			if usedBrace {
 				if p.curToken.Type != token.RBRACE {
-					return nil, NewParseError(p.curToken, fmt.Sprintf("missing closing curly brace for poryswitch case '%s'", caseValue))
+					return nil, NewParseError(p.curToken, fmt.Sprintf("missing closing curly brace for poryswitch case '%s'", caseName))
 				}
 				p.nextToken()
 			}
 		} else {
-			return nil, NewParseError(p.curToken, fmt.Sprintf("invalid token '%s' after poryswitch case '%s'. Expected ':' or '{'", p.curToken.Literal, caseValue))
+			return nil, NewParseError(p.curToken, fmt.Sprintf("invalid token '%s' after poryswitch case '%s'. Expected ':' or '{'", p.curToken.Literal, caseName))
 		}
 	}
 	return listCases, nil
@@ -1106,6 +1478,9 @@ func (p *Parser) parseMartStatement() (*ast.MartStatement, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := p.validateSymbols(statement.TokenItems); err != nil {
+		return nil, err
+	}
 
 	return statement, nil
 }
@@ -1179,21 +1554,15 @@ func (p *Parser) parseMapscriptsStatement() (*ast.MapScriptsStatement, *impData,
 			braceToken := p.curToken
 			p.nextToken()
 			scriptName := fmt.Sprintf("%s_%s", statement.Name.Value, mapScriptTypeToken.Literal)
-			blockStmt, stmtImpData, err := p.parseBlockStatement(scriptName, braceToken)
+			scriptStmt, stmtImpData, err := p.parseMapScriptBody(scriptName, braceToken)
 			if err != nil {
 				return nil, nil, err
 			}
 			impData.add(stmtImpData)
 			statement.MapScripts = append(statement.MapScripts, ast.MapScript{
-				Type: mapScriptTypeToken,
-				Name: scriptName,
-				Script: &ast.ScriptStatement{
-					Name: &ast.Identifier{
-						Value: scriptName,
-					},
-					Body:  blockStmt,
-					Scope: token.LOCAL,
-				},
+				Type:   mapScriptTypeToken,
+				Name:   scriptName,
+				Script: scriptStmt,
 			})
 			p.nextToken()
 		} else if p.curToken.Type == token.LBRACKET {
@@ -1252,7 +1621,7 @@ func (p *Parser) parseMapscriptsStatement() (*ast.MapScriptsStatement, *impData,
 					braceToken := p.curToken
 					p.nextToken()
 					scriptName := fmt.Sprintf("%s_%s_%d", statement.Name.Value, mapScriptTypeToken.Literal, i)
-					blockStmt, stmtImpData, err := p.parseBlockStatement(scriptName, braceToken)
+					scriptStmt, stmtImpData, err := p.parseMapScriptBody(scriptName, braceToken)
 					if err != nil {
 						return nil, nil, err
 					}
@@ -1261,13 +1630,7 @@ func (p *Parser) parseMapscriptsStatement() (*ast.MapScriptsStatement, *impData,
 						Condition:  conditionToken,
 						Comparison: comparisonValue,
 						Name:       scriptName,
-						Script: &ast.ScriptStatement{
-							Name: &ast.Identifier{
-								Value: scriptName,
-							},
-							Body:  blockStmt,
-							Scope: token.LOCAL,
-						},
+						Script:     scriptStmt,
 					})
 					p.nextToken()
 				}
@@ -1296,6 +1659,7 @@ func (p *Parser) parseMovesOperator() ([]token.Token, error) {
 	if err != nil {
 		return nil, err
 	}
+	p.checkMovementTerminators(moveTokens)
 
 	return moveTokens, nil
 }
@@ -1646,6 +2010,10 @@ func (p *Parser) parseSwitchStatement(scriptName string) (*ast.SwitchStatement,
 			if p.curToken.Type == token.EOF {
 				return nil, nil, nil, NewParseError(originalToken, "missing closing parenthesis of switch statement value")
 			}
+			if err := p.validateSymbol(p.curToken); err != nil {
+				return nil, nil, nil, err
+			}
+			p.checkSymbolKind(p.curToken, "var", "var()")
 			parts = append(parts, p.tryReplaceWithConstant(p.curToken.Literal))
 			p.nextToken()
 		}
@@ -1670,6 +2038,10 @@ func (p *Parser) parseSwitchStatement(scriptName string) (*ast.SwitchStatement,
 
 	// Parse each of the switch cases, including "default".
 	caseValues := make(map[string]bool)
+	// Maps the evaluated values of cases to the cases, so that cases like
+	// 'ITEM_POTION' and '13' are reported. They may be distinct aliases
+	// that happen to share a value, so they're only warned about.
+	caseNumbers := make(map[int64]string)
 	for p.curToken.Type != token.RBRACE {
 		if p.curToken.Type == token.CASE {
 			caseToken := p.curToken
@@ -1688,6 +2060,22 @@ func (p *Parser) parseSwitchStatement(scriptName string) (*ast.SwitchStatement,
 				return nil, nil, nil, NewRangeParseError(caseToken, p.curToken, fmt.Sprintf("duplicate switch cases detected for case '%s'", caseValue))
 			}
 			caseValues[caseValue] = true
+			if number, ok := p.evaluateHeaderExpression(caseValue); ok {
+				if otherCase, ok := caseNumbers[number]; ok {
+					p.warnings = append(p.warnings, ast.Warning{
+						Type:            ast.WarningDuplicateCase,
+						LineNumberStart: caseToken.LineNumber,
+						LineNumberEnd:   p.curToken.EndLineNumber,
+						CharStart:       caseToken.StartCharIndex,
+						Utf8CharStart:   caseToken.StartUtf8CharIndex,
+						CharEnd:         p.curToken.EndCharIndex,
+						Utf8CharEnd:     p.curToken.EndUtf8CharIndex,
+						Message:         fmt.Sprintf("switch case '%s' has the same value as case '%s' (%d), so it's never reached", caseValue, otherCase, number),
+					})
+				} else {
+					caseNumbers[number] = caseValue
+				}
+			}
 			p.nextToken()
 
 			body, stmtImpData, err := p.parseSwitchBlockStatement(scriptName, braceToken)
@@ -1892,6 +2280,13 @@ func (p *Parser) parseRightSideExpression(left ast.BooleanExpression, single boo
 	}
 }
 
+// Kinds of symbols that the operands of condition operators are expected to be.
+var conditionOperandKinds = map[token.Type]string{
+	token.VAR:      "var",
+	token.FLAG:     "flag",
+	token.DEFEATED: "trainer",
+}
+
 func (p *Parser) parseLeafBooleanExpression(scriptName string) (*ast.OperatorExpression, *impData, error) {
 	// Left-side of binary expression must be a special condition statement.
 	usedNotOperator := false
@@ -1903,8 +2298,11 @@ func (p *Parser) parseLeafBooleanExpression(scriptName string) (*ast.OperatorExp
 	}
 
 	isAutoVar := p.peekTokenIsAutoVar()
+	if p.peekTokenIsConditionCommand() {
+		return p.parseConditionCommand(operatorExpression, usedNotOperator, scriptName)
+	}
 	if !p.peekTokenIs(token.VAR) && !isAutoVar && !p.peekTokenIs(token.FLAG) && !p.peekTokenIs(token.DEFEATED) {
-		return nil, nil, NewParseError(p.peekToken, fmt.Sprintf("left side of binary expression must be var(), flag(), defeated(), or autovar command. Instead, found '%s'", p.peekToken.Literal))
+		return nil, nil, NewParseError(p.peekToken, fmt.Sprintf("left side of binary expression must be var(), flag(), defeated(), autovar command, or condition command. Instead, found '%s'", p.peekToken.Literal))
 	}
 
 	resultImpData := &impData{}
@@ -1923,6 +2321,10 @@ func (p *Parser) parseLeafBooleanExpression(scriptName string) (*ast.OperatorExp
 		parts := []string{}
 		operandToken := p.curToken
 		for p.curToken.Type != token.RPAREN {
+			if err := p.validateSymbol(p.curToken); err != nil {
+				return nil, nil, err
+			}
+			p.checkSymbolKind(p.curToken, conditionOperandKinds[operatorToken.Type], fmt.Sprintf("%s()", operatorToken.Literal))
 			parts = append(parts, p.tryReplaceWithConstant(p.curToken.Literal))
 			p.nextToken()
 			if p.curToken.Type == token.EOF {
@@ -1976,6 +2378,55 @@ func (p *Parser) parseLeafBooleanExpression(scriptName string) (*ast.OperatorExp
 	return operatorExpression, resultImpData, nil
 }
 
+func (p *Parser) peekTokenIsConditionCommand() bool {
+	if p.peekToken.Type != token.IDENT {
+		return false
+	}
+	_, ok := p.commandConfig.ConditionCommands[p.peekToken.Literal]
+	return ok
+}
+
+// Parses a condition command, such as yesno("Save?"). Unless an explicit
+// comparison is given, the condition is true when the command's result var
+// holds the configured value.
+func (p *Parser) parseConditionCommand(expression *ast.OperatorExpression, negated bool, scriptName string) (*ast.OperatorExpression, *impData, error) {
+	p.nextToken()
+	commandToken := p.curToken
+	cmd := p.commandConfig.ConditionCommands[commandToken.Literal]
+	commandStmt, impData, err := p.parseCommandStatement(scriptName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cmd.Command != "" {
+		commandStmt.Name = &ast.Identifier{
+			Token: commandToken,
+			Value: cmd.Command,
+		}
+	}
+	commandStmt.Args = append(commandStmt.Args, cmd.Args...)
+
+	operandToken := commandToken
+	operandToken.Type = token.IDENT
+	operandToken.Literal = cmd.VarName
+	expression.Type = token.VAR
+	expression.Operand = operandToken
+	expression.PreambleStatement = commandStmt
+	p.nextToken()
+	if negated {
+		expression.Operator = token.NEQ
+		expression.ComparisonValue = cmd.Value
+	} else if p.curToken.Type == token.GT || p.curToken.Type == token.GTE || p.curToken.Type == token.LT ||
+		p.curToken.Type == token.LTE || p.curToken.Type == token.EQ || p.curToken.Type == token.NEQ {
+		if err := p.parseConditionVarOperator(expression); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		expression.Operator = token.EQ
+		expression.ComparisonValue = cmd.Value
+	}
+	return expression, impData, nil
+}
+
 func (p *Parser) parseConditionVarOperator(expression *ast.OperatorExpression) error {
 	if p.curToken.Type != token.GT && p.curToken.Type != token.GTE && p.curToken.Type != token.LT &&
 		p.curToken.Type != token.LTE && p.curToken.Type != token.EQ && p.curToken.Type != token.NEQ {
@@ -2087,7 +2538,7 @@ func (p *Parser) parsePoryswitchStatement(scriptName string) ([]ast.Statement, *
 	if err != nil {
 		return nil, nil, err
 	}
-	cases, caseImpData, err := p.parsePoryswitchStatementCases(scriptName)
+	cases, caseImpData, err := p.parsePoryswitchStatementCases(switchCase, scriptName)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -2108,7 +2559,7 @@ func (p *Parser) parsePoryswitchStatement(scriptName string) ([]ast.Statement, *
 	return statements, impData, nil
 }
 
-func (p *Parser) parsePoryswitchStatementCases(scriptName string) (map[string][]ast.Statement, map[string]*impData, error) {
+func (p *Parser) parsePoryswitchStatementCases(switchName, scriptName string) (map[string][]ast.Statement, map[string]*impData, error) {
 	statementCases := make(map[string][]ast.Statement)
 	impDatas := make(map[string]*impData)
 	startToken := p.curToken
@@ -2120,7 +2571,11 @@ func (p *Parser) parsePoryswitchStatementCases(scriptName string) (map[string][]
 			return nil, nil, NewParseError(p.curToken, fmt.Sprintf("invalid poryswitch case '%s'. Expected a simple identifier", p.curToken.Literal))
 		}
 		caseToken := p.curToken
-		p.nextToken()
+		caseValues, err := p.parsePoryswitchCaseValues(switchName)
+		if err != nil {
+			return nil, nil, err
+		}
+		caseName := strings.Join(caseValues, ", ")
 		if p.curToken.Type == token.COLON || p.curToken.Type == token.LBRACE {
 			usedBrace := p.curToken.Type == token.LBRACE
 			p.nextToken()
@@ -2128,16 +2583,18 @@ func (p *Parser) parsePoryswitchStatementCases(scriptName string) (map[string][]
 			if err != nil {
 				return nil, nil, err
 			}
-			statementCases[caseToken.Literal] = statements
-			impDatas[caseToken.Literal] = stmtImpData
+			for _, caseValue := range caseValues {
+				statementCases[caseValue] = statements
+				impDatas[caseValue] = stmtImpData
+			}
 			if usedBrace {
 				if p.curToken.Type != token.RBRACE {
-					return nil, nil, NewParseError(caseToken, fmt.Sprintf("missing closing curly brace for poryswitch case '%s'", caseToken.Literal))
+					return nil, nil, NewParseError(caseToken, fmt.Sprintf("missing closing curly brace for poryswitch case '%s'", caseName))
 				}
 				p.nextToken()
 			}
 		} else {
-			return nil, nil, NewParseError(p.curToken, fmt.Sprintf("invalid token '%s' after poryswitch case '%s'. Expected ':' or '{'", p.curToken.Literal, caseToken.Literal))
+			return nil, nil, NewParseError(p.curToken, fmt.Sprintf("invalid token '%s' after poryswitch case '%s'. Expected ':' or '{'", p.curToken.Literal, caseName))
 		}
 	}
 	return statementCases, impDatas, nil
@@ -2177,9 +2634,13 @@ func (p *Parser) parseConstant() error {
 		return NewParseError(p.peekToken, fmt.Sprintf("expected identifier after const, but got '%s' instead", p.peekToken.Literal))
 	}
 	constName := p.curToken.Literal
-	if _, ok := p.constants[constName]; ok {
+	nameToken := p.curToken
+	if _, ok := p.constants[constName]; ok && !p.definedConstants[constName] {
 		return NewParseError(p.curToken, fmt.Sprintf("duplicate const '%s'. Must use unique const names", constName))
 	}
+	if headerConstant, ok := p.lookupHeaderConstant(constName); ok {
+		return NewParseError(p.curToken, fmt.Sprintf("const '%s' is already defined in C header '%s' on line %d", constName, headerConstant.File, headerConstant.Line))
+	}
 	if err := p.expectPeek(token.ASSIGN); err != nil {
 		return NewParseError(p.curToken, fmt.Sprintf("missing equals sign after const name '%s'", constName))
 	}
@@ -2187,8 +2648,7 @@ func (p *Parser) parseConstant() error {
 
 	var sb strings.Builder
 	for {
-		_, ok := topLevelTokens[p.peekToken.Type]
-		if ok || p.curToken.Type == token.EOF {
+		if p.peekTokenStartsTopLevelStatement() || p.curToken.Type == token.EOF {
 			break
 		}
 		p.nextToken()
@@ -2201,10 +2661,64 @@ func (p *Parser) parseConstant() error {
 	if sb.Len() == 0 {
 		return NewRangeParseError(initialToken, equalsToken, fmt.Sprintf("missing value for const '%s'", constName))
 	}
+	if p.definedConstants[constName] {
+		delete(p.definedConstants, constName)
+		switch p.constOverridePolicy {
+		case ConstOverrideError:
+			return NewParseError(nameToken, fmt.Sprintf("const '%s' was already defined with the '-D' option", constName))
+		case ConstOverrideKeepDefined:
+			return nil
+		}
+	}
 	p.constants[constName] = sb.String()
 	return nil
 }
 
+// SetHeaderConstants sets the constants that were read from C headers. They're
+// used to evaluate the values of expressions, such as switch cases.
+func (p *Parser) SetHeaderConstants(constants *cheader.Constants) {
+	p.headerConstants = constants
+}
+
+func (p *Parser) lookupHeaderConstant(name string) (cheader.Constant, bool) {
+	if p.headerConstants == nil {
+		return cheader.Constant{}, false
+	}
+	return p.headerConstants.Lookup(name)
+}
+
+// Evaluates an integer expression, such as "FLAG_BASE + 1", using the constants
+// read from C headers. Returns false if the expression can't be evaluated.
+func (p *Parser) evaluateHeaderExpression(expr string) (int64, bool) {
+	return cheader.Evaluate(expr, func(name string) (int64, bool) {
+		constant, ok := p.lookupHeaderConstant(name)
+		return constant.Value, ok && constant.Evaluated
+	})
+}
+
+// ConstOverridePolicy controls what happens when a const in the script has the
+// same name as a constant defined with DefineConstants.
+type ConstOverridePolicy int
+
+const (
+	// The const in the script is an error.
+	ConstOverrideError ConstOverridePolicy = iota
+	// The defined constant is kept, so the const in the script acts as a default value.
+	ConstOverrideKeepDefined
+	// The const in the script replaces the defined constant.
+	ConstOverrideAllow
+)
+
+// DefineConstants defines constants before the script is parsed, as if they were
+// declared with const at the top of the script. It's used for the '-D' option.
+func (p *Parser) DefineConstants(constants map[string]string, policy ConstOverridePolicy) {
+	for name, value := range constants {
+		p.constants[name] = value
+		p.definedConstants[name] = true
+	}
+	p.constOverridePolicy = policy
+}
+
 func (p *Parser) tryReplaceWithConstant(value string) string {
 	if constValue, ok := p.constants[value]; ok {
 		return constValue
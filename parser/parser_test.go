@@ -1,15 +1,20 @@
 package parser
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/huderlem/poryscript/token"
 
 	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/cheader"
 	"github.com/huderlem/poryscript/lexer"
+	"github.com/huderlem/poryscript/movement"
 )
 
 type commandArgs struct {
@@ -302,6 +307,510 @@ mart MyMart {
 	}
 }
 
+func TestTopLevelPoryswitchStatements(t *testing.T) {
+	input := `
+const UNUSED = 1
+poryswitch(GAME_VERSION) {
+	_ {
+		const ORB = ITEM_NONE
+		script VersionScript { fallback }
+	}
+	RUBY {
+		const ORB = ITEM_RED_ORB
+		script VersionScript { ruby }
+		poryswitch(LANG) {
+			DE { text RubyText { "Rubin" } }
+			_ {}
+		}
+	}
+	SAPPHIRE {
+		const ORB = ITEM_BLUE_ORB
+		script VersionScript { sapphire }
+		mart SapphireMart { ITEM_POTION }
+	}
+}
+
+script GiveOrb {
+	giveitem(ORB)
+}
+`
+	tests := []struct {
+		switches   map[string]string
+		statements []string
+		command    string
+		orb        string
+	}{
+		{map[string]string{"GAME_VERSION": "RUBY", "LANG": "DE"}, []string{"VersionScript", "RubyText", "GiveOrb"}, "ruby", "ITEM_RED_ORB"},
+		{map[string]string{"GAME_VERSION": "RUBY", "LANG": "EN"}, []string{"VersionScript", "GiveOrb"}, "ruby", "ITEM_RED_ORB"},
+		{map[string]string{"GAME_VERSION": "SAPPHIRE", "LANG": "EN"}, []string{"VersionScript", "SapphireMart", "GiveOrb"}, "sapphire", "ITEM_BLUE_ORB"},
+		{map[string]string{"GAME_VERSION": "EMERALD", "LANG": "EN"}, []string{"VersionScript", "GiveOrb"}, "fallback", "ITEM_NONE"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(input)
+		p := New(l, CommandConfig{}, "../font_config.json", "", 0, tt.switches)
+		program, err := p.ParseProgram()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(program.TopLevelStatements) != len(tt.statements) {
+			t.Fatalf("Incorrect number of top-level statements. Expected %d, got %d", len(tt.statements), len(program.TopLevelStatements))
+		}
+		for i, expectedName := range tt.statements {
+			var name string
+			switch stmt := program.TopLevelStatements[i].(type) {
+			case *ast.ScriptStatement:
+				name = stmt.Name.Value
+			case *ast.TextStatement:
+				name = stmt.Name.Value
+			case *ast.MartStatement:
+				name = stmt.Name.Value
+			}
+			if expectedName != name {
+				t.Fatalf("Incorrect top-level statement %d. Expected %s, got %s", i, expectedName, name)
+			}
+		}
+		versionScript := program.TopLevelStatements[0].(*ast.ScriptStatement)
+		if command := versionScript.Body.Statements[0].TokenLiteral(); command != tt.command {
+			t.Fatalf("Incorrect version command. Expected %s, got %s", tt.command, command)
+		}
+		giveOrb := program.TopLevelStatements[len(tt.statements)-1].(*ast.ScriptStatement)
+		if orb := giveOrb.Body.Statements[0].(*ast.CommandStatement).Args[0]; orb != tt.orb {
+			t.Fatalf("Incorrect const value. Expected %s, got %s", tt.orb, orb)
+		}
+	}
+}
+
+func TestTopLevelPoryswitchErrors(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedErrorMsg string
+	}{
+		{
+			input: `
+poryswitch(GAME_VERSION) {
+	RUBY: script MyScript {}
+}`,
+			expectedErrorMsg: "line 3: invalid token ':' after top-level poryswitch case 'RUBY'. Expected '{'",
+		},
+		{
+			input: `
+poryswitch(GAME_VERSION) {
+	SAPPHIRE { script MyScript {} }
+}`,
+			expectedErrorMsg: "line 2: no poryswitch case found for 'GAME_VERSION=RUBY', which was specified with the '-s' option",
+		},
+		{
+			input: `
+poryswitch(GAME_VERSION) {
+	_ { script MyScript { }
+	SAPPHIRE { script MyScript {} }
+}`,
+			expectedErrorMsg: "line 2: missing closing curly braces for poryswitch statement",
+		},
+		{
+			input: `
+poryswitch(GAME_VERSION) {
+	RUBY { script MyScript { foo( } }
+}`,
+			expectedErrorMsg: "line 3: missing closing parenthesis for command 'foo'",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l, CommandConfig{}, "", "", 0, map[string]string{"GAME_VERSION": "RUBY"})
+		_, err := p.ParseProgram()
+		if err == nil {
+			t.Fatalf("Expected error '%s', but no error occurred", tt.expectedErrorMsg)
+		}
+		if err.Error() != tt.expectedErrorMsg {
+			t.Fatalf("Expected error message '%s', but got '%s'", tt.expectedErrorMsg, err.Error())
+		}
+	}
+}
+
+func TestCompileTimeConditionals(t *testing.T) {
+	input := `
+#if VERSION == EMERALD && LANGUAGE != JAPANESE
+script VersionScript { emerald }
+#elif VERSION == RUBY || VERSION == SAPPHIRE
+script VersionScript { hoenn }
+#else
+script VersionScript { fallback }
+#endif
+
+script MyScript {
+	lock
+	poryswitch(VERSION) {
+		RUBY, SAPPHIRE: rs_command
+		EMERALD, 3 {
+			e_command
+		}
+	}
+#if !(VERSION == RUBY) && DEBUG
+	debug_command
+#endif
+	release
+}
+
+text MyText {
+	poryswitch(VERSION) {
+		RUBY, SAPPHIRE: "Hoenn"
+		_: "Other"
+	}
+}
+
+mart MyMart {
+	ITEM_POTION
+	poryswitch(VERSION) {
+		RUBY, SAPPHIRE: ITEM_RS
+		_ { ITEM_OTHER }
+	}
+#if LANGUAGE == JAPANESE
+	ITEM_JAPANESE
+	#if VERSION == EMERALD
+	ITEM_JAPANESE_EMERALD
+	#endif
+#endif
+	ITEM_FINAL
+}
+`
+	tests := []struct {
+		switches       map[string]string
+		versionCommand string
+		commands       []string
+		text           string
+		items          []string
+	}{
+		{
+			map[string]string{"VERSION": "EMERALD", "LANGUAGE": "ENGLISH"},
+			"emerald",
+			[]string{"lock", "e_command", "release"},
+			"Other$",
+			[]string{"ITEM_POTION", "ITEM_OTHER", "ITEM_FINAL"},
+		},
+		{
+			map[string]string{"VERSION": "EMERALD", "LANGUAGE": "JAPANESE", "DEBUG": "1"},
+			"fallback",
+			[]string{"lock", "e_command", "debug_command", "release"},
+			"Other$",
+			[]string{"ITEM_POTION", "ITEM_OTHER", "ITEM_JAPANESE", "ITEM_JAPANESE_EMERALD", "ITEM_FINAL"},
+		},
+		{
+			map[string]string{"VERSION": "RUBY", "LANGUAGE": "JAPANESE", "DEBUG": "1"},
+			"hoenn",
+			[]string{"lock", "rs_command", "release"},
+			"Hoenn$",
+			[]string{"ITEM_POTION", "ITEM_RS", "ITEM_JAPANESE", "ITEM_FINAL"},
+		},
+		{
+			map[string]string{"VERSION": "SAPPHIRE", "LANGUAGE": "ENGLISH", "DEBUG": "1"},
+			"hoenn",
+			[]string{"lock", "rs_command", "debug_command", "release"},
+			"Hoenn$",
+			[]string{"ITEM_POTION", "ITEM_RS", "ITEM_FINAL"},
+		},
+		{
+			map[string]string{"VERSION": "3", "LANGUAGE": "ENGLISH"},
+			"fallback",
+			[]string{"lock", "e_command", "release"},
+			"Other$",
+			[]string{"ITEM_POTION", "ITEM_OTHER", "ITEM_FINAL"},
+		},
+	}
+
+	for i, tt := range tests {
+		l := lexer.New(input)
+		p := New(l, CommandConfig{}, "../font_config.json", "", 0, tt.switches)
+		program, err := p.ParseProgram()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		versionScript := program.TopLevelStatements[0].(*ast.ScriptStatement)
+		if command := versionScript.Body.Statements[0].TokenLiteral(); command != tt.versionCommand {
+			t.Fatalf("Test %d: Incorrect version command. Expected %s, got %s", i, tt.versionCommand, command)
+		}
+		script := program.TopLevelStatements[1].(*ast.ScriptStatement)
+		if len(script.Body.Statements) != len(tt.commands) {
+			t.Fatalf("Test %d: Incorrect number of statements. Expected %d, got %d", i, len(tt.commands), len(script.Body.Statements))
+		}
+		for j, expectedCommand := range tt.commands {
+			if command := script.Body.Statements[j].TokenLiteral(); command != expectedCommand {
+				t.Fatalf("Test %d: Incorrect statement %d. Expected %s, got %s", i, j, expectedCommand, command)
+			}
+		}
+		text := program.TopLevelStatements[2].(*ast.TextStatement)
+		if text.Value != tt.text {
+			t.Fatalf("Test %d: Incorrect text. Expected %s, got %s", i, tt.text, text.Value)
+		}
+		mart := program.TopLevelStatements[3].(*ast.MartStatement)
+		if len(mart.Items) != len(tt.items) {
+			t.Fatalf("Test %d: Incorrect number of mart items. Expected %d, got %d", i, len(tt.items), len(mart.Items))
+		}
+		for j, expectedItem := range tt.items {
+			if mart.Items[j] != expectedItem {
+				t.Fatalf("Test %d: Incorrect mart item %d. Expected %s, got %s", i, j, expectedItem, mart.Items[j])
+			}
+		}
+	}
+}
+
+func TestCompileTimeConditionalErrors(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedErrorMsg string
+	}{
+		{
+			input: `
+#if VERSION == RUBY
+script MyScript {}`,
+			expectedErrorMsg: "line 2: missing '#endif' for '#if' directive",
+		},
+		{
+			input: `
+script MyScript {}
+#endif`,
+			expectedErrorMsg: "line 3: '#endif' directive without a matching '#if'",
+		},
+		{
+			input: `
+#if VERSION == RUBY
+#else
+#elif VERSION == SAPPHIRE
+#endif`,
+			expectedErrorMsg: "line 4: '#elif' directive can't come after '#else'",
+		},
+		{
+			input: `
+#if VERSION == RUBY
+#else
+#else
+#endif`,
+			expectedErrorMsg: "line 4: duplicate '#else' directive for '#if'",
+		},
+		{
+			input: `
+#if VERSION == RUBY
+#endif VERSION`,
+			expectedErrorMsg: "line 2: missing '#endif' for '#if' directive",
+		},
+		{
+			input: `
+#if
+#endif`,
+			expectedErrorMsg: "line 3: '#endif' directive without a matching '#if'",
+		},
+		{
+			input: `
+#if LANGUAGE == ENGLISH
+#endif`,
+			expectedErrorMsg: "line 2: no compile switch for 'LANGUAGE' was specified with the '-s' option",
+		},
+		{
+			input: `
+#if (VERSION == RUBY
+#endif`,
+			expectedErrorMsg: "line 3: '#endif' directive without a matching '#if'",
+		},
+		{
+			input: `
+script MyScript {
+	poryswitch(VERSION) {
+		RUBY, {}: foo
+	}
+}`,
+			expectedErrorMsg: "line 4: invalid poryswitch case '{'. Expected a simple identifier",
+		},
+		{
+			input: `
+script MyScript {
+#if VERSION == RUBY
+	foo(
+#endif
+}`,
+			expectedErrorMsg: "line 4: missing closing parenthesis for command 'foo'",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l, CommandConfig{}, "", "", 0, map[string]string{"VERSION": "RUBY"})
+		_, err := p.ParseProgram()
+		if err == nil {
+			t.Fatalf("Expected error '%s', but no error occurred", tt.expectedErrorMsg)
+		}
+		if err.Error() != tt.expectedErrorMsg {
+			t.Fatalf("Expected error message '%s', but got '%s'", tt.expectedErrorMsg, err.Error())
+		}
+	}
+}
+
+func TestSwitchDefaults(t *testing.T) {
+	input := `
+switch_default VERSION = EMERALD
+#if !LANGUAGE
+switch_default LANGUAGE = ENGLISH
+#endif
+
+#if VERSION == EMERALD && LANGUAGE == ENGLISH
+script VersionScript { emerald_english }
+#else
+script VersionScript { other }
+#endif
+
+script MyScript {
+	poryswitch(VERSION) {
+		RUBY: ruby
+		EMERALD: emerald
+	}
+	poryswitch(LANGUAGE) {
+		ENGLISH: english
+		GERMAN: german
+	}
+}
+`
+	tests := []struct {
+		switches map[string]string
+		commands []string
+	}{
+		{nil, []string{"emerald_english", "emerald", "english"}},
+		{map[string]string{"VERSION": "RUBY"}, []string{"other", "ruby", "english"}},
+		{map[string]string{"LANGUAGE": "GERMAN"}, []string{"other", "emerald", "german"}},
+	}
+
+	for i, tt := range tests {
+		l := lexer.New(input)
+		p := New(l, CommandConfig{}, "", "", 0, tt.switches)
+		program, err := p.ParseProgram()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		versionScript := program.TopLevelStatements[0].(*ast.ScriptStatement)
+		script := program.TopLevelStatements[1].(*ast.ScriptStatement)
+		commands := []string{versionScript.Body.Statements[0].TokenLiteral()}
+		for _, stmt := range script.Body.Statements {
+			commands = append(commands, stmt.TokenLiteral())
+		}
+		if len(commands) != len(tt.commands) {
+			t.Fatalf("Test %d: Incorrect number of commands. Expected %d, got %d", i, len(tt.commands), len(commands))
+		}
+		for j, expectedCommand := range tt.commands {
+			if commands[j] != expectedCommand {
+				t.Fatalf("Test %d: Incorrect command %d. Expected %s, got %s", i, j, expectedCommand, commands[j])
+			}
+		}
+	}
+}
+
+func TestSwitchDefaultErrors(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedErrorMsg string
+	}{
+		{
+			input: `
+switch_default VERSION = RUBY
+switch_default VERSION = SAPPHIRE`,
+			expectedErrorMsg: "line 3: duplicate switch_default for compile switch 'VERSION'",
+		},
+		{
+			input: `
+switch_default = RUBY`,
+			expectedErrorMsg: "line 2: expected compile switch name after 'switch_default', but got '=' instead",
+		},
+		{
+			input: `
+switch_default VERSION RUBY`,
+			expectedErrorMsg: "line 2: missing '=' after switch_default 'VERSION'. Got 'RUBY' instead",
+		},
+		{
+			input: `
+switch_default VERSION = "RUBY"`,
+			expectedErrorMsg: "line 2: expected default value for compile switch 'VERSION', but got 'RUBY' instead",
+		},
+		{
+			input: `
+script MyScript {
+	switch_default VERSION = RUBY
+}`,
+			expectedErrorMsg: "line 3: switch_default can only be used at the top level",
+		},
+		{
+			input: `
+switch_default VERSION = RUBY
+poryswitch(VERSION) {
+	RUBY {
+		switch_default LANGUAGE = ENGLISH
+	}
+}`,
+			expectedErrorMsg: "line 5: switch_default can't be used inside a poryswitch statement",
+		},
+		{
+			input: `
+script MyScript {
+	poryswitch(VERSION) {
+		RUBY: foo
+	}
+}`,
+			expectedErrorMsg: "line 3: poryswitch used, but no compile switches were specified with the '-s' option",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l, CommandConfig{}, "", "", 0, nil)
+		_, err := p.ParseProgram()
+		if err == nil {
+			t.Fatalf("Expected error '%s', but no error occurred", tt.expectedErrorMsg)
+		}
+		if err.Error() != tt.expectedErrorMsg {
+			t.Fatalf("Expected error message '%s', but got '%s'", tt.expectedErrorMsg, err.Error())
+		}
+	}
+}
+
+func TestSwitchReferences(t *testing.T) {
+	input := `
+script MyScript {
+	poryswitch(VERSION) {
+		RUBY, SAPPHIRE: foo
+		_: bar
+	}
+#if LANGUAGE == GERMAN || DEBUG
+	baz
+#endif
+}
+`
+	l := lexer.New(input)
+	p := New(l, CommandConfig{}, "", "", 0, map[string]string{"VERSION": "RUBY", "LANGUAGE": "ENGLISH"})
+	_, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := []struct {
+		switchName string
+		value      string
+		line       int
+	}{
+		{"VERSION", "", 3},
+		{"VERSION", "RUBY", 4},
+		{"VERSION", "SAPPHIRE", 4},
+		{"LANGUAGE", "GERMAN", 7},
+		{"DEBUG", "", 7},
+	}
+	references := p.SwitchReferences()
+	if len(references) != len(expected) {
+		t.Fatalf("Incorrect number of switch references. Expected %d, got %d", len(expected), len(references))
+	}
+	for i, tt := range expected {
+		ref := references[i]
+		if ref.Switch != tt.switchName || ref.Value != tt.value || ref.Token.LineNumber != tt.line {
+			t.Fatalf("Incorrect switch reference %d. Expected %s=%s on line %d, got %s=%s on line %d", i, tt.switchName, tt.value, tt.line, ref.Switch, ref.Value, ref.Token.LineNumber)
+		}
+	}
+}
+
 func TestRawStatements(t *testing.T) {
 	input := `
 raw ` + "`" + `
@@ -1135,48 +1644,1003 @@ script Script1 {
 
 mapscripts MyMapScript {
 	MAP_SCRIPT_ON_FRAME_TABLE [
-		PROF_ELM, FOO: MyOnFrameScript
+		PROF_ELM, FOO: MyOnFrameScript
+	]
+}
+`
+	l := lexer.New(input)
+	p := New(l, CommandConfig{}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	script := program.TopLevelStatements[0].(*ast.ScriptStatement)
+	command1 := script.Body.Statements[0].(*ast.CommandStatement)
+	command2 := script.Body.Statements[1].(*ast.CommandStatement)
+	command3 := script.Body.Statements[2].(*ast.CommandStatement)
+	testConstant(t, "2", command1.Args[0])
+	testConstant(t, "2 + FLAG_TEMP_1 + 3 - FLAG_BASE", command2.Args[1])
+	testConstant(t, "( 2 + 1 - 1 ) - ( ( 2 + 1 + 2 ) )", command3.Args[1])
+
+	if1 := script.Body.Statements[3].(*ast.IfStatement)
+	op1 := if1.Consequence.Expression.(*ast.OperatorExpression)
+	testConstant(t, "2 + 1 - 1", op1.Operand.Literal)
+
+	if2 := script.Body.Statements[4].(*ast.IfStatement)
+	op2 := if2.Consequence.Expression.(*ast.OperatorExpression)
+	testConstant(t, "2 + 1", op2.Operand.Literal)
+	testConstant(t, "2 + 1 - 1 + 1", op2.ComparisonValue)
+
+	sw := script.Body.Statements[5].(*ast.SwitchStatement)
+	testConstant(t, "2 + 1 - 1", sw.Operand.Literal)
+	testConstant(t, "2", sw.Cases[0].Value.Literal)
+
+	ms := program.TopLevelStatements[1].(*ast.MapScriptsStatement)
+	frame := ms.TableMapScripts[0].Entries[0]
+	testConstant(t, "2 + 1 - 1", frame.Condition.Literal)
+	testConstant(t, "2", frame.Comparison)
+}
+
+func TestDefinedConstants(t *testing.T) {
+	input := `
+const MAX_BADGES = 8
+const BONUS = MAX_BADGES + 1
+
+script MyScript {
+	foo(MAX_BADGES, BONUS, LEVEL)
+}
+`
+	tests := []struct {
+		policy           ConstOverridePolicy
+		expectedArgs     []string
+		expectedErrorMsg string
+	}{
+		{ConstOverrideError, nil, "line 2: const 'MAX_BADGES' was already defined with the '-D' option"},
+		{ConstOverrideKeepDefined, []string{"16", "16 + 1", "50"}, ""},
+		{ConstOverrideAllow, []string{"8", "8 + 1", "50"}, ""},
+	}
+
+	for i, tt := range tests {
+		l := lexer.New(input)
+		p := New(l, CommandConfig{}, "", "", 0, nil)
+		p.DefineConstants(map[string]string{"MAX_BADGES": "16", "LEVEL": "50"}, tt.policy)
+		program, err := p.ParseProgram()
+		if tt.expectedErrorMsg != "" {
+			if err == nil || err.Error() != tt.expectedErrorMsg {
+				t.Fatalf("Test %d: Expected error message '%s', but got '%v'", i, tt.expectedErrorMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		command := program.TopLevelStatements[0].(*ast.ScriptStatement).Body.Statements[0].(*ast.CommandStatement)
+		for j, expectedArg := range tt.expectedArgs {
+			testConstant(t, expectedArg, command.Args[j])
+		}
+	}
+
+	l := lexer.New(`
+const MAX_BADGES = 8
+const MAX_BADGES = 9`)
+	p := New(l, CommandConfig{}, "", "", 0, nil)
+	p.DefineConstants(map[string]string{"MAX_BADGES": "16"}, ConstOverrideAllow)
+	_, err := p.ParseProgram()
+	expectedErrorMsg := "line 3: duplicate const 'MAX_BADGES'. Must use unique const names"
+	if err == nil || err.Error() != expectedErrorMsg {
+		t.Fatalf("Expected error message '%s', but got '%v'", expectedErrorMsg, err)
+	}
+}
+
+func TestHeaderConstants(t *testing.T) {
+	headers := cheader.New()
+	headers.Parse(`
+#define ITEM_NONE 0
+#define ITEM_POTION 13
+#define ITEM_SUPER_POTION (ITEM_POTION + 1)
+`, "items.h")
+
+	tests := []struct {
+		input            string
+		expectedErrorMsg string
+		expectedWarning  string
+	}{
+		{
+			input: `
+script MyScript {
+	switch (var(VAR_ITEM)) {
+		case ITEM_POTION: foo
+		case ITEM_SUPER_POTION: bar
+		case UNKNOWN_ITEM: baz
+		case 15: qux
+	}
+}`,
+		},
+		{
+			input: `
+script MyScript {
+	switch (var(VAR_ITEM)) {
+		case ITEM_SUPER_POTION: foo
+		case 14: bar
+	}
+}`,
+			expectedWarning: "switch case '14' has the same value as case 'ITEM_SUPER_POTION' (14), so it's never reached",
+		},
+		{
+			input: `
+const BASE = ITEM_POTION
+script MyScript {
+	switch (var(VAR_ITEM)) {
+		case BASE + 1: foo
+		case ITEM_SUPER_POTION: bar
+	}
+}`,
+			expectedWarning: "switch case 'ITEM_SUPER_POTION' has the same value as case 'ITEM_POTION + 1' (14), so it's never reached",
+		},
+		{
+			input: `
+const ITEM_POTION = 5`,
+			expectedErrorMsg: "line 2: const 'ITEM_POTION' is already defined in C header 'items.h' on line 3",
+		},
+	}
+
+	for i, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l, CommandConfig{}, "", "", 0, nil)
+		p.SetHeaderConstants(headers)
+		program, err := p.ParseProgram()
+		if tt.expectedErrorMsg == "" {
+			if err != nil {
+				t.Fatalf("Test %d: %s", i, err.Error())
+			}
+			if tt.expectedWarning == "" && len(program.Warnings) > 0 {
+				t.Fatalf("Test %d: Expected no warnings, but got '%s'", i, program.Warnings[0].Message)
+			}
+			if tt.expectedWarning != "" && (len(program.Warnings) != 1 || program.Warnings[0].Message != tt.expectedWarning) {
+				t.Fatalf("Test %d: Expected warning '%s', but got %v", i, tt.expectedWarning, program.Warnings)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.expectedErrorMsg {
+			t.Fatalf("Test %d: Expected error message '%s', but got '%v'", i, tt.expectedErrorMsg, err)
+		}
+	}
+}
+
+func TestUndefinedSymbols(t *testing.T) {
+	headers := cheader.New()
+	headers.Parse(`
+#define FLAG_BADGE01_GET 0x807
+#define FLAG_BADGE02_GET 0x808
+#define VAR_RESULT 0x800D
+#define FLAG_HIDE_RIVAL (FLAG_HIDDEN_ITEMS_START + 1)
+`, "flags.h")
+	symbols := SymbolConfig{
+		Symbols:   []string{"ITEM_POTION", "ITEM_ANTIDOTE", "TRAINER_ROXANNE_1"},
+		Movements: []string{"walk_up", "walk_down", "step_end"},
+	}
+	commandConfig := CommandConfig{TempVars: []string{"VAR_TEMP_0"}}
+
+	tests := []struct {
+		input            string
+		expectedErrorMsg string
+	}{
+		{
+			input: `
+const FLAG_CUSTOM = FLAG_BADGE01_GET
+script MyScript {
+	let counter: var
+	if (flag(FLAG_BADGE02_GET) && !flag(FLAG_CUSTOM) && var(counter) == 1 && defeated(TRAINER_ROXANNE_1)) {
+		foo
+	}
+	switch (var(VAR_RESULT)) {
+		case 0: bar
+	}
+}
+mart MyMart {
+	ITEM_POTION
+	ITEM_ANTIDOTE
+}
+movement MyMovement {
+	walk_up * 2
+	walk_down
+	step_end
+}`,
+		},
+		{
+			// FLAG_HIDDEN_ITEMS_START is defined in a header that wasn't read,
+			// but FLAG_HIDE_RIVAL is still a known symbol.
+			input: `
+script MyScript {
+	if (flag(FLAG_HIDE_RIVAL)) {
+		foo
+	}
+}`,
+		},
+		{
+			input: `
+script MyScript {
+	if (flag(FLAG_BADGE01GET)) {
+		foo
+	}
+}`,
+			expectedErrorMsg: "line 3: undefined symbol 'FLAG_BADGE01GET'. Did you mean 'FLAG_BADGE01_GET'?",
+		},
+		{
+			input: `
+script MyScript {
+	if (var(VAR_RESULT + VAR_UNKNOWN) == 1) {
+		foo
+	}
+}`,
+			expectedErrorMsg: "line 3: undefined symbol 'VAR_UNKNOWN'",
+		},
+		{
+			input: `
+script MyScript {
+	if (defeated(TRAINER_ROXANE_1)) {
+		foo
+	}
+}`,
+			expectedErrorMsg: "line 3: undefined symbol 'TRAINER_ROXANE_1'. Did you mean 'TRAINER_ROXANNE_1'?",
+		},
+		{
+			input: `
+script MyScript {
+	switch (var(VAR_RESULTS)) {
+		case 0: bar
+	}
+}`,
+			expectedErrorMsg: "line 3: undefined symbol 'VAR_RESULTS'. Did you mean 'VAR_RESULT'?",
+		},
+		{
+			input: `
+mart MyMart {
+	ITEM_POTION
+	ITEM_ANTIDOT
+}`,
+			expectedErrorMsg: "line 4: undefined symbol 'ITEM_ANTIDOT'. Did you mean 'ITEM_ANTIDOTE'?",
+		},
+		{
+			input: `
+script MyScript {
+	applymovement(OBJ_EVENT_ID_PLAYER, moves(walk_up, walk_dwn))
+}`,
+			expectedErrorMsg: "line 3: undefined movement command 'walk_dwn'. Did you mean 'walk_down'?",
+		},
+		{
+			input: `
+movement MyMovement {
+	jump_in_place
+}`,
+			expectedErrorMsg: "line 3: undefined movement command 'jump_in_place'",
+		},
+	}
+
+	for i, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l, commandConfig, "", "", 0, nil)
+		p.SetKnownSymbols(symbols, UndefinedSymbolsError)
+		p.SetHeaderConstants(headers)
+		_, err := p.ParseProgram()
+		if tt.expectedErrorMsg == "" {
+			if err != nil {
+				t.Fatalf("Test %d: %s", i, err.Error())
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.expectedErrorMsg {
+			t.Fatalf("Test %d: Expected error message '%s', but got '%v'", i, tt.expectedErrorMsg, err)
+		}
+	}
+
+	// Undefined symbols are warnings by default.
+	input := `
+script MyScript {
+	if (flag(FLAG_BADGE03_GET)) {
+		applymovement(OBJ_EVENT_ID_PLAYER, moves(walk_left))
+	}
+}`
+	p := New(lexer.New(input), commandConfig, "", "", 0, nil)
+	p.SetHeaderConstants(headers)
+	p.SetKnownSymbols(symbols, UndefinedSymbolsWarn)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectedWarnings := []string{
+		"undefined symbol 'FLAG_BADGE03_GET'. Did you mean 'FLAG_BADGE01_GET'?",
+		"undefined movement command 'walk_left'",
+	}
+	if len(program.Warnings) != len(expectedWarnings) {
+		t.Fatalf("Incorrect number of warnings. Expected %d, got %d: %v", len(expectedWarnings), len(program.Warnings), program.Warnings)
+	}
+	for i, warning := range program.Warnings {
+		if warning.Type != ast.WarningUndefinedSymbol || warning.Message != expectedWarnings[i] {
+			t.Errorf("Incorrect warning %d. Expected '%s', got '%s'", i, expectedWarnings[i], warning.Message)
+		}
+	}
+	if program.Warnings[0].LineNumberStart != 3 || program.Warnings[0].CharStart != 10 {
+		t.Errorf("Incorrect position for warning. Expected line 3, char 10, got line %d, char %d", program.Warnings[0].LineNumberStart, program.Warnings[0].CharStart)
+	}
+}
+
+func TestCommandSignatures(t *testing.T) {
+	commandConfig := CommandConfig{
+		TempVars:  []string{"VAR_TEMP_0"},
+		TempFlags: []string{"FLAG_TEMP_1"},
+		Commands: map[string]CommandSignature{
+			"setflag":       {Params: []CommandParam{{Name: "flag", Kind: "flag"}}},
+			"setvar":        {Params: []CommandParam{{Name: "destination", Kind: "var"}, {Name: "value", Kind: "int"}}},
+			"goto":          {Params: []CommandParam{{Name: "destination", Kind: "label"}}},
+			"msgbox":        {Params: []CommandParam{{Name: "text", Kind: "text"}, {Name: "type", Kind: "int", Optional: true}}},
+			"applymovement": {Params: []CommandParam{{Name: "localId", Kind: "int"}, {Name: "movements", Kind: "movement"}}},
+			"end":           {},
+			"giveitem_std":  {Params: []CommandParam{{Name: "item"}}, Deprecated: true, Replacement: "giveitem"},
+			"special":       {Params: []CommandParam{{Name: "function", Kind: "function"}}},
+		},
+		KnownCommands: []string{"lock", "faceplayer", "release", "end"},
+	}
+
+	tests := []struct {
+		input            string
+		strict           bool
+		expectedErrorMsg string
+	}{
+		{
+			input: `
+script MyScript {
+	let counter: var
+	let talked: flag
+	setflag(FLAG_BASE + 1)
+	setflag(talked)
+	setvar(counter, counter)
+	setvar(VAR_TEMP_1, (2 + 3) * 4)
+	goto(MyScript)
+	goto({ end })
+	msgbox("Hello")
+	msgbox(ascii"Hello", MSGBOX_DEFAULT)
+	msgbox(MyText)
+	applymovement(OBJ_EVENT_ID_PLAYER, moves(walk_up))
+	unknowncommand(1, "foo")
+	MyOtherScript(5)
+	end
+}
+script MyOtherScript {
+	end
+}`,
+		},
+		{
+			input: `
+script MyScript {
+	setflag(FLAG_1, FLAG_2)
+}`,
+			expectedErrorMsg: "line 3: command 'setflag' expects 1 argument, but got 2",
+		},
+		{
+			input: `
+script MyScript {
+	msgbox
+}`,
+			expectedErrorMsg: "line 3: command 'msgbox' expects 1 to 2 arguments, but got 0",
+		},
+		{
+			input: `
+script MyScript {
+	end(1)
+}`,
+			expectedErrorMsg: "line 3: command 'end' expects 0 arguments, but got 1",
+		},
+		{
+			input: `
+script MyScript {
+	setflag("FLAG_1")
+}`,
+			expectedErrorMsg: "line 3: command 'setflag' expects a flag for parameter 'flag', but got a string",
+		},
+		{
+			input: `
+script MyScript {
+	let counter: var
+	setflag(counter)
+}`,
+			expectedErrorMsg: "line 4: command 'setflag' expects a flag for parameter 'flag', but got local var 'counter'",
+		},
+		{
+			input: `
+script MyScript {
+	let talked: flag
+	setvar(VAR_TEMP_1, talked)
+}`,
+			expectedErrorMsg: "line 4: command 'setvar' expects an integer for parameter 'value', but got local flag 'talked'",
+		},
+		{
+			input: `
+script MyScript {
+	goto(5)
+}`,
+			expectedErrorMsg: "line 3: command 'goto' expects a label for parameter 'destination', but got '5'",
+		},
+		{
+			input: `
+script MyScript {
+	msgbox(moves(walk_up), MSGBOX_DEFAULT)
+}`,
+			expectedErrorMsg: "line 3: command 'msgbox' expects text for parameter 'text', but got moves()",
+		},
+		{
+			input: `
+script MyScript {
+	applymovement(OBJ_EVENT_ID_PLAYER,
+		"walk_up")
+}`,
+			expectedErrorMsg: "line 4: command 'applymovement' expects movement for parameter 'movements', but got a string",
+		},
+		{
+			input: `
+script MyScript {
+	special(DoSomething)
+}`,
+			expectedErrorMsg: "line 3: unknown kind 'function' for parameter 'function' of command 'special' in the command config",
+		},
+		{
+			input: `
+script MyScript {
+	msgbox("Hello")
+	setflg(FLAG_1)
+}`,
+			strict:           true,
+			expectedErrorMsg: "line 4: unknown command 'setflg'. Did you mean 'setflag'?",
+		},
+		{
+			input: `
+script MyScript {
+	lock
+	faceplyer
+}`,
+			strict:           true,
+			expectedErrorMsg: "line 4: unknown command 'faceplyer'. Did you mean 'faceplayer'?",
+		},
+		{
+			input: `
+script MyScript {
+	lock
+	faceplayer
+	msgbox("Hello")
+	release
+	end
+}`,
+			strict: true,
+		},
+		{
+			input: `
+script MyScript {
+	MyOtherScript
+	if (yesno("Save?")) {
+		end
+	}
+}
+script MyOtherScript {
+	end
+}`,
+			strict: true,
+		},
+	}
+
+	for i, tt := range tests {
+		l := lexer.New(tt.input)
+		config := commandConfig
+		config.ConditionCommands = map[string]ConditionCommand{"yesno": {Command: "msgbox", Args: []string{"MSGBOX_YESNO"}, VarName: "VAR_RESULT", Value: "YES"}}
+		p := New(l, config, "", "", 0, nil)
+		p.SetStrictCommands(tt.strict)
+		_, err := p.ParseProgram()
+		if tt.expectedErrorMsg == "" {
+			if err != nil {
+				t.Fatalf("Test %d: %s", i, err.Error())
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.expectedErrorMsg {
+			t.Fatalf("Test %d: Expected error message '%s', but got '%v'", i, tt.expectedErrorMsg, err)
+		}
+	}
+
+	input := `
+script MyScript {
+	giveitem_std(ITEM_POTION)
+}`
+	p := New(lexer.New(input), commandConfig, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(program.Warnings) != 1 {
+		t.Fatalf("Expected 1 warning, but got %d", len(program.Warnings))
+	}
+	warning := program.Warnings[0]
+	if warning.Type != ast.WarningDeprecatedCommand || warning.LineNumberStart != 3 || warning.Message != "command 'giveitem_std' is deprecated. Use 'giveitem' instead" {
+		t.Errorf("Incorrect warning. Got line %d: %s", warning.LineNumberStart, warning.Message)
+	}
+}
+
+func TestExampleCommandSignatures(t *testing.T) {
+	bytes, err := ioutil.ReadFile("../command_signatures.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commandConfig CommandConfig
+	if err := json.Unmarshal(bytes, &commandConfig); err != nil {
+		t.Fatal(err)
+	}
+	input := `
+script MyScript {
+	setflag("Hello")
+}`
+	l := lexer.New(input)
+	p := New(l, commandConfig, "", "", 0, nil)
+	_, err = p.ParseProgram()
+	if err == nil || err.Error() != "line 3: command 'setflag' expects a flag for parameter 'flag', but got a string" {
+		t.Fatalf("Expected the example signatures to check 'setflag', but got: %v", err)
+	}
+}
+
+func TestStrictCommandsWithDefaultConfig(t *testing.T) {
+	bytes, err := ioutil.ReadFile("../command_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commandConfig CommandConfig
+	if err := json.Unmarshal(bytes, &commandConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(commandConfig.Commands) != 0 {
+		t.Fatalf("Expected the default command config to have no command signatures, but got %d", len(commandConfig.Commands))
+	}
+	input := `
+mapscripts MyMap_MapScripts {
+	MAP_SCRIPT_ON_TRANSITION {
+		setflag(FLAG_TEMP_1)
+		call_if_set(FLAG_HIDE_RIVAL, MyScript_HideRival)
+	}
+}
+script MyScript {
+	lock
+	faceplayer
+	if (!flag(FLAG_RECEIVED_POTION)) {
+		msgbox("Take this!")
+		giveitem(ITEM_POTION)
+		setflag(FLAG_RECEIVED_POTION)
+	}
+	checkitem(ITEM_POTION)
+	if (var(VAR_RESULT) == TRUE) {
+		trainerbattle_single(TRAINER_RIVAL, MyText, MyText)
+	}
+	applymovement(OBJ_EVENT_ID_PLAYER, moves(walk_up))
+	waitmovement(0)
+	playse(SE_DOOR)
+	delay(30)
+	release
+	end
+}
+script MyScript_HideRival {
+	setflag(FLAG_HIDE_RIVAL)
+	return
+}
+text MyText {
+	"Hello!"
+}`
+	l := lexer.New(input)
+	p := New(l, commandConfig, "", "", 0, nil)
+	p.SetStrictCommands(true)
+	if _, err := p.ParseProgram(); err != nil {
+		t.Fatalf("Expected the default command config to pass -strict-commands, but got: %s", err.Error())
+	}
+}
+
+func TestSymbolKinds(t *testing.T) {
+	commandConfig := CommandConfig{
+		SymbolPrefixes: map[string]string{
+			"FLAG_":    "flag",
+			"VAR_":     "var",
+			"TRAINER_": "trainer",
+			"ITEM_":    "item",
+			"ITEM_PC_": "pc_item",
+		},
+		Commands: map[string]CommandSignature{
+			"setflag":  {Params: []CommandParam{{Name: "flag", Kind: "flag"}}},
+			"setvar":   {Params: []CommandParam{{Name: "destination", Kind: "var"}, {Name: "value", Kind: "int"}}},
+			"giveitem": {Params: []CommandParam{{Name: "item", Kind: "item"}, {Name: "amount", Kind: "int", Optional: true}}},
+		},
+	}
+	input := `
+const MY_FLAG = VAR_TEMP_2
+script MyScript {
+	if (flag(FLAG_BADGE01_GET) && var(VAR_RESULT) == 1 && defeated(TRAINER_ROXANNE_1)) {
+		setflag(FLAG_TEMP_1)
+		setvar(VAR_TEMP_1, FLAG_TEMP_1)
+		giveitem(ITEM_POTION, 2)
+	}
+	if (flag(VAR_TEMP_1) || var(FLAG_TEMP_1 + 1) || defeated(FLAG_1)) {
+		setflag(VAR_TEMP_1)
+		setflag(MY_FLAG)
+		giveitem(TRAINER_ROXANNE_1)
+		giveitem(ITEM_PC_POTION)
+	}
+	switch (var(FLAG_TEMP_1)) {
+		case 0: end
+	}
+}`
+	p := New(lexer.New(input), commandConfig, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectedWarnings := []struct {
+		line    int
+		message string
+	}{
+		{9, "'VAR_TEMP_1' is a var, but flag() expects a flag"},
+		{9, "'FLAG_TEMP_1' is a flag, but var() expects a var"},
+		{9, "'FLAG_1' is a flag, but defeated() expects a trainer"},
+		{15, "'FLAG_TEMP_1' is a flag, but var() expects a var"},
+		{10, "'VAR_TEMP_1' is a var, but parameter 'flag' of command 'setflag' expects a flag"},
+		{11, "'MY_FLAG' is a var ('VAR_TEMP_2'), but parameter 'flag' of command 'setflag' expects a flag"},
+		{12, "'TRAINER_ROXANNE_1' is a trainer, but parameter 'item' of command 'giveitem' expects an item"},
+		{13, "'ITEM_PC_POTION' is a pc_item, but parameter 'item' of command 'giveitem' expects an item"},
+	}
+	if len(program.Warnings) != len(expectedWarnings) {
+		t.Fatalf("Incorrect number of warnings. Expected %d, got %d: %v", len(expectedWarnings), len(program.Warnings), program.Warnings)
+	}
+	for i, warning := range program.Warnings {
+		expected := expectedWarnings[i]
+		if warning.Type != ast.WarningSymbolKindMismatch || warning.LineNumberStart != expected.line || warning.Message != expected.message {
+			t.Errorf("Incorrect warning %d. Expected line %d: %s, got line %d: %s", i, expected.line, expected.message, warning.LineNumberStart, warning.Message)
+		}
+	}
+
+	input = `
+script MyScript {
+	giveitem("Potion")
+}`
+	p = New(lexer.New(input), commandConfig, "", "", 0, nil)
+	_, err = p.ParseProgram()
+	expectedErrorMsg := "line 3: command 'giveitem' expects an item for parameter 'item', but got a string"
+	if err == nil || err.Error() != expectedErrorMsg {
+		t.Fatalf("Expected error message '%s', but got '%v'", expectedErrorMsg, err)
+	}
+}
+
+func TestMovementCatalogue(t *testing.T) {
+	catalogue := movement.New()
+	catalogue.ParseMacros(`
+	create_movement_action walk_up, MOVEMENT_ACTION_WALK_NORMAL_UP
+	create_movement_action walk_right, MOVEMENT_ACTION_WALK_NORMAL_RIGHT
+	create_movement_action step_end, MOVEMENT_ACTION_STEP_END
+	create_movement_action step_stop, MOVEMENT_ACTION_STEP_END
+`)
+	catalogue.Add(movement.Command{Name: "step_stop", Frames: -1, Terminator: true})
+
+	input := `
+script MyScript {
+	applymovement(1, moves(walk_up * 2, walk_rigth))
+	applymovement(1, moves(walk_up, step_stop, walk_right))
+}
+movement MyMovement {
+	walk_up
+	step_end * 2
+}
+movement MyOtherMovement {
+	walk_up step_end
+}`
+	p := New(lexer.New(input), CommandConfig{}, "", "", 0, nil)
+	p.SetMovementCatalogue(catalogue)
+	p.SetKnownSymbols(SymbolConfig{}, UndefinedSymbolsWarn)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectedWarnings := []struct {
+		warningType ast.WarningType
+		line        int
+		message     string
+	}{
+		{ast.WarningUndefinedSymbol, 3, "undefined movement command 'walk_rigth'. Did you mean 'walk_right'?"},
+		{ast.WarningUnreachableCode, 4, "unreachable movement command 'walk_right'. The movement ends at the 'step_stop' command on line 4"},
+		{ast.WarningUnreachableCode, 8, "unreachable movement command 'step_end'. The movement ends at the 'step_end' command on line 8"},
+	}
+	if len(program.Warnings) != len(expectedWarnings) {
+		t.Fatalf("Incorrect number of warnings. Expected %d, got %d: %v", len(expectedWarnings), len(program.Warnings), program.Warnings)
+	}
+	for i, warning := range program.Warnings {
+		expected := expectedWarnings[i]
+		if warning.Type != expected.warningType || warning.LineNumberStart != expected.line || warning.Message != expected.message {
+			t.Errorf("Incorrect warning %d. Expected line %d: %s, got line %d: %s", i, expected.line, expected.message, warning.LineNumberStart, warning.Message)
+		}
+	}
+}
+
+func testConstant(t *testing.T, expected, actual string) {
+	if actual != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, actual)
+	}
+}
+
+func TestLocalVariables(t *testing.T) {
+	input := `
+script Caller {
+	let counter: var
+	let result: var
+	setvar(counter, 0)
+	setvar(VAR_TEMP_2, 1)
+	while (var(counter) < 3) {
+		call(Callee)
+		addvar(counter, 1)
+	}
+	if (var(result) == counter) {}
+	switch (var(result)) {
+		case 1: end
+	}
+}
+
+script Callee {
+	let count: var
+	setvar(count, counter)
+}
+
+script Unrelated {
+	let first: var
+	let second: var
+	copyvar(first, second)
+}
+`
+	l := lexer.New(input)
+	p := New(l, CommandConfig{
+		TempVars: []string{"VAR_TEMP_0", "VAR_TEMP_1", "VAR_TEMP_2", "VAR_TEMP_3", "VAR_TEMP_4"},
+	}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	caller := program.TopLevelStatements[0].(*ast.ScriptStatement)
+	testConstant(t, "VAR_TEMP_0", caller.Locals[0].Value)
+	testConstant(t, "VAR_TEMP_1", caller.Locals[1].Value)
+	testConstant(t, "VAR_TEMP_0", caller.Body.Statements[0].(*ast.CommandStatement).Args[0])
+	testConstant(t, "VAR_TEMP_2", caller.Body.Statements[1].(*ast.CommandStatement).Args[0])
+	while := caller.Body.Statements[2].(*ast.WhileStatement)
+	testConstant(t, "VAR_TEMP_0", while.Consequence.Expression.(*ast.OperatorExpression).Operand.Literal)
+	testConstant(t, "VAR_TEMP_0", while.Consequence.Body.Statements[1].(*ast.CommandStatement).Args[0])
+	ifStmt := caller.Body.Statements[3].(*ast.IfStatement)
+	op := ifStmt.Consequence.Expression.(*ast.OperatorExpression)
+	testConstant(t, "VAR_TEMP_1", op.Operand.Literal)
+	testConstant(t, "VAR_TEMP_0", op.ComparisonValue)
+	testConstant(t, "VAR_TEMP_1", caller.Body.Statements[4].(*ast.SwitchStatement).Operand.Literal)
+
+	// The callee's locals can't overlap with the caller's locals, or with the
+	// temp var that the caller uses directly. Locals are only visible inside
+	// the script that declares them.
+	callee := program.TopLevelStatements[1].(*ast.ScriptStatement)
+	testConstant(t, "VAR_TEMP_3", callee.Locals[0].Value)
+	testConstant(t, "VAR_TEMP_3", callee.Body.Statements[0].(*ast.CommandStatement).Args[0])
+	testConstant(t, "counter", callee.Body.Statements[0].(*ast.CommandStatement).Args[1])
+
+	// Scripts that aren't in the same call chain can share temp vars.
+	unrelated := program.TopLevelStatements[2].(*ast.ScriptStatement)
+	testConstant(t, "VAR_TEMP_0 , VAR_TEMP_1", fmt.Sprintf("%s , %s", unrelated.Locals[0].Value, unrelated.Locals[1].Value))
+	testConstant(t, "VAR_TEMP_0", unrelated.Body.Statements[0].(*ast.CommandStatement).Args[0])
+	testConstant(t, "VAR_TEMP_1", unrelated.Body.Statements[0].(*ast.CommandStatement).Args[1])
+}
+
+func TestContextualKeywordsAsIdentifiers(t *testing.T) {
+	input := `
+script let {
+	let count: var
+	setvar(count, 1)
+	call(let)
+}
+
+script MyScript {
+	menu(1, 2)
+	msgbox(menu)
+template:
+	goto(template)
+}
+
+text menu {
+	"Menu"
+}
+
+const COUNT = 2
+template npc {
+	prologue: lock;
+	epilogue: release, end
+}
+
+script(npc) template {}
+
+script switch_default {
+	goto(switch_default)
+}
+`
+	l := lexer.New(input)
+	p := New(l, CommandConfig{
+		TempVars: []string{"VAR_TEMP_0"},
+	}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	letScript := program.TopLevelStatements[0].(*ast.ScriptStatement)
+	testConstant(t, "let", letScript.Name.Value)
+	testConstant(t, "count", letScript.Locals[0].Name.Value)
+	testConstant(t, "VAR_TEMP_0", letScript.Body.Statements[0].(*ast.CommandStatement).Args[0])
+	testConstant(t, "let", letScript.Body.Statements[1].(*ast.CommandStatement).Args[0])
+
+	myScript := program.TopLevelStatements[1].(*ast.ScriptStatement)
+	menuCommand := myScript.Body.Statements[0].(*ast.CommandStatement)
+	testConstant(t, "menu 1 2", fmt.Sprintf("%s %s", menuCommand.Name.Value, strings.Join(menuCommand.Args, " ")))
+	testConstant(t, "menu", myScript.Body.Statements[1].(*ast.CommandStatement).Args[0])
+	testConstant(t, "menu", program.TopLevelStatements[2].(*ast.TextStatement).Name.Value)
+	testConstant(t, "template", myScript.Body.Statements[2].(*ast.LabelStatement).Name.Value)
+	testConstant(t, "template", myScript.Body.Statements[3].(*ast.CommandStatement).Args[0])
+
+	templateScript := program.TopLevelStatements[3].(*ast.ScriptStatement)
+	testConstant(t, "template", templateScript.Name.Value)
+	testConstant(t, "lock", templateScript.Body.Statements[0].(*ast.CommandStatement).Name.Value)
+
+	switchDefaultScript := program.TopLevelStatements[4].(*ast.ScriptStatement)
+	testConstant(t, "switch_default", switchDefaultScript.Name.Value)
+	testConstant(t, "switch_default", switchDefaultScript.Body.Statements[0].(*ast.CommandStatement).Args[0])
+}
+
+func TestLocalFlags(t *testing.T) {
+	input := `
+script Npc {
+	let talkedOnce: flag
+	let talkedTwice: flag
+	let count: var
+	if (flag(talkedTwice)) {
+		end
+	} elif (!flag(talkedOnce)) {
+		setflag(talkedOnce)
+		call(Helper)
+	} else {
+		setflag(talkedTwice)
+		clearflag(talkedOnce)
+	}
+}
+
+script Helper {
+	let seen: flag
+	setflag(seen)
+}
+`
+	l := lexer.New(input)
+	p := New(l, CommandConfig{
+		TempVars:  []string{"VAR_TEMP_0"},
+		TempFlags: []string{"FLAG_TEMP_1", "FLAG_TEMP_2", "FLAG_TEMP_3"},
+	}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	npc := program.TopLevelStatements[0].(*ast.ScriptStatement)
+	testConstant(t, "FLAG_TEMP_1", npc.Locals[0].Value)
+	testConstant(t, "FLAG_TEMP_2", npc.Locals[1].Value)
+	testConstant(t, "VAR_TEMP_0", npc.Locals[2].Value)
+	ifStmt := npc.Body.Statements[0].(*ast.IfStatement)
+	testConstant(t, "FLAG_TEMP_2", ifStmt.Consequence.Expression.(*ast.OperatorExpression).Operand.Literal)
+	elif := ifStmt.ElifConsequences[0]
+	testConstant(t, "FLAG_TEMP_1", elif.Expression.(*ast.OperatorExpression).Operand.Literal)
+	testConstant(t, "FLAG_TEMP_1", elif.Body.Statements[0].(*ast.CommandStatement).Args[0])
+	testConstant(t, "FLAG_TEMP_2", ifStmt.ElseConsequence.Statements[0].(*ast.CommandStatement).Args[0])
+	testConstant(t, "FLAG_TEMP_1", ifStmt.ElseConsequence.Statements[1].(*ast.CommandStatement).Args[0])
+
+	helper := program.TopLevelStatements[1].(*ast.ScriptStatement)
+	testConstant(t, "FLAG_TEMP_3", helper.Locals[0].Value)
+	testConstant(t, "FLAG_TEMP_3", helper.Body.Statements[0].(*ast.CommandStatement).Args[0])
+}
+
+func TestMapScriptLocals(t *testing.T) {
+	input := `
+mapscripts MyMapScripts {
+	MAP_SCRIPT_ON_LOAD {
+		let counter: var
+		setvar(counter, 1)
+		if (var(counter) == 1) {
+			call(Helper)
+		}
+	}
+	MAP_SCRIPT_ON_FRAME_TABLE [
+		VAR_TEMP_5, 0 {
+			let seen: flag
+			setflag(seen)
+			msgbox("seen counter")
+		}
 	]
 }
+
+script Helper {
+	let count: var
+	setvar(count, 2)
+}
 `
 	l := lexer.New(input)
-	p := New(l, CommandConfig{}, "", "", 0, nil)
+	p := New(l, CommandConfig{
+		TempVars:  []string{"VAR_TEMP_0", "VAR_TEMP_1"},
+		TempFlags: []string{"FLAG_TEMP_1"},
+	}, "", "", 0, nil)
 	program, err := p.ParseProgram()
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
-	script := program.TopLevelStatements[0].(*ast.ScriptStatement)
-	command1 := script.Body.Statements[0].(*ast.CommandStatement)
-	command2 := script.Body.Statements[1].(*ast.CommandStatement)
-	command3 := script.Body.Statements[2].(*ast.CommandStatement)
-	testConstant(t, "2", command1.Args[0])
-	testConstant(t, "2 + FLAG_TEMP_1 + 3 - FLAG_BASE", command2.Args[1])
-	testConstant(t, "( 2 + 1 - 1 ) - ( ( 2 + 1 + 2 ) )", command3.Args[1])
-
-	if1 := script.Body.Statements[3].(*ast.IfStatement)
-	op1 := if1.Consequence.Expression.(*ast.OperatorExpression)
-	testConstant(t, "2 + 1 - 1", op1.Operand.Literal)
+	mapScripts := program.TopLevelStatements[0].(*ast.MapScriptsStatement)
+	onLoad := mapScripts.MapScripts[0].Script
+	testConstant(t, "VAR_TEMP_0", onLoad.Locals[0].Value)
+	testConstant(t, "VAR_TEMP_0", onLoad.Body.Statements[0].(*ast.CommandStatement).Args[0])
+	ifStmt := onLoad.Body.Statements[1].(*ast.IfStatement)
+	testConstant(t, "VAR_TEMP_0", ifStmt.Consequence.Expression.(*ast.OperatorExpression).Operand.Literal)
 
-	if2 := script.Body.Statements[4].(*ast.IfStatement)
-	op2 := if2.Consequence.Expression.(*ast.OperatorExpression)
-	testConstant(t, "2 + 1", op2.Operand.Literal)
-	testConstant(t, "2 + 1 - 1 + 1", op2.ComparisonValue)
+	onFrame := mapScripts.TableMapScripts[0].Entries[0].Script
+	testConstant(t, "FLAG_TEMP_1", onFrame.Body.Statements[0].(*ast.CommandStatement).Args[0])
+	// Only identifiers are replaced, so text that mentions a local is unchanged.
+	testConstant(t, "seen counter$", program.Texts[0].Value)
 
-	sw := script.Body.Statements[5].(*ast.SwitchStatement)
-	testConstant(t, "2 + 1 - 1", sw.Operand.Literal)
-	testConstant(t, "2", sw.Cases[0].Value.Literal)
+	// The map script calls Helper, so their locals can't share a temp var.
+	helper := program.TopLevelStatements[1].(*ast.ScriptStatement)
+	testConstant(t, "VAR_TEMP_1", helper.Locals[0].Value)
+}
 
-	ms := program.TopLevelStatements[1].(*ast.MapScriptsStatement)
-	frame := ms.TableMapScripts[0].Entries[0]
-	testConstant(t, "2 + 1 - 1", frame.Condition.Literal)
-	testConstant(t, "2", frame.Comparison)
+func TestMenuStatements(t *testing.T) {
+	input := `
+script Shop {
+	menu(1, 2) {
+		"Buy": { buy }
+		"Sell": { sell }
+		cancel: { end }
+	}
 }
+`
+	l := lexer.New(input)
+	p := New(l, CommandConfig{
+		Menu: &MenuCommand{
+			Name:        "multichoice_list",
+			Args:        []string{"{x}", "{y}", "{list}", "{count}"},
+			ResultVar:   "VAR_RESULT",
+			CancelValue: "MULTI_B_PRESSED",
+		},
+	}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
 
-func testConstant(t *testing.T, expected, actual string) {
-	if actual != expected {
-		t.Errorf("Expected '%s', but got '%s'", expected, actual)
+	script := program.TopLevelStatements[0].(*ast.ScriptStatement)
+	command := script.Body.Statements[0].(*ast.CommandStatement)
+	testConstant(t, "multichoice_list 1, 2, Shop_MenuList_0, 2", fmt.Sprintf("%s %s", command.Name.Value, strings.Join(command.Args, ", ")))
+	switchStmt := script.Body.Statements[1].(*ast.SwitchStatement)
+	testConstant(t, "VAR_RESULT", switchStmt.Operand.Literal)
+	if len(switchStmt.Cases) != 3 {
+		t.Fatalf("len(switchStmt.Cases) != 3. Got '%d' instead.", len(switchStmt.Cases))
 	}
+	testSwitchCase(t, switchStmt.Cases[0], "0", 1)
+	testSwitchCase(t, switchStmt.Cases[1], "1", 1)
+	testSwitchCase(t, switchStmt.Cases[2], "MULTI_B_PRESSED", 1)
+	// Each case points at the line of the option that it came from.
+	for i, expectedLine := range []int{4, 5, 6} {
+		if switchStmt.Cases[i].Value.LineNumber != expectedLine {
+			t.Errorf("switchStmt.Cases[%d].Value.LineNumber != %d. Got '%d' instead.", i, expectedLine, switchStmt.Cases[i].Value.LineNumber)
+		}
+	}
+
+	list := program.TopLevelStatements[1].(*ast.RawStatement)
+	testConstant(t, "Shop_MenuList_0:\n\t.4byte Shop_Text_0\n\t.4byte Shop_Text_1", list.Value)
+	testConstant(t, "Buy$", program.Texts[0].Value)
+	testConstant(t, "Sell$", program.Texts[1].Value)
 }
 
 type labelTest struct {
@@ -1371,6 +2835,110 @@ script Test {
 	testSwitchCase(t, switchStmt.Cases[2], "6", 1)
 }
 
+func TestConditionCommands(t *testing.T) {
+	input := `
+script Test {
+	if (yesno("Save?")) {
+		save()
+	} elif (!yesno("Quit?")) {
+		stay()
+	}
+	while (yesno("Again?") == NO) {
+		retry()
+	}
+}
+`
+	l := lexer.New(input)
+	p := New(l, CommandConfig{
+		ConditionCommands: map[string]ConditionCommand{
+			"yesno": {Command: "msgbox", Args: []string{"MSGBOX_YESNO"}, VarName: "VAR_RESULT", Value: "YES"},
+		},
+	}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	scriptStmt := program.TopLevelStatements[0].(*ast.ScriptStatement)
+	ifStmt := scriptStmt.Body.Statements[0].(*ast.IfStatement)
+	expression := ifStmt.Consequence.Expression.(*ast.OperatorExpression)
+	testConditionExpression(t, expression, token.VAR, "VAR_RESULT", token.EQ, "YES", ast.NormalComparison)
+	if expression.PreambleStatement == nil || expression.PreambleStatement.Name.Value != "msgbox" {
+		t.Fatalf("condition command preamble should be 'msgbox'")
+	}
+	if len(expression.PreambleStatement.Args) != 2 || expression.PreambleStatement.Args[1] != "MSGBOX_YESNO" {
+		t.Fatalf("condition command preamble args should end with 'MSGBOX_YESNO'. Got '%v' instead.", expression.PreambleStatement.Args)
+	}
+	testConditionExpression(t, ifStmt.ElifConsequences[0].Expression.(*ast.OperatorExpression), token.VAR, "VAR_RESULT", token.NEQ, "YES", ast.NormalComparison)
+	whileStmt := scriptStmt.Body.Statements[1].(*ast.WhileStatement)
+	testConditionExpression(t, whileStmt.Consequence.Expression.(*ast.OperatorExpression), token.VAR, "VAR_RESULT", token.EQ, "NO", ast.NormalComparison)
+}
+
+func TestScriptTemplates(t *testing.T) {
+	input := `
+const UNUSED = 1
+template npc {
+	epilogue: release, end;
+	prologue: lock, faceplayer
+}
+
+script(npc) Talk {
+	if (flag(FLAG_1)) {
+		end
+	}
+	msgbox(Talk_Text)
+}
+
+script(sign, local) Sign {
+	msgbox(Sign_Text)
+	end
+}
+`
+	l := lexer.New(input)
+	p := New(l, CommandConfig{
+		Templates: map[string]ScriptTemplate{
+			"npc":  {Prologue: []string{"lockall"}},
+			"sign": {Prologue: []string{"setvar VAR_0x8004, 1"}, Epilogue: []string{"releaseall", "end"}},
+		},
+	}, "", "", 0, nil)
+	program, err := p.ParseProgram()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	talk := program.TopLevelStatements[0].(*ast.ScriptStatement)
+	if len(talk.Body.Statements) != 4 {
+		t.Fatalf("len(talk.Body.Statements) != 4. Got '%d' instead.", len(talk.Body.Statements))
+	}
+	for i, name := range []string{"lock", "faceplayer"} {
+		if command := talk.Body.Statements[i].(*ast.CommandStatement); command.Name.Value != name {
+			t.Errorf("talk.Body.Statements[%d] != '%s'. Got '%s' instead.", i, name, command.Name.Value)
+		}
+	}
+	ifStmt := talk.Body.Statements[2].(*ast.IfStatement)
+	if len(ifStmt.Consequence.Body.Statements) != 2 || ifStmt.Consequence.Body.Statements[0].(*ast.CommandStatement).Name.Value != "release" {
+		t.Errorf("expected 'release' to be injected before the early 'end'")
+	}
+	if len(talk.Epilogue) != 2 {
+		t.Fatalf("len(talk.Epilogue) != 2. Got '%d' instead.", len(talk.Epilogue))
+	}
+
+	sign := program.TopLevelStatements[1].(*ast.ScriptStatement)
+	if sign.Scope != token.LOCAL {
+		t.Errorf("sign.Scope != LOCAL. Got '%s' instead.", sign.Scope)
+	}
+	prologue := sign.Body.Statements[0].(*ast.CommandStatement)
+	if prologue.Name.Value != "setvar" || strings.Join(prologue.Args, ", ") != "VAR_0x8004, 1" {
+		t.Errorf("config prologue should be 'setvar VAR_0x8004, 1'. Got '%s %s' instead.", prologue.Name.Value, strings.Join(prologue.Args, ", "))
+	}
+	if sign.Epilogue != nil {
+		t.Errorf("sign.Epilogue should be nil, since the script ends with 'end'")
+	}
+	if len(sign.Body.Statements) != 4 || sign.Body.Statements[2].(*ast.CommandStatement).Name.Value != "releaseall" {
+		t.Errorf("expected 'releaseall' to be injected before the final 'end'")
+	}
+}
+
 func TestErrors(t *testing.T) {
 	tests := []struct {
 		input              string
@@ -1667,8 +3235,8 @@ script MyScript {
 script MyScript {
 	if (var(FLAG_1) ||) {
 	}`,
-			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 19, Utf8CharStart: 19, CharEnd: 20, Utf8CharEnd: 20, Message: "left side of binary expression must be var(), flag(), defeated(), or autovar command. Instead, found ')'"},
-			expectedErrorMsg: "line 3: left side of binary expression must be var(), flag(), defeated(), or autovar command. Instead, found ')'",
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 19, Utf8CharStart: 19, CharEnd: 20, Utf8CharEnd: 20, Message: "left side of binary expression must be var(), flag(), defeated(), autovar command, or condition command. Instead, found ')'"},
+			expectedErrorMsg: "line 3: left side of binary expression must be var(), flag(), defeated(), autovar command, or condition command. Instead, found ')'",
 		},
 		{
 			input: `
@@ -1743,8 +3311,8 @@ script MyScript {
 		bar
 	}
 }`,
-			expectedError:    ParseError{LineNumberStart: 5, LineNumberEnd: 5, CharStart: 9, Utf8CharStart: 9, CharEnd: 12, Utf8CharEnd: 12, Message: "left side of binary expression must be var(), flag(), defeated(), or autovar command. Instead, found 'fla'"},
-			expectedErrorMsg: "line 5: left side of binary expression must be var(), flag(), defeated(), or autovar command. Instead, found 'fla'",
+			expectedError:    ParseError{LineNumberStart: 5, LineNumberEnd: 5, CharStart: 9, Utf8CharStart: 9, CharEnd: 12, Utf8CharEnd: 12, Message: "left side of binary expression must be var(), flag(), defeated(), autovar command, or condition command. Instead, found 'fla'"},
+			expectedErrorMsg: "line 5: left side of binary expression must be var(), flag(), defeated(), autovar command, or condition command. Instead, found 'fla'",
 		},
 		{
 			input: `
@@ -1926,6 +3494,17 @@ movement Script1_Movement_0 {
 		},
 		{
 			input: `
+script Script1 {
+	call({ end })
+}
+script Script1_Script_0 {
+	end
+}`,
+			expectedError:    ParseError{LineNumberStart: 5, LineNumberEnd: 5, CharStart: 7, Utf8CharStart: 7, CharEnd: 23, Utf8CharEnd: 23, Message: "duplicate script label 'Script1_Script_0'. Choose a unique label that won't clash with the auto-generated script labels"},
+			expectedErrorMsg: "line 5: duplicate script label 'Script1_Script_0'. Choose a unique label that won't clash with the auto-generated script labels",
+		},
+		{
+			input: `
 script Script1 {
 	applymovent(moves walk_up)
 }`,
@@ -2227,8 +3806,8 @@ mapscripts MyMapScripts {
 		if (sdf)
 	}
 }`,
-			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 6, Utf8CharStart: 6, CharEnd: 9, Utf8CharEnd: 9, Message: "left side of binary expression must be var(), flag(), defeated(), or autovar command. Instead, found 'sdf'"},
-			expectedErrorMsg: "line 4: left side of binary expression must be var(), flag(), defeated(), or autovar command. Instead, found 'sdf'",
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 6, Utf8CharStart: 6, CharEnd: 9, Utf8CharEnd: 9, Message: "left side of binary expression must be var(), flag(), defeated(), autovar command, or condition command. Instead, found 'sdf'"},
+			expectedErrorMsg: "line 4: left side of binary expression must be var(), flag(), defeated(), autovar command, or condition command. Instead, found 'sdf'",
 		},
 		{
 			input: `
@@ -2295,8 +3874,8 @@ mapscripts MyMapScripts {
 		{
 			input: `
 script(asdf) MyScript {}`,
-			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 7, Utf8CharStart: 7, CharEnd: 11, Utf8CharEnd: 11, Message: "scope modifier must be 'global' or 'local', but got 'asdf' instead"},
-			expectedErrorMsg: "line 2: scope modifier must be 'global' or 'local', but got 'asdf' instead",
+			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 7, Utf8CharStart: 7, CharEnd: 11, Utf8CharEnd: 11, Message: "unknown template 'asdf'. Templates must be declared before they are used"},
+			expectedErrorMsg: "line 2: unknown template 'asdf'. Templates must be declared before they are used",
 		},
 		{
 			input: `
@@ -2374,6 +3953,276 @@ script MyScript {
 			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 19, Utf8CharStart: 19, CharEnd: 24, Utf8CharEnd: 24, Message: "missing ')' when evaluating 'value'"},
 			expectedErrorMsg: "line 3: missing ')' when evaluating 'value'",
 		},
+		{
+			input: `
+script MyScript {
+	let counter: var
+	let counter: var
+}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 5, Utf8CharStart: 5, CharEnd: 12, Utf8CharEnd: 12, Message: "duplicate local 'counter'. Must use unique local and parameter names within a script"},
+			expectedErrorMsg: "line 4: duplicate local 'counter'. Must use unique local and parameter names within a script",
+		},
+		{
+			input: `
+script MyScript {
+	let counter: number
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 14, Utf8CharStart: 14, CharEnd: 20, Utf8CharEnd: 20, Message: "invalid type 'number' for local 'counter'. Expected 'var' or 'flag'"},
+			expectedErrorMsg: "line 3: invalid type 'number' for local 'counter'. Expected 'var' or 'flag'",
+		},
+		{
+			input: `
+script MyScript {
+	let counter var
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 1, Utf8CharStart: 1, CharEnd: 16, Utf8CharEnd: 16, Message: "missing ':' after local name 'counter'"},
+			expectedErrorMsg: "line 3: missing ':' after local name 'counter'",
+		},
+		{
+			input: `
+script MyScript {
+	let counter: var
+	if (flag(counter)) {}
+}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 10, Utf8CharStart: 10, CharEnd: 17, Utf8CharEnd: 17, Message: "local 'counter' is a var, so it can't be used in flag()"},
+			expectedErrorMsg: "line 4: local 'counter' is a var, so it can't be used in flag()",
+		},
+		{
+			input: `
+script Caller {
+	let a: var
+	call(Callee)
+}
+script Callee {
+	let b: var
+	let c: var
+}`,
+			expectedError:    ParseError{LineNumberStart: 8, LineNumberEnd: 8, CharStart: 5, Utf8CharStart: 5, CharEnd: 6, Utf8CharEnd: 6, Message: "cannot allocate local 'c' because all 2 temp vars are already used by script 'Callee' or the scripts in its call chain"},
+			expectedErrorMsg: "line 8: cannot allocate local 'c' because all 2 temp vars are already used by script 'Callee' or the scripts in its call chain",
+		},
+		{
+			input: `
+script MyScript {
+	let talked: flag
+	if (var(talked) == 1) {}
+}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 9, Utf8CharStart: 9, CharEnd: 15, Utf8CharEnd: 15, Message: "local 'talked' is a flag, so it can't be used in var()"},
+			expectedErrorMsg: "line 4: local 'talked' is a flag, so it can't be used in var()",
+		},
+		{
+			input: `
+script MyScript {
+	let a: flag
+	let b: flag
+	setflag(FLAG_TEMP_1)
+}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 5, Utf8CharStart: 5, CharEnd: 6, Utf8CharEnd: 6, Message: "cannot allocate local 'b' because all 2 temp flags are already used by script 'MyScript' or the scripts in its call chain"},
+			expectedErrorMsg: "line 4: cannot allocate local 'b' because all 2 temp flags are already used by script 'MyScript' or the scripts in its call chain",
+		},
+		{
+			input: `
+script Callee(a, b) {}
+script MyScript {
+	Callee(1)
+}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 1, Utf8CharStart: 1, CharEnd: 7, Utf8CharEnd: 7, Message: "script 'Callee' expects 2 arguments, but got 1"},
+			expectedErrorMsg: "line 4: script 'Callee' expects 2 arguments, but got 1",
+		},
+		{
+			input: `
+script Callee(a, b) {}
+script Swap(a, b) {
+	let x: var
+	let y: var
+	Callee(b, a)
+}`,
+			expectedError:    ParseError{LineNumberStart: 6, LineNumberEnd: 6, CharStart: 1, Utf8CharStart: 1, CharEnd: 7, Utf8CharEnd: 7, Message: "cannot allocate local '__arg_temp_0' because all 2 temp vars are already used by script 'Swap' or the scripts in its call chain"},
+			expectedErrorMsg: "line 6: cannot allocate local '__arg_temp_0' because all 2 temp vars are already used by script 'Swap' or the scripts in its call chain",
+		},
+		{
+			input: `
+script Callee(a, b, c) {}`,
+			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 20, Utf8CharStart: 20, CharEnd: 21, Utf8CharEnd: 21, Message: "script 'Callee' has too many parameters. Only 2 script arg vars are configured in \"script_arg_vars\""},
+			expectedErrorMsg: "line 2: script 'Callee' has too many parameters. Only 2 script arg vars are configured in \"script_arg_vars\"",
+		},
+		{
+			input: `
+script Callee(a, a) {}`,
+			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 17, Utf8CharStart: 17, CharEnd: 18, Utf8CharEnd: 18, Message: "duplicate parameter 'a' for script 'Callee'"},
+			expectedErrorMsg: "line 2: duplicate parameter 'a' for script 'Callee'",
+		},
+		{
+			input: `
+script Callee(a) {
+	let a: var
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 5, Utf8CharStart: 5, CharEnd: 6, Utf8CharEnd: 6, Message: "duplicate local 'a'. Must use unique local and parameter names within a script"},
+			expectedErrorMsg: "line 3: duplicate local 'a'. Must use unique local and parameter names within a script",
+		},
+		{
+			input: `
+script Callee(a) {}
+script MyScript {
+	var(VAR_1) = Callee(1)
+}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 14, Utf8CharStart: 14, CharEnd: 20, Utf8CharEnd: 20, Message: "cannot assign the return value of script 'Callee', because it never returns a value with 'return(value)'"},
+			expectedErrorMsg: "line 4: cannot assign the return value of script 'Callee', because it never returns a value with 'return(value)'",
+		},
+		{
+			input: `
+script MyScript {
+	var(VAR_1) = checkitem(ITEM_POTION)
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 14, Utf8CharStart: 14, CharEnd: 23, Utf8CharEnd: 23, Message: "cannot assign the return value of 'checkitem', because it isn't a script with a parameter list"},
+			expectedErrorMsg: "line 3: cannot assign the return value of 'checkitem', because it isn't a script with a parameter list",
+		},
+		{
+			input: `
+script MyScript {
+	var(VAR_1) += 1
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 1, Utf8CharStart: 1, CharEnd: 13, Utf8CharEnd: 13, Message: "expected '=' after var operator. Only the return values of scripts can be assigned to vars"},
+			expectedErrorMsg: "line 3: expected '=' after var operator. Only the return values of scripts can be assigned to vars",
+		},
+		{
+			input: `
+script MyScript {
+	while {
+		call({ break })
+	}
+}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 9, Utf8CharStart: 9, CharEnd: 14, Utf8CharEnd: 14, Message: "'break' statement outside of any break-able scope"},
+			expectedErrorMsg: "line 4: 'break' statement outside of any break-able scope",
+		},
+		{
+			input: `
+script MyScript {
+	call({ msgbox("Hi")
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 1, Utf8CharStart: 1, CharEnd: 5, Utf8CharEnd: 5, Message: "missing closing parenthesis for command 'call'"},
+			expectedErrorMsg: "line 3: missing closing parenthesis for command 'call'",
+		},
+		{
+			input: `
+script MyScript {
+	menu(1, 2) {
+		BUY: { buy }
+	}
+}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 2, Utf8CharStart: 2, CharEnd: 5, Utf8CharEnd: 5, Message: "invalid menu option 'BUY'. Expected a string or 'cancel'"},
+			expectedErrorMsg: "line 4: invalid menu option 'BUY'. Expected a string or 'cancel'",
+		},
+		{
+			input: `
+script MyScript {
+	menu(1) {
+		"Buy": { buy }
+	}
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 1, Utf8CharStart: 1, CharEnd: 8, Utf8CharEnd: 8, Message: "menu position must have 2 values, x and y, but got 1"},
+			expectedErrorMsg: "line 3: menu position must have 2 values, x and y, but got 1",
+		},
+		{
+			input: `
+script MyScript {
+	menu(1, 2) {
+	}
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 4, CharStart: 1, Utf8CharStart: 1, CharEnd: 2, Utf8CharEnd: 2, Message: "menu statement has no options"},
+			expectedErrorMsg: "line 3: menu statement has no options",
+		},
+		{
+			input: `
+script MyScript {
+	menu(1, 2) {
+		"Yes": { end }
+		cancel: { end }
+	}
+}`,
+			expectedError:    ParseError{LineNumberStart: 5, LineNumberEnd: 5, CharStart: 2, Utf8CharStart: 2, CharEnd: 8, Utf8CharEnd: 8, Message: "cannot use 'cancel' option, because no \"cancel_value\" is configured for the \"menu\" command"},
+			expectedErrorMsg: "line 5: cannot use 'cancel' option, because no \"cancel_value\" is configured for the \"menu\" command",
+		},
+		{
+			input: `
+script MyScript {
+	menu(1, 2) {
+		"Buy": { buy }
+		cancel: { end }
+		cancel: { end }
+	}
+}`,
+			expectedError:    ParseError{LineNumberStart: 6, LineNumberEnd: 6, CharStart: 2, Utf8CharStart: 2, CharEnd: 8, Utf8CharEnd: 8, Message: "multiple 'cancel' options found in menu statement. Only one 'cancel' option is allowed"},
+			expectedErrorMsg: "line 6: multiple 'cancel' options found in menu statement. Only one 'cancel' option is allowed",
+		},
+		{
+			input: `
+template npc { prologue: lock }
+template npc { epilogue: end }`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 9, Utf8CharStart: 9, CharEnd: 12, Utf8CharEnd: 12, Message: "duplicate template 'npc'"},
+			expectedErrorMsg: "line 3: duplicate template 'npc'",
+		},
+		{
+			input: `
+template npc { middle: lock }`,
+			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 15, Utf8CharStart: 15, CharEnd: 21, Utf8CharEnd: 21, Message: "invalid template section 'middle'. Expected 'prologue' or 'epilogue'"},
+			expectedErrorMsg: "line 2: invalid template section 'middle'. Expected 'prologue' or 'epilogue'",
+		},
+		{
+			input: `
+template npc { prologue: lock; prologue: lock }`,
+			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 31, Utf8CharStart: 31, CharEnd: 39, Utf8CharEnd: 39, Message: "duplicate 'prologue' section in template 'npc'"},
+			expectedErrorMsg: "line 2: duplicate 'prologue' section in template 'npc'",
+		},
+		{
+			input: `
+template npc { prologue: msgbox("Hi") }`,
+			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 25, Utf8CharStart: 25, CharEnd: 31, Utf8CharEnd: 31, Message: "command 'msgbox' in template 'npc' can't use strings, movements, or block literals"},
+			expectedErrorMsg: "line 2: command 'msgbox' in template 'npc' can't use strings, movements, or block literals",
+		},
+		{
+			input: `
+template npc { prologue: lock faceplayer }`,
+			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 30, Utf8CharStart: 30, CharEnd: 40, Utf8CharEnd: 40, Message: "expected ',', ';', or '}' after command 'lock' in template 'npc', but got 'faceplayer' instead"},
+			expectedErrorMsg: "line 2: expected ',', ';', or '}' after command 'lock' in template 'npc', but got 'faceplayer' instead",
+		},
+		{
+			input: `
+template npc { prologue: lock }
+template sign { prologue: lockall }
+script(npc, sign) MyScript {}`,
+			expectedError:    ParseError{LineNumberStart: 4, LineNumberEnd: 4, CharStart: 12, Utf8CharStart: 12, CharEnd: 16, Utf8CharEnd: 16, Message: "script can only use one template, but got 'sign' as well"},
+			expectedErrorMsg: "line 4: script can only use one template, but got 'sign' as well",
+		},
+		{
+			input: `
+script(local, ) MyScript {}`,
+			expectedError:    ParseError{LineNumberStart: 2, LineNumberEnd: 2, CharStart: 14, Utf8CharStart: 14, CharEnd: 15, Utf8CharEnd: 15, Message: "script modifier must be 'global', 'local', or a template, but got ')' instead"},
+			expectedErrorMsg: "line 2: script modifier must be 'global', 'local', or a template, but got ')' instead",
+		},
+		{
+			input: `
+script MyScript {
+	raw(foo) ` + "`" + `end` + "`" + `
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 5, Utf8CharStart: 5, CharEnd: 8, Utf8CharEnd: 8, Message: "raw statement modifier must be 'noreturn', but got 'foo' instead"},
+			expectedErrorMsg: "line 3: raw statement modifier must be 'noreturn', but got 'foo' instead",
+		},
+		{
+			input: `
+script MyScript {
+	raw(noreturn ` + "`" + `end` + "`" + `
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 5, Utf8CharStart: 5, CharEnd: 13, Utf8CharEnd: 13, Message: "missing ')' after raw statement modifier. Got 'end' instead"},
+			expectedErrorMsg: "line 3: missing ')' after raw statement modifier. Got 'end' instead",
+		},
+		{
+			input: `
+script MyScript {
+	raw end
+}`,
+			expectedError:    ParseError{LineNumberStart: 3, LineNumberEnd: 3, CharStart: 1, Utf8CharStart: 1, CharEnd: 8, Utf8CharEnd: 8, Message: "raw statement must begin with a backtick character '`'"},
+			expectedErrorMsg: "line 3: raw statement must begin with a backtick character '`'",
+		},
 	}
 
 	for _, test := range tests {
@@ -2389,6 +4238,11 @@ func testForParseError(t *testing.T, input string, expectedError ParseError, exp
 		AutoVarCommands: map[string]AutoVarCommand{
 			"specialvar": {VarNameArgPosition: &two},
 		},
+		TempVars:        []string{"VAR_TEMP_0", "VAR_TEMP_1"},
+		TempFlags:       []string{"FLAG_TEMP_1", "FLAG_TEMP_2"},
+		ScriptArgVars:   []string{"VAR_0x8004", "VAR_0x8005"},
+		ScriptReturnVar: "VAR_RESULT",
+		Menu:            &MenuCommand{Name: "multichoice_list", Args: []string{"{list}"}, ResultVar: "VAR_RESULT"},
 	}, "../font_config.json", "", 0, nil)
 	_, err := p.ParseProgram()
 	if err == nil {
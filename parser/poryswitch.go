@@ -0,0 +1,177 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/lexer"
+	"github.com/huderlem/poryscript/token"
+)
+
+// parserState is a snapshot of the parser's position in the token stream.
+type parserState struct {
+	lexer        lexer.Lexer
+	tokens       [5]token.Token
+	conditionals []conditionalFrame
+	directiveErr error
+	braceDepth   int
+	lastLine     int
+}
+
+func (p *Parser) saveState() parserState {
+	return parserState{
+		lexer:        p.l.Snapshot(),
+		tokens:       [5]token.Token{p.curToken, p.peekToken, p.peek2Token, p.peek3Token, p.peek4Token},
+		conditionals: append([]conditionalFrame{}, p.conditionals...),
+		directiveErr: p.directiveErr,
+		braceDepth:   p.braceDepth,
+		lastLine:     p.lastLineNumber,
+	}
+}
+
+func (p *Parser) restoreState(state parserState) {
+	p.l.Restore(state.lexer)
+	p.curToken, p.peekToken, p.peek2Token, p.peek3Token, p.peek4Token = state.tokens[0], state.tokens[1], state.tokens[2], state.tokens[3], state.tokens[4]
+	p.conditionals = append([]conditionalFrame{}, state.conditionals...)
+	p.directiveErr = state.directiveErr
+	p.braceDepth = state.braceDepth
+	p.lastLineNumber = state.lastLine
+}
+
+// Parses a poryswitch statement at the top level, which includes or excludes
+// whole top-level statements, such as:
+//
+//	poryswitch(GAME_VERSION) {
+//	    RUBY { script MyScript { ... } }
+//	    _ { ... }
+//	}
+//
+// Only the selected case is parsed, so that the other cases can't define
+// constants, texts, or anything else. The other cases are skipped entirely.
+func (p *Parser) parseTopLevelPoryswitchStatement() ([]ast.Statement, error) {
+	startToken := p.curToken
+	switchCase, switchValue, err := p.parsePoryswitchHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []ast.Statement
+	var fallback *parserState
+	var fallbackToken token.Token
+	matched := false
+	for p.curToken.Type != token.RBRACE {
+		if p.curToken.Type == token.EOF {
+			return nil, NewParseError(startToken, "missing closing curly braces for poryswitch statement")
+		}
+		if p.curToken.Type != token.IDENT && p.curToken.Type != token.INT {
+			return nil, NewParseError(p.curToken, fmt.Sprintf("invalid poryswitch case '%s'. Expected a simple identifier", p.curToken.Literal))
+		}
+		caseToken := p.curToken
+		caseValues, err := p.parsePoryswitchCaseValues(switchCase)
+		if err != nil {
+			return nil, err
+		}
+		if p.curToken.Type != token.LBRACE {
+			return nil, NewParseError(p.curToken, fmt.Sprintf("invalid token '%s' after top-level poryswitch case '%s'. Expected '{'", p.curToken.Literal, strings.Join(caseValues, ", ")))
+		}
+		p.nextToken()
+		if !matched && containsString(caseValues, switchValue) {
+			statements, err = p.parseTopLevelPoryswitchCase(caseToken)
+			if err != nil {
+				return nil, err
+			}
+			matched = true
+		} else {
+			if containsString(caseValues, "_") && fallback == nil {
+				state := p.saveState()
+				fallback = &state
+				fallbackToken = caseToken
+			}
+			if err := p.skipPoryswitchCase(caseToken); err != nil {
+				return nil, err
+			}
+		}
+		p.nextToken()
+	}
+
+	if !matched && fallback != nil {
+		// The fallback case is only known to be needed after all of the
+		// other cases were checked, so go back and parse it now.
+		end := p.saveState()
+		p.restoreState(*fallback)
+		statements, err = p.parseTopLevelPoryswitchCase(fallbackToken)
+		if err != nil {
+			return nil, err
+		}
+		p.restoreState(end)
+	} else if !matched && p.enableEnvironmentErrors {
+		return nil, NewParseError(startToken, fmt.Sprintf("no poryswitch case found for '%s=%s', which was specified with the '-s' option", switchCase, switchValue))
+	}
+	return statements, nil
+}
+
+// Parses the values of a poryswitch case, such as "RUBY, SAPPHIRE". Afterwards,
+// the current token is the one that follows the last value.
+func (p *Parser) parsePoryswitchCaseValues(switchName string) ([]string, error) {
+	values := []string{}
+	for {
+		if p.curToken.Literal != "_" {
+			p.addSwitchReference(switchName, p.curToken.Literal, p.curToken)
+		}
+		values = append(values, p.curToken.Literal)
+		p.nextToken()
+		if p.curToken.Type != token.COMMA {
+			return values, nil
+		}
+		p.nextToken()
+		if p.curToken.Type != token.IDENT && p.curToken.Type != token.INT {
+			return nil, NewParseError(p.curToken, fmt.Sprintf("invalid poryswitch case '%s'. Expected a simple identifier", p.curToken.Literal))
+		}
+	}
+}
+
+// Parses the top-level statements of a poryswitch case, up to the case's
+// closing curly brace.
+func (p *Parser) parseTopLevelPoryswitchCase(caseToken token.Token) ([]ast.Statement, error) {
+	statements := []ast.Statement{}
+	for p.curToken.Type != token.RBRACE {
+		if p.curToken.Type == token.EOF {
+			return nil, NewParseError(caseToken, fmt.Sprintf("missing closing curly brace for poryswitch case '%s'", caseToken.Literal))
+		}
+		stmts, err := p.parseTopLevelStatementOrPoryswitch()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, stmts...)
+		p.nextToken()
+	}
+	return statements, nil
+}
+
+// Skips over the tokens of a poryswitch case that wasn't selected, up to the
+// case's closing curly brace.
+func (p *Parser) skipPoryswitchCase(caseToken token.Token) error {
+	depth := 0
+	for !(p.curToken.Type == token.RBRACE && depth == 0) {
+		switch p.curToken.Type {
+		case token.EOF:
+			return NewParseError(caseToken, fmt.Sprintf("missing closing curly brace for poryswitch case '%s'", caseToken.Literal))
+		case token.LBRACE:
+			depth++
+		case token.RBRACE:
+			depth--
+		}
+		p.nextToken()
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
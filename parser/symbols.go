@@ -0,0 +1,363 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/movement"
+	"github.com/huderlem/poryscript/token"
+)
+
+// SymbolConfig is a list of the symbols that scripts can reference, such as
+// flags, vars, trainers, and items, along with the names of the movement commands.
+// It's loaded from a JSON file, such as:
+//
+//	{
+//	    "symbols": ["FLAG_BADGE01_GET", "VAR_TEMP_1", "ITEM_POTION"],
+//	    "movements": ["walk_up", "walk_down", "step_end"]
+//	}
+type SymbolConfig struct {
+	Symbols   []string `json:"symbols"`
+	Movements []string `json:"movements"`
+}
+
+// LoadSymbolConfig reads a symbol config from a JSON file.
+func LoadSymbolConfig(filepath string) (SymbolConfig, error) {
+	var config SymbolConfig
+	bytes, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(bytes, &config)
+	return config, err
+}
+
+// UndefinedSymbolMode controls what happens when a script references a symbol
+// that isn't known.
+type UndefinedSymbolMode int
+
+const (
+	// Symbols aren't checked.
+	UndefinedSymbolsOff UndefinedSymbolMode = iota
+	// Undefined symbols are reported as warnings.
+	UndefinedSymbolsWarn
+	// Undefined symbols are errors.
+	UndefinedSymbolsError
+)
+
+// symbolSet is a set of known names. The names are also kept sorted, so that
+// suggestions for misspelled names are deterministic.
+type symbolSet struct {
+	names  map[string]bool
+	sorted []string
+}
+
+func newSymbolSet() *symbolSet {
+	return &symbolSet{names: make(map[string]bool)}
+}
+
+func (s *symbolSet) add(name string) {
+	if !s.names[name] {
+		s.names[name] = true
+		s.sorted = append(s.sorted, name)
+	}
+}
+
+func (s *symbolSet) contains(name string) bool {
+	return s.names[name]
+}
+
+func (s *symbolSet) empty() bool {
+	return len(s.sorted) == 0
+}
+
+// Finds the known name that's closest to the given misspelled name. Returns
+// an empty string if none of the names are close enough.
+func (s *symbolSet) suggest(name string) string {
+	maxDistance := len(name) / 3
+	if maxDistance > 3 {
+		maxDistance = 3
+	}
+	best := ""
+	bestDistance := maxDistance + 1
+	for _, candidate := range s.sorted {
+		if abs(len(candidate)-len(name)) >= bestDistance {
+			continue
+		}
+		if distance := editDistance(name, candidate); distance < bestDistance {
+			best = candidate
+			bestDistance = distance
+		}
+	}
+	return best
+}
+
+// SetKnownSymbols sets the symbols and movement commands that scripts can
+// reference. Constants read from C headers are also known symbols. When mode
+// isn't UndefinedSymbolsOff, the operands of flag(), var(), defeated(), and
+// switch statements, mart items, and movement commands are checked against
+// them. Nothing is checked if there aren't any known symbols of that kind.
+func (p *Parser) SetKnownSymbols(config SymbolConfig, mode UndefinedSymbolMode) {
+	p.symbolConfig = config
+	p.undefinedSymbolMode = mode
+	p.knownSymbols = nil
+	p.knownMovements = nil
+}
+
+// SetMovementCatalogue sets the catalogue of movement commands. Its commands
+// are known movement commands, and its terminators end movements.
+func (p *Parser) SetMovementCatalogue(catalogue *movement.Catalogue) {
+	p.movementCatalogue = catalogue
+	p.knownSymbols = nil
+	p.knownMovements = nil
+}
+
+// Builds the sets of known symbols the first time they're needed, since the
+// constants from C headers can be set after the symbol config.
+func (p *Parser) loadKnownSymbols() {
+	if p.knownSymbols != nil {
+		return
+	}
+	p.knownSymbols = newSymbolSet()
+	for _, name := range p.symbolConfig.Symbols {
+		p.knownSymbols.add(name)
+	}
+	if p.headerConstants != nil {
+		for _, name := range p.headerConstants.Names() {
+			p.knownSymbols.add(name)
+		}
+	}
+	sort.Strings(p.knownSymbols.sorted)
+	p.knownMovements = newSymbolSet()
+	for _, name := range p.symbolConfig.Movements {
+		p.knownMovements.add(name)
+	}
+	if p.movementCatalogue != nil {
+		for _, name := range p.movementCatalogue.Names() {
+			p.knownMovements.add(name)
+		}
+	}
+	sort.Strings(p.knownMovements.sorted)
+}
+
+// Checks that the identifiers in an operand, such as "FLAG_BASE + 1", are
+// known symbols.
+func (p *Parser) validateSymbols(tokens []token.Token) error {
+	for _, tok := range tokens {
+		if err := p.validateSymbol(tok); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Parser) validateSymbol(tok token.Token) error {
+	if p.undefinedSymbolMode == UndefinedSymbolsOff || tok.Type != token.IDENT {
+		return nil
+	}
+	p.loadKnownSymbols()
+	if p.knownSymbols.empty() {
+		return nil
+	}
+	name := tok.Literal
+	if p.knownSymbols.contains(name) || p.isScriptLocal(name) {
+		return nil
+	}
+	if _, ok := p.constants[name]; ok {
+		return nil
+	}
+	return p.reportUndefinedSymbol(tok, "symbol", p.knownSymbols)
+}
+
+func (p *Parser) validateMovement(tok token.Token) error {
+	if p.undefinedSymbolMode == UndefinedSymbolsOff {
+		return nil
+	}
+	p.loadKnownSymbols()
+	if p.knownMovements.empty() {
+		return nil
+	}
+	if p.knownMovements.contains(tok.Literal) {
+		return nil
+	}
+	if _, ok := p.constants[tok.Literal]; ok {
+		return nil
+	}
+	return p.reportUndefinedSymbol(tok, "movement command", p.knownMovements)
+}
+
+func (p *Parser) isMovementTerminator(name string) bool {
+	if p.movementCatalogue != nil {
+		if command, ok := p.movementCatalogue.Lookup(name); ok {
+			return command.Terminator
+		}
+	}
+	return name == "step_end"
+}
+
+// Warns about movement commands that come after a terminator, such as
+// step_end, since they're never run.
+func (p *Parser) checkMovementTerminators(commands []token.Token) {
+	for i, command := range commands {
+		if !p.isMovementTerminator(command.Literal) || i == len(commands)-1 {
+			continue
+		}
+		next := commands[i+1]
+		p.warnings = append(p.warnings, ast.Warning{
+			Type:            ast.WarningUnreachableCode,
+			LineNumberStart: next.LineNumber,
+			LineNumberEnd:   next.EndLineNumber,
+			CharStart:       next.StartCharIndex,
+			Utf8CharStart:   next.StartUtf8CharIndex,
+			CharEnd:         next.EndCharIndex,
+			Utf8CharEnd:     next.EndUtf8CharIndex,
+			Message:         fmt.Sprintf("unreachable movement command '%s'. The movement ends at the '%s' command on line %d", next.Literal, command.Literal, command.LineNumber),
+		})
+		return
+	}
+}
+
+func (p *Parser) reportUndefinedSymbol(tok token.Token, kind string, known *symbolSet) error {
+	message := fmt.Sprintf("undefined %s '%s'", kind, tok.Literal)
+	if suggestion := known.suggest(tok.Literal); suggestion != "" {
+		message += fmt.Sprintf(". Did you mean '%s'?", suggestion)
+	}
+	if p.undefinedSymbolMode == UndefinedSymbolsError {
+		return NewParseError(tok, message)
+	}
+	p.warnings = append(p.warnings, ast.Warning{
+		Type:            ast.WarningUndefinedSymbol,
+		LineNumberStart: tok.LineNumber,
+		LineNumberEnd:   tok.EndLineNumber,
+		CharStart:       tok.StartCharIndex,
+		Utf8CharStart:   tok.StartUtf8CharIndex,
+		CharEnd:         tok.EndCharIndex,
+		Utf8CharEnd:     tok.EndUtf8CharIndex,
+		Message:         message,
+	})
+	return nil
+}
+
+// Returns the kind of a symbol, such as "flag" for "FLAG_BADGE01_GET", using
+// the longest matching prefix in the command config's "symbol_prefixes".
+func (p *Parser) symbolKind(name string) string {
+	kind := ""
+	longest := 0
+	for prefix, prefixKind := range p.commandConfig.SymbolPrefixes {
+		if len(prefix) > longest && strings.HasPrefix(name, prefix) {
+			kind = prefixKind
+			longest = len(prefix)
+		}
+	}
+	return kind
+}
+
+// Reports whether any symbol prefix is mapped to the given kind, which means
+// that the kinds of symbols can be checked for it.
+func (p *Parser) isSymbolKind(kind string) bool {
+	for _, prefixKind := range p.commandConfig.SymbolPrefixes {
+		if prefixKind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Warns when a symbol in an operand has a different kind than the one that's
+// expected, such as a var in a flag() operand. Constants are checked using
+// their values.
+func (p *Parser) checkSymbolKind(tok token.Token, expectedKind, usage string) {
+	if tok.Type != token.IDENT || !p.isSymbolKind(expectedKind) {
+		return
+	}
+	for _, name := range identifierRegex.FindAllString(p.tryReplaceWithConstant(tok.Literal), -1) {
+		kind := p.symbolKind(name)
+		if kind == "" || kind == expectedKind {
+			continue
+		}
+		message := fmt.Sprintf("'%s' is %s, but %s expects %s", name, withArticle(kind), usage, withArticle(expectedKind))
+		if name != tok.Literal {
+			message = fmt.Sprintf("'%s' is %s ('%s'), but %s expects %s", tok.Literal, withArticle(kind), name, usage, withArticle(expectedKind))
+		}
+		p.warnings = append(p.warnings, ast.Warning{
+			Type:            ast.WarningSymbolKindMismatch,
+			LineNumberStart: tok.LineNumber,
+			LineNumberEnd:   tok.EndLineNumber,
+			CharStart:       tok.StartCharIndex,
+			Utf8CharStart:   tok.StartUtf8CharIndex,
+			CharEnd:         tok.EndCharIndex,
+			Utf8CharEnd:     tok.EndUtf8CharIndex,
+			Message:         message,
+		})
+		return
+	}
+}
+
+func withArticle(word string) string {
+	if word != "" && strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an " + word
+	}
+	return "a " + word
+}
+
+// Reports whether the name is a local or parameter of the script that's
+// currently being parsed.
+func (p *Parser) isScriptLocal(name string) bool {
+	return p.lookupScriptLocal(name) != nil
+}
+
+func (p *Parser) lookupScriptLocal(name string) *ast.LocalDeclaration {
+	for _, local := range p.scriptParams {
+		if local.Name.Value == name {
+			return local
+		}
+	}
+	for _, local := range p.scriptLocals {
+		if local.Name.Value == name {
+			return local
+		}
+	}
+	return nil
+}
+
+// Computes the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min(values ...int) int {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
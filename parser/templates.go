@@ -0,0 +1,250 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huderlem/poryscript/ast"
+	"github.com/huderlem/poryscript/token"
+)
+
+// ScriptTemplate describes a template from the command config. Each command is
+// written the same way it's emitted, such as "lock" or "setvar VAR_0x8004, 1".
+type ScriptTemplate struct {
+	Prologue []string `json:"prologue"`
+	Epilogue []string `json:"epilogue"`
+}
+
+// scriptTemplate holds the commands that a template injects into its scripts.
+// The prologue runs at the start of the script, and the epilogue runs when the
+// script reaches its end, as well as before every 'end' inside the script.
+type scriptTemplate struct {
+	prologue []*ast.CommandStatement
+	epilogue []*ast.CommandStatement
+}
+
+// Parses the modifiers of a script statement, such as "script(local, npc)".
+// A script can have a scope modifier and a template.
+func (p *Parser) parseScriptModifiers() (token.Type, *scriptTemplate, error) {
+	scope := token.Type(token.GLOBAL)
+	var template *scriptTemplate
+	if !p.peekTokenIs(token.LPAREN) {
+		return scope, nil, nil
+	}
+	p.nextToken()
+	for {
+		switch p.peekToken.Type {
+		case token.GLOBAL, token.LOCAL:
+			scope = p.peekToken.Type
+		case token.IDENT:
+			if template != nil {
+				return scope, nil, NewParseError(p.peekToken, fmt.Sprintf("script can only use one template, but got '%s' as well", p.peekToken.Literal))
+			}
+			var err error
+			template, err = p.getTemplate(p.peekToken)
+			if err != nil {
+				return scope, nil, err
+			}
+		default:
+			return scope, nil, NewParseError(p.peekToken, fmt.Sprintf("script modifier must be 'global', 'local', or a template, but got '%s' instead", p.peekToken.Literal))
+		}
+		p.nextToken()
+		if p.peekTokenIs(token.RPAREN) {
+			break
+		}
+		if !p.peekTokenIs(token.COMMA) {
+			return scope, nil, NewParseError(p.curToken, fmt.Sprintf("missing ')' after scope modifier. Got '%s' instead", p.peekToken.Literal))
+		}
+		p.nextToken()
+	}
+	p.nextToken()
+	return scope, template, nil
+}
+
+// Looks up a template by name. Templates declared in the script take priority
+// over the templates in the command config.
+func (p *Parser) getTemplate(nameToken token.Token) (*scriptTemplate, error) {
+	name := nameToken.Literal
+	if template, ok := p.templates[name]; ok {
+		return template, nil
+	}
+	config, ok := p.commandConfig.Templates[name]
+	if !ok {
+		return nil, NewParseError(nameToken, fmt.Sprintf("unknown template '%s'. Templates must be declared before they are used", name))
+	}
+	template := &scriptTemplate{
+		prologue: parseTemplateConfigCommands(config.Prologue, nameToken),
+		epilogue: parseTemplateConfigCommands(config.Epilogue, nameToken),
+	}
+	p.templates[name] = template
+	return template, nil
+}
+
+func parseTemplateConfigCommands(commands []string, tok token.Token) []*ast.CommandStatement {
+	result := []*ast.CommandStatement{}
+	for _, command := range commands {
+		parts := strings.SplitN(strings.TrimSpace(command), " ", 2)
+		commandStmt := &ast.CommandStatement{
+			Token: tok,
+			Name: &ast.Identifier{
+				Token: tok,
+				Value: parts[0],
+			},
+			Args: []string{},
+		}
+		if len(parts) > 1 {
+			for _, arg := range strings.Split(parts[1], ",") {
+				commandStmt.Args = append(commandStmt.Args, strings.TrimSpace(arg))
+			}
+		}
+		result = append(result, commandStmt)
+	}
+	return result
+}
+
+// Parses a template statement, such as:
+//
+//	template npc {
+//	    prologue: lock, faceplayer;
+//	    epilogue: release, end
+//	}
+func (p *Parser) parseTemplateStatement() error {
+	templateToken := p.curToken
+	if err := p.expectPeek(token.IDENT); err != nil {
+		return NewRangeParseError(templateToken, p.peekToken, "missing name for template")
+	}
+	name := p.curToken.Literal
+	if _, ok := p.templates[name]; ok {
+		return NewParseError(p.curToken, fmt.Sprintf("duplicate template '%s'", name))
+	}
+	if err := p.expectPeek(token.LBRACE); err != nil {
+		return NewRangeParseError(templateToken, p.peekToken, fmt.Sprintf("missing opening curly brace for template '%s'", name))
+	}
+	braceToken := p.curToken
+	p.nextToken()
+
+	template := &scriptTemplate{
+		prologue: []*ast.CommandStatement{},
+		epilogue: []*ast.CommandStatement{},
+	}
+	sections := map[string]bool{}
+	for p.curToken.Type != token.RBRACE {
+		if p.curToken.Type == token.EOF {
+			return NewParseError(braceToken, fmt.Sprintf("missing closing curly brace for template '%s'", name))
+		}
+		section := p.curToken.Literal
+		if p.curToken.Type != token.IDENT || (section != "prologue" && section != "epilogue") {
+			return NewParseError(p.curToken, fmt.Sprintf("invalid template section '%s'. Expected 'prologue' or 'epilogue'", section))
+		}
+		if sections[section] {
+			return NewParseError(p.curToken, fmt.Sprintf("duplicate '%s' section in template '%s'", section, name))
+		}
+		sections[section] = true
+		if err := p.expectPeek(token.COLON); err != nil {
+			return NewParseError(p.curToken, fmt.Sprintf("missing ':' after template section '%s'", section))
+		}
+		commands, err := p.parseTemplateCommands(name)
+		if err != nil {
+			return err
+		}
+		if section == "prologue" {
+			template.prologue = commands
+		} else {
+			template.epilogue = commands
+		}
+		if p.curToken.Type == token.SEMICOLON {
+			p.nextToken()
+		}
+	}
+	p.templates[name] = template
+	return nil
+}
+
+// Parses a template section's list of commands, which are separated by commas.
+// The section ends at a ';' or the template's closing curly brace.
+func (p *Parser) parseTemplateCommands(templateName string) ([]*ast.CommandStatement, error) {
+	commands := []*ast.CommandStatement{}
+	for {
+		if err := p.expectPeek(token.IDENT); err != nil {
+			return nil, NewParseError(p.peekToken, fmt.Sprintf("expected command in template '%s', but got '%s' instead", templateName, p.peekToken.Literal))
+		}
+		command, impData, err := p.parseCommandStatement(templateName)
+		if err != nil {
+			return nil, err
+		}
+		if len(impData.texts) > 0 || len(impData.movements) > 0 || len(impData.scripts) > 0 {
+			return nil, NewParseError(command.Token, fmt.Sprintf("command '%s' in template '%s' can't use strings, movements, or block literals", command.Name.Value, templateName))
+		}
+		commands = append(commands, command)
+		p.nextToken()
+		switch p.curToken.Type {
+		case token.COMMA:
+			continue
+		case token.SEMICOLON, token.RBRACE:
+			return commands, nil
+		}
+		return nil, NewParseError(p.curToken, fmt.Sprintf("expected ',', ';', or '}' after command '%s' in template '%s', but got '%s' instead", command.Name.Value, templateName, p.curToken.Literal))
+	}
+}
+
+// Injects the template's prologue at the start of the script, and its epilogue
+// before every 'end' in the script and in the block literals written inside it.
+// When the script's body can fall through to its end, the epilogue runs there, too.
+func (p *Parser) applyTemplate(template *scriptTemplate, scriptStmt *ast.ScriptStatement, impData *impData) {
+	// The 'end' that follows the injected epilogue is the one already in the script.
+	beforeEnd := template.epilogue
+	if n := len(beforeEnd); n > 0 && beforeEnd[n-1].Name.Value == "end" {
+		beforeEnd = beforeEnd[:n-1]
+	}
+	bodies := []*ast.BlockStatement{scriptStmt.Body}
+	for _, script := range impData.scripts {
+		bodies = append(bodies, script.body)
+	}
+	for _, body := range bodies {
+		blocks := []*ast.BlockStatement{body}
+		for _, child := range body.AllChildren() {
+			if block, ok := child.(*ast.BlockStatement); ok {
+				blocks = append(blocks, block)
+			}
+		}
+		for _, block := range blocks {
+			statements := make([]ast.Statement, 0, len(block.Statements))
+			for _, stmt := range block.Statements {
+				if commandStmt, ok := stmt.(*ast.CommandStatement); ok && commandStmt.Name.Value == "end" {
+					statements = append(statements, copyTemplateCommands(beforeEnd, commandStmt.Token)...)
+				}
+				statements = append(statements, stmt)
+			}
+			block.Statements = statements
+		}
+	}
+
+	body := scriptStmt.Body
+	body.Statements = append(copyTemplateCommands(template.prologue, scriptStmt.Token), body.Statements...)
+	if n := len(body.Statements); n > 0 {
+		if commandStmt, ok := body.Statements[n-1].(*ast.CommandStatement); ok {
+			switch commandStmt.Name.Value {
+			case "end", "return", "goto":
+				return
+			}
+		}
+	}
+	scriptStmt.Epilogue = copyTemplateCommands(template.epilogue, scriptStmt.Token)
+}
+
+// Creates fresh copies of a template's commands, since later passes modify
+// the commands of each script separately.
+func copyTemplateCommands(commands []*ast.CommandStatement, tok token.Token) []ast.Statement {
+	statements := make([]ast.Statement, 0, len(commands))
+	for _, command := range commands {
+		statements = append(statements, &ast.CommandStatement{
+			Token: tok,
+			Name: &ast.Identifier{
+				Token: tok,
+				Value: command.Name.Value,
+			},
+			Args: append([]string{}, command.Args...),
+		})
+	}
+	return statements
+}
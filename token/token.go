@@ -41,6 +41,7 @@ const (
 	AUTOSTRING = "AUTOSTRING"
 	RAWSTRING  = "RAWSTRING"
 	STRINGTYPE = "STRINGTYPE"
+	DIRECTIVE  = "DIRECTIVE"
 
 	// Operators
 	ASSIGN = "="
@@ -56,8 +57,9 @@ const (
 	MUL    = "*"
 
 	// Delimeters
-	COMMA = ","
-	COLON = ":"
+	COMMA     = ","
+	COLON     = ":"
+	SEMICOLON = ";"
 
 	LPAREN   = "("
 	RPAREN   = ")"